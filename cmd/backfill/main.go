@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/suiguo/yscan/config"
+	"github.com/suiguo/yscan/services/bg"
+)
+
+// 补扫历史区间：backfill -chain eth -from 100 -to 200 [-rpc url,url] [-gonum 4] [-name job]
+func main() {
+	chainName := flag.String("chain", "", "链：eth/bsc/tron")
+	from := flag.Int64("from", 0, "起始高度（含）")
+	to := flag.Int64("to", 0, "结束高度（含）")
+	rpc := flag.String("rpc", "", "节点地址，多个用逗号分隔，空=默认节点")
+	gonum := flag.Int("gonum", 4, "补扫并发数")
+	name := flag.String("name", "", "任务名，同名任务中断后从 checkpoint 继续")
+	db := flag.String("db", "backfill.db", "checkpoint 文件")
+	flag.Parse()
+
+	chain := bg.NewNodeChain(*chainName)
+	if !chain.IsValid() {
+		fmt.Println("unknown chain", *chainName)
+		os.Exit(2)
+	}
+	urls := []string{config.Rpc(chain)}
+	if *rpc != "" {
+		urls = strings.Split(*rpc, ",")
+	}
+	disk, err := bg.NewBoltDisk(*db)
+	if err != nil {
+		fmt.Println("open db", err)
+		os.Exit(2)
+	}
+	defer disk.Close()
+	// 只跑补扫，-gonum 是补扫任务的并发数；实时分片数用不上，Backfill 也不改实时扫描的 checkpoint
+	scan := bg.NewWork(1, disk, nil, bg.ChainScanCfg{Chain: chain, Rpc: urls})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for slice := range scan.Result() {
+			for _, val := range slice {
+				fmt.Println("scan", val.BlockNum, val.TxId)
+			}
+		}
+	}()
+	last := time.Now()
+	err = scan.Backfill(ctx, bg.BackfillJob{Chain: chain, From: *from, To: *to, Name: *name, GoNum: *gonum}, func(p bg.BackfillProgress) {
+		if time.Since(last) < time.Second && p.Done < p.Total {
+			return
+		}
+		last = time.Now()
+		fmt.Printf("progress %d/%d\n", p.Done, p.Total)
+	})
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	// 超时未排空时最后几个区块的 checkpoint 可能没保存，下次同名任务会重扫
+	shutdownErr := scan.Shutdown(shutdownCtx)
+	<-done
+	if shutdownErr != nil {
+		fmt.Println("shutdown", shutdownErr)
+	}
+	if err != nil {
+		fmt.Println("backfill", err)
+	}
+	if err != nil || shutdownErr != nil {
+		disk.Close()
+		os.Exit(1)
+	}
+}
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/suiguo/yscan/config"
 	"github.com/suiguo/yscan/services/bg"
 )
 
 func main() {
+	// checkpoint 存本地文件，重启后从上次位置继续
+	path := os.Getenv("YSCAN_DB")
+	if path == "" {
+		path = "yscan.db"
+	}
+	disk, err := bg.NewBoltDisk(path)
+	if err != nil {
+		fmt.Println("open db", err)
+		os.Exit(1)
+	}
+	defer disk.Close()
 	scan := bg.NewWork(10,
-		nil,
+		disk,
 		nil,
 		// logger.GetLogger("tag").Zap(),
 		bg.ChainScanCfg{
@@ -22,9 +39,25 @@ func main() {
 					Decimals:  6,
 				},
 			}, //默认支持本币
-			Rpc: []string{config.Rpc(bg.CHAIN_TRON), ""},
+			Endpoints: []bg.Endpoint{
+				{
+					URL:  config.Rpc(bg.CHAIN_TRON),
+					Keys: apiKeys(os.Getenv("TRON_PRO_API_KEY")), //多个 key 用逗号分隔，轮换使用
+				},
+			},
 		})
 	scan.Run()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		// 等分片保存 checkpoint 后关闭 Result，下面的循环随之退出
+		if err := scan.Shutdown(ctx); err != nil {
+			fmt.Println("shutdown", err)
+		}
+	}()
 	for slice := range scan.Result() {
 		for _, val := range slice {
 			if !val.Success {
@@ -33,3 +66,13 @@ func main() {
 		}
 	}
 }
+
+func apiKeys(val string) []string {
+	out := make([]string, 0)
+	for _, k := range strings.Split(val, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			out = append(out, k)
+		}
+	}
+	return out
+}
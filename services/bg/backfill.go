@@ -0,0 +1,303 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errScanClosed = errors.New("scan closed")
+
+// errRolledBack 投递期间发生了回滚，结果作废
+var errRolledBack = errors.New("rolled back during delivery")
+
+// ErrBackfillSkipped 补扫完成但有高度重试用完被跳过，记在该任务自己的死信里，同名任务重跑时先重试这些高度
+var ErrBackfillSkipped = errors.New("backfill skipped blocks")
+
+// BackfillJob 历史区间补扫，与实时扫描并行，checkpoint 独立，不影响实时分片；GoNum 只是补扫的并发数，与实时分片数无关
+type BackfillJob struct {
+	Chain ChainType
+	From  int64  // 起始高度（含），>=1
+	To    int64  // 结束高度（含），需已达到确认数
+	Name  string // 任务名，区分 checkpoint，同名任务中断后从 checkpoint 继续；空=from-to
+	GoNum int    // 并发分片数，0=1
+}
+
+func (j BackfillJob) name() string {
+	if j.Name != "" {
+		return j.Name
+	}
+	return fmt.Sprintf("%d-%d", j.From, j.To)
+}
+
+// BackfillProgress 补扫进度
+type BackfillProgress struct {
+	Chain ChainType
+	Name  string
+	From  int64
+	To    int64
+	Done  int64 // 已处理的高度数，不含被跳过的
+	Dead  int64 // 重试用完被跳过的高度数
+	Total int64
+}
+
+func (s *Scan) getBackfillKey(t *storeTool, name string, idx int) string {
+	return fmt.Sprintf("%s:backfill:%s:shard:%d:checkpoint", t.ChainType().Name(), name, idx)
+}
+
+// getBackfillDeadPrefix 补扫任务自己的死信列表，不进实时扫描的死信，也不影响连续水位
+func (s *Scan) getBackfillDeadPrefix(t *storeTool, name string) string {
+	return fmt.Sprintf("%s:backfill:%s:dead", t.ChainType().Name(), name)
+}
+
+// shardCount 分片 idx 在 [from, last] 内的高度数
+func shardCount(from, last, goNum int64, idx int) int64 {
+	first := shardStart(from-1, goNum, idx)
+	if last < first {
+		return 0
+	}
+	return (last-first)/goNum + 1
+}
+
+// Backfill 补扫 [From, To]，阻塞到完成、出错、ctx 取消或 Scan 关闭
+// 交易照常投递到 Result；每推进一个高度回调一次 progress，可为 nil
+// 有高度重试用完被跳过时返回 ErrBackfillSkipped 并列出这些高度，同名任务重跑时先重试它们
+func (s *Scan) Backfill(ctx context.Context, job BackfillJob, progress func(BackfillProgress)) error {
+	t := s.tool(job.Chain)
+	if t == nil {
+		return fmt.Errorf("chain %s not configured", job.Chain.Name())
+	}
+	if job.From <= 0 || job.To < job.From {
+		return fmt.Errorf("invalid backfill range [%d, %d]", job.From, job.To)
+	}
+	callCtx, cancel := s.callCtx(ctx, t)
+	head, err := t.GetBlockNum(callCtx)
+	if ct, ok := t.ScanTool.(ConfirmTool); ok && t.pending != nil && err == nil {
+		// 快速模式只补扫已固化的区块
+		head, err = ct.SolidHeight(callCtx)
+	}
+	cancel()
+	if err != nil {
+		return err
+	}
+	if job.To > head-int64(t.cfg.ConfirmNum) {
+		return fmt.Errorf("backfill to %d beyond confirmed head %d", job.To, head-int64(t.cfg.ConfirmNum))
+	}
+	if err := s.loadSafe(t); err != nil {
+		return err
+	}
+	name := job.name()
+	goNum := int64(max(job.GoNum, 1))
+	marks := make([]int64, goNum)
+	for i := range marks {
+		last, err := s.getKey(t, s.getBackfillKey(t, name, i))
+		if err != nil {
+			return err
+		}
+		marks[i] = max(last, job.From-1)
+	}
+	deadPrefix := s.getBackfillDeadPrefix(t, name)
+	var dead []int64
+	err = s.tracked(func() (err error) {
+		dead, err = s.retryBackfillDead(ctx, t, deadPrefix)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex // 保护 marks、dead 和 progress 回调
+	report := func(idx int, h int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		marks[idx] = h
+		if progress == nil {
+			return
+		}
+		p := BackfillProgress{Chain: job.Chain, Name: name, From: job.From, To: job.To, Total: job.To - job.From + 1}
+		for i, last := range marks {
+			p.Done += shardCount(job.From, min(last, job.To), goNum, i)
+		}
+		p.Dead = int64(len(dead))
+		p.Done -= p.Dead
+		progress(p)
+	}
+	addDead := func(h int64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if slices.Contains(dead, h) {
+			return nil
+		}
+		dead = append(dead, h)
+		if err := s.writeDead(t, deadPrefix, dead, len(dead)-1); err != nil {
+			dead = dead[:len(dead)-1]
+			return err
+		}
+		return nil
+	}
+
+	startTs := time.Now()
+	errs := make([]error, goNum)
+	var wg sync.WaitGroup
+	for i := 0; i < int(goNum); i++ {
+		if !s.acquire() {
+			errs[i] = errScanClosed
+			break
+		}
+		wg.Add(1)
+		idx := i
+		go func() {
+			defer wg.Done()
+			defer s.wg.Done()
+			errs[idx] = s.backfillShard(ctx, t, name, goNum, idx, marks[idx], job.To, report, addDead)
+		}()
+	}
+	wg.Wait()
+	err = errors.Join(errs...)
+	if err == nil && len(dead) > 0 {
+		slices.Sort(dead)
+		err = fmt.Errorf("%w: %v", ErrBackfillSkipped, dead)
+	}
+	if s.zap_l != nil {
+		fields := []zap.Field{
+			zap.String("event", "backfill_done"),
+			zap.String("chain", job.Chain.Name()),
+			zap.String("name", name),
+			zap.Int64("from", job.From),
+			zap.Int64("to", job.To),
+			zap.Int64("elapsed_ms", time.Since(startTs).Milliseconds()),
+		}
+		if err != nil {
+			fields = append(fields, zap.String("err", err.Error()))
+		}
+		s.zap_l.Info("scan.backfill", fields...)
+	}
+	return err
+}
+
+// loadSafe 补扫只用连续水位给交易填 SafeHeight：实时扫描还没恢复进度时直接读存储里的水位
+// 不走 load，单独跑补扫的进程不会按自己的分片数迁移实时分片的 checkpoint 和死信
+func (s *Scan) loadSafe(t *storeTool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.loaded {
+		return nil
+	}
+	safe, err := s.getKey(t, s.getWatermarkKey(t))
+	if err != nil {
+		return err
+	}
+	t.safe = safe
+	return nil
+}
+
+// retryBackfillDead 同名任务上次跳过的高度各重试一次，成功的投递后移出，返回仍失败的高度
+func (s *Scan) retryBackfillDead(ctx context.Context, t *storeTool, prefix string) ([]int64, error) {
+	dead, err := s.readDead(t, prefix)
+	if err != nil || len(dead) == 0 {
+		return dead, err
+	}
+	remain := make([]int64, 0, len(dead))
+	for i, h := range dead {
+		block, err := s.getBlock(ctx, t, h)
+		if err == nil {
+			// 死信槽位里本来就是 h，写回原值只为让事务存储把交易和它一起提交
+			err = s.backfillCommit(ctx, t, fmt.Sprintf("%s:%d", prefix, i), block)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if s.zap_l != nil {
+				s.zap_l.Warn("scan.backfill",
+					zap.String("event", "dead_retry_failed"),
+					zap.String("chain", t.ChainType().Name()),
+					zap.Int64("block", h),
+					zap.String("err", err.Error()),
+				)
+			}
+			remain = append(remain, h)
+		}
+	}
+	if err := s.writeDead(t, prefix, remain, len(dead)); err != nil {
+		return nil, err
+	}
+	return remain, nil
+}
+
+// backfillShard 处理 (last, to] 内 % goNum == idx 的高度，每个高度投递后保存 checkpoint；重试用完的高度交给 dead 记入任务死信
+func (s *Scan) backfillShard(ctx context.Context, t *storeTool, name string, goNum int64, idx int, last, to int64, report func(int, int64), dead func(int64) error) error {
+	batch := t.batchSize()
+	for h := shardStart(last, goNum, idx); h <= to; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stop:
+			return errScanClosed
+		default:
+		}
+		heights := make([]int64, 0, batch)
+		for ; len(heights) < batch && h <= to; h += goNum {
+			heights = append(heights, h)
+		}
+		blocks, err := s.getBlocks(ctx, t, heights)
+		for i, height := range heights {
+			var block *BlockLog
+			if i < len(blocks) {
+				block = blocks[i]
+			} else {
+				// 拉取失败的高度单独重试，之后的高度重新拉取
+				if err == nil {
+					err = fmt.Errorf("block %d missing in batch", height)
+				}
+				if block = s.retryBlock(ctx, t, idx, height, err, dead); block == nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					return fmt.Errorf("backfill block %d: %w", height, err)
+				}
+				h = height + goNum
+			}
+			if err := s.backfillCommit(ctx, t, s.getBackfillKey(t, name, idx), block); err != nil {
+				return err
+			}
+			report(idx, height)
+			if i >= len(blocks) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// backfillCommit 投递补扫区块的交易并保存补扫 checkpoint；历史区块不做分叉检测，也不改实时 checkpoint
+// 投递不持有 t.mu，避免慢 Sink 卡住实时分片；期间发生回滚且该高度已不在连续水位内则不保存，任务重跑时重扫
+func (s *Scan) backfillCommit(ctx context.Context, t *storeTool, key string, block *BlockLog) error {
+	t.mu.Lock()
+	safe, epoch := t.safe, t.epoch
+	t.mu.Unlock()
+	for _, tran := range block.Trans {
+		// 补扫范围已固化，快速模式的 pending 直接按确认发出
+		if tran.Event == "" || tran.Event == EventPending {
+			tran.Event = EventConfirmed
+		}
+		tran.SafeHeight = safe
+	}
+	if td, ok := s.txDisk(t); ok {
+		return td.SaveWithTrans(ctx, nil, key, block.Num, block.Trans)
+	}
+	if !s.deliver(ctx, block.Trans) {
+		return deliverErr(ctx)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.epoch != epoch && block.Num > t.safe {
+		return fmt.Errorf("backfill block %d: %w", block.Num, errRolledBack)
+	}
+	return s.saveKey(t, key, block.Num)
+}
@@ -0,0 +1,39 @@
+package bg
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBackfillKeepsLiveLayout(t *testing.T) {
+	d := newMemStore()
+	s := NewScan(4, nil, nil)
+	tl := newTestTool(d, toolOpts{tool: newFakeChain(CHAIN_ETH, 200), marks: make([]int64, 4)})
+	s.chain.Store(CHAIN_ETH, tl)
+	sink := &recordSink{}
+	s.SetSink(sink)
+	// 实时扫描按 2 个分片跑在同一个存储上
+	live := map[string]int64{s.getShardsKey(tl): 2, s.getSaveKey(tl, 0): 100, s.getSaveKey(tl, 1): 101, s.getWatermarkKey(tl): 101}
+	if err := d.SaveBatch(live); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Backfill(context.Background(), BackfillJob{Chain: CHAIN_ETH, From: 10, To: 13, Name: "t", GoNum: 4}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.received(); len(got) != 4 {
+		t.Fatalf("delivered %s", got)
+	}
+	for key, want := range live {
+		if got, _, _ := d.Load(key); got != want {
+			t.Fatalf("%s = %d, want %d", key, got, want)
+		}
+	}
+	for i := 2; i < 4; i++ {
+		if _, found, _ := d.Load(s.getSaveKey(tl, i)); found {
+			t.Fatalf("live shard %d checkpoint written", i)
+		}
+	}
+	if tl.safe != 101 {
+		t.Fatalf("safe height %d", tl.safe)
+	}
+}
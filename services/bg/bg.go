@@ -29,6 +29,33 @@ func (c ChainType) Name() string {
 	}
 	return "Unknow"
 }
+
+// Coin 链的本币，用于手续费
+func (c ChainType) Coin() string {
+	switch c {
+	case CHAIN_BSC:
+		return "BNB"
+	case CHAIN_ETH:
+		return "ETH"
+	case CHAIN_TRON:
+		return "TRX"
+	}
+	return ""
+}
+
+// BlockTime 出块时间，作为默认扫描间隔
+func (c ChainType) BlockTime() time.Duration {
+	switch c {
+	case CHAIN_BSC:
+		return 750 * time.Millisecond
+	case CHAIN_ETH:
+		return 12 * time.Second
+	case CHAIN_TRON:
+		return 3 * time.Second
+	}
+	return 2 * time.Second
+}
+
 func (c ChainType) IsValid() bool { //暂不支持这种链
 	return c.Name() != "Unknow"
 }
@@ -47,11 +74,14 @@ func NewNodeChain(chain string) ChainType {
 }
 
 type WorkHandler struct {
-	ctx    context.Context
-	zap_l  *zap.Logger
-	cancel context.CancelFunc
-	once   sync.Once
-	scan   *Scan
+	ctx      context.Context // 取消后中断进行中的 RPC
+	zap_l    *zap.Logger
+	cancel   context.CancelFunc
+	once     sync.Once
+	scan     *Scan
+	quit     chan struct{} // 关闭后不再触发新一轮扫描
+	quitOnce sync.Once
+	loopDone chan struct{}
 }
 
 func (w *WorkHandler) Run() {
@@ -59,37 +89,124 @@ func (w *WorkHandler) Run() {
 		go w.work()
 	})
 }
+
+// work 每条链按自己的间隔独立调度
 func (w *WorkHandler) work() {
-	idx := 0
+	defer close(w.loopDone)
+	var wg sync.WaitGroup
+	w.scan.chain.Range(func(_, v any) bool {
+		t, ok := v.(*storeTool)
+		if !ok {
+			return true
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.workChain(t)
+		}()
+		return true
+	})
+	wg.Wait()
+}
+
+func (w *WorkHandler) workChain(t *storeTool) {
+	interval := t.pollInterval()
 	for {
-		idx++
-		select {
-		case <-w.ctx.Done():
+		if !w.scan.processTool(w.ctx, t) {
 			return
-		default:
-			w.scan.Process()
-			time.Sleep(time.Second * 2)
 		}
-		if idx%5 == 0 {
-			idx = 0
+		select {
+		case <-w.quit:
+			return
+		case <-time.After(interval):
 		}
 	}
 }
+
+// quitLoop 不再触发新一轮扫描
+func (w *WorkHandler) quitLoop() {
+	w.quitOnce.Do(func() {
+		close(w.quit)
+		// 未 Run 过则不会再启动
+		w.once.Do(func() { close(w.loopDone) })
+	})
+}
+
+// Stop 停止触发新扫描并立即中断进行中的调用，不等待分片结束，也不关闭 Result
+// 需要处理完当前区块、保存 checkpoint 后再退出时用 Shutdown(ctx)
 func (w *WorkHandler) Stop() {
+	w.quitLoop()
+	w.cancel()
+}
+
+// Shutdown 停止触发新扫描，等待各分片处理完当前区块并保存 checkpoint 后关闭 Result
+// ctx 到期仍未结束则中断进行中的调用（未保存的区块下次重扫），返回 ctx.Err()
+func (w *WorkHandler) Shutdown(ctx context.Context) error {
+	w.quitLoop()
+	select {
+	case <-w.loopDone:
+	case <-ctx.Done():
+		w.cancel()
+		<-w.loopDone
+	}
+	err := w.scan.Close(ctx)
+	if err != nil {
+		if w.zap_l != nil {
+			w.zap_l.Warn("work.shutdown",
+				zap.String("event", "drain_timeout"),
+				zap.String("err", err.Error()),
+			)
+		}
+		w.cancel()
+		_ = w.scan.Close(context.Background())
+	}
 	w.cancel()
+	return err
 }
 func (w *WorkHandler) Result() <-chan []*ContractTokenTran {
 	return w.scan.Result()
 }
 
-// NewWork maxGoNum 最大执行分组 cfg 链的配置
-func NewWork(maxGoNum int, disk Disk, log *zap.Logger, cfgs ...ChainScanCfg) *WorkHandler {
+// SetSink 替换投递目标，需在 Run 之前调用；投递成功后才保存 checkpoint
+func (w *WorkHandler) SetSink(sink Sink) {
+	w.scan.SetSink(sink)
+}
+
+// EnableLeases 多个实例共用存储时按分片租约分工，需在 Run 之前调用
+func (w *WorkHandler) EnableLeases(cfg LeaseCfg) error {
+	return w.scan.EnableLeases(cfg)
+}
+
+// SafeHeight 该链已连续处理完的最高区块
+func (w *WorkHandler) SafeHeight(chain ChainType) int64 {
+	return w.scan.SafeHeight(chain)
+}
+
+// DeadBlocks 该链重试用完被跳过的高度
+func (w *WorkHandler) DeadBlocks(chain ChainType) []int64 {
+	return w.scan.DeadBlocks(chain)
+}
+
+// RetryDead 重新拉取一个死信高度并投递到 Result
+func (w *WorkHandler) RetryDead(ctx context.Context, chain ChainType, h int64) error {
+	return w.scan.RetryDead(ctx, chain, h)
+}
+
+// Backfill 补扫历史区间，阻塞到完成；可与 Run 同时使用，交易投递到 Result
+func (w *WorkHandler) Backfill(ctx context.Context, job BackfillJob, progress func(BackfillProgress)) error {
+	return w.scan.Backfill(ctx, job, progress)
+}
+
+// NewWork maxGoNum 默认执行分组（ChainScanCfg.GoNum 可单独覆盖） disk 进度存储，旧的 Disk 用 AdaptDisk 包装 cfg 链的配置
+func NewWork(maxGoNum int, disk Store, log *zap.Logger, cfgs ...ChainScanCfg) *WorkHandler {
 	scan := NewScan(int64(maxGoNum), disk, log, cfgs...)
 	ctx, cancel := context.WithCancel(context.Background())
 	return &WorkHandler{
-		zap_l:  log,
-		ctx:    ctx,
-		cancel: cancel,
-		scan:   scan,
+		zap_l:    log,
+		ctx:      ctx,
+		cancel:   cancel,
+		scan:     scan,
+		quit:     make(chan struct{}),
+		loopDone: make(chan struct{}),
 	}
 }
@@ -0,0 +1,155 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestWork 用给定的链桩组装 WorkHandler
+func newTestWork(d Store, tools ...*storeTool) *WorkHandler {
+	w := NewWork(1, d, nil)
+	for _, tl := range tools {
+		w.scan.chain.Store(tl.ChainType(), tl)
+	}
+	return w
+}
+
+// drain 读完 Result 直到关闭，把收到的交易发到返回的 channel
+func drain(w *WorkHandler) <-chan []string {
+	out := make(chan []string, 1)
+	go func() {
+		got := make([]string, 0)
+		for batch := range w.Result() {
+			got = append(got, txIds(batch)...)
+		}
+		out <- got
+	}()
+	return out
+}
+
+func recvWithin[T any](t *testing.T, what string, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+func TestShutdownDrainsShards(t *testing.T) {
+	d := newMemStore()
+	c := newFakeChain(CHAIN_ETH, 10)
+	c.gate, c.entered = make(chan struct{}), make(chan int64, 16)
+	tl := newStoreTool(c, ChainScanCfg{Chain: CHAIN_ETH, PollInterval: 10 * time.Millisecond}, 1, d)
+	w := newTestWork(d, tl)
+	got := drain(w)
+	w.Run()
+	if h := recvWithin(t, "shard fetching", c.entered); h != 10 {
+		t.Fatalf("fetching %d", h)
+	}
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- w.Shutdown(ctx)
+	}()
+	// 分片还在处理当前区块，Shutdown 等它
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned before the shard finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(c.gate)
+	if err := recvWithin(t, "shutdown", done); err != nil {
+		t.Fatal(err)
+	}
+	// 当前区块投递完、checkpoint 保存后才关闭 Result
+	if txs := recvWithin(t, "result closed", got); fmt.Sprint(txs) != "[tx10]" {
+		t.Fatalf("delivered %v", txs)
+	}
+	if val, _, _ := d.Load(w.scan.getSaveKey(tl, 0)); val != 10 {
+		t.Fatalf("checkpoint %d", val)
+	}
+	// 重复关闭不会再关一次 Result
+	w.Stop()
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	d := newMemStore()
+	c := newFakeChain(CHAIN_ETH, 10)
+	c.gate, c.entered = make(chan struct{}), make(chan int64, 16)
+	tl := newStoreTool(c, ChainScanCfg{Chain: CHAIN_ETH, PollInterval: 10 * time.Millisecond}, 1, d)
+	w := newTestWork(d, tl)
+	got := drain(w)
+	w.Run()
+	recvWithin(t, "shard fetching", c.entered)
+	// 到期后中断进行中的调用，未完成的区块不保存，下次重扫
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := w.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("shutdown took %s", elapsed)
+	}
+	if txs := recvWithin(t, "result closed", got); len(txs) != 0 {
+		t.Fatalf("delivered %v", txs)
+	}
+	if val, _, _ := d.Load(w.scan.getSaveKey(tl, 0)); val != 9 {
+		t.Fatalf("checkpoint %d", val)
+	}
+	w.Stop()
+}
+
+func TestStopDoesNotWait(t *testing.T) {
+	d := newMemStore()
+	c := newFakeChain(CHAIN_ETH, 10)
+	c.gate, c.entered = make(chan struct{}), make(chan int64, 16)
+	tl := newStoreTool(c, ChainScanCfg{Chain: CHAIN_ETH, PollInterval: 10 * time.Millisecond}, 1, d)
+	w := newTestWork(d, tl)
+	got := drain(w)
+	w.Run()
+	recvWithin(t, "shard fetching", c.entered)
+	// 不等分片处理完当前区块，中断后立即返回，Result 留给 Shutdown 关闭
+	start := time.Now()
+	w.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stop took %s", elapsed)
+	}
+	select {
+	case txs := <-got:
+		t.Fatalf("result closed by Stop: %v", txs)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if txs := recvWithin(t, "result closed", got); len(txs) != 0 {
+		t.Fatalf("delivered %v", txs)
+	}
+	if val, _, _ := d.Load(w.scan.getSaveKey(tl, 0)); val != 9 {
+		t.Fatalf("checkpoint %d", val)
+	}
+}
+
+func TestShutdownBeforeRun(t *testing.T) {
+	d := newMemStore()
+	w := newTestWork(d, newStoreTool(newFakeChain(CHAIN_ETH, 10), ChainScanCfg{Chain: CHAIN_ETH}, 1, d))
+	got := drain(w)
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	recvWithin(t, "result closed", got)
+	// 关闭之后 Run 不再启动扫描
+	w.Run()
+	w.Stop()
+}
@@ -0,0 +1,280 @@
+package bg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+func (s *Scan) getSolidKey(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:solid", t.ChainType().Name())
+}
+
+func (s *Scan) getPendingPrefix(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:pending:", t.ChainType().Name())
+}
+
+func (s *Scan) getPendingKey(t *storeTool, h int64) string {
+	return s.getPendingPrefix(t) + strconv.FormatInt(h, 10)
+}
+
+// savePending 记下高度 h 已发 pending 的交易，调用方持有 t.mu
+// 启用租约时各实例扫自己的分片，确认由持有分片 0 的实例做，待确认的交易写到共用的存储
+func (s *Scan) savePending(t *storeTool, h int64, trans []*ContractTokenTran) error {
+	if t.leases == nil {
+		t.pending[h] = trans
+		return nil
+	}
+	raw, err := json.Marshal(trans)
+	if err != nil {
+		return err
+	}
+	return t.disk.(BlobStore).SaveBlob(s.getPendingKey(t, h), raw)
+}
+
+// loadPending 取高度 h 已发 pending 的交易
+func (s *Scan) loadPending(t *storeTool, h int64) ([]*ContractTokenTran, error) {
+	t.mu.Lock()
+	if t.leases == nil {
+		defer t.mu.Unlock()
+		return t.pending[h], nil
+	}
+	t.mu.Unlock()
+	raw, found, err := t.disk.(BlobStore).LoadBlob(s.getPendingKey(t, h))
+	if err != nil || !found {
+		return nil, err
+	}
+	trans := make([]*ContractTokenTran, 0)
+	if err := json.Unmarshal(raw, &trans); err != nil {
+		// 损坏的记录只影响该高度的撤回
+		s.confirmFailed(t, "pending_corrupt", h, err)
+		return nil, nil
+	}
+	return trans, nil
+}
+
+// dropPending 高度 h 已确认，调用方持有 t.mu
+func (s *Scan) dropPending(t *storeTool, h int64) {
+	delete(t.pending, h)
+	if t.leases == nil {
+		return
+	}
+	if err := t.disk.(BlobStore).DeleteBlobs(s.getPendingKey(t, h)); err != nil {
+		s.confirmFailed(t, "pending_delete_failed", h, err)
+	}
+}
+
+// clearPending 强制改起始高度时丢弃全部待确认记录，调用方持有 t.mu
+func (s *Scan) clearPending(t *storeTool) error {
+	clear(t.pending)
+	if t.leases == nil {
+		return nil
+	}
+	bs := t.disk.(BlobStore)
+	blobs, err := bs.ListBlobs(s.getPendingPrefix(t))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(blobs))
+	for key := range blobs {
+		keys = append(keys, key)
+	}
+	return bs.DeleteBlobs(keys...)
+}
+
+// initSolid 快速模式启动时恢复确认进度；未确认的高度回退 checkpoint 重扫，重新发 pending 并建立待确认记录
+func (s *Scan) initSolid(t *storeTool) error {
+	solid, err := s.getKey(t, s.getSolidKey(t))
+	if err != nil {
+		return err
+	}
+	t.solid = solid
+	done := contiguous(t.marks, t.GoNum)
+	if t.solid == 0 {
+		// 之前按固化区块扫过，已扫高度都已确认
+		if done > 0 {
+			s.setSolid(t, done)
+		}
+		return nil
+	}
+	if done <= t.solid {
+		return nil
+	}
+	for i := range t.marks {
+		if t.marks[i] <= t.solid {
+			continue
+		}
+		if err := s.rewind(t, i, t.solid); err != nil && s.zap_l != nil {
+			s.zap_l.Error("scan.confirm",
+				zap.String("event", "rewind_save_failed"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.Int("shard", i),
+				zap.String("err", err.Error()),
+			)
+		}
+	}
+	if s.zap_l != nil {
+		s.zap_l.Warn("scan.confirm",
+			zap.String("event", "rewind_to_solid"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int64("solid", t.solid),
+		)
+	}
+	return nil
+}
+
+// setSolid 保存确认进度，调用方持有 t.mu 或尚未开始扫描
+func (s *Scan) setSolid(t *storeTool, h int64) {
+	write := s.saveKey
+	if h < t.solid {
+		write = s.rewindKey
+	}
+	if err := write(t, s.getSolidKey(t), h); err != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.confirm",
+				zap.String("event", "save_failed"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.Int64("solid", h),
+				zap.String("err", err.Error()),
+			)
+		}
+		return
+	}
+	t.solid = h
+}
+
+// confirm 固化节点追上的已扫高度逐个确认：固化数据里的交易发 confirmed，pending 过但已消失的发 retracted
+func (s *Scan) confirm(ctx context.Context, t *storeTool) {
+	select {
+	case t.confirming <- struct{}{}:
+	default:
+		return
+	}
+	defer func() {
+		<-t.confirming
+	}()
+	ct := t.ScanTool.(ConfirmTool)
+	chainName := t.ChainType().Name()
+	callCtx, cancel := s.callCtx(ctx, t)
+	solid, err := ct.SolidHeight(callCtx)
+	cancel()
+	if err != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.confirm",
+				zap.String("event", "get_solid_failed"),
+				zap.String("chain", chainName),
+				zap.String("err", err.Error()),
+			)
+		}
+		return
+	}
+	if !s.reloadSolid(t) {
+		return
+	}
+	t.mu.Lock()
+	from, to := t.solid+1, min(solid, contiguous(t.marks, t.GoNum))
+	t.mu.Unlock()
+	if from == 1 {
+		// 还没开始扫描
+		return
+	}
+	for h := from; h <= to; h++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		default:
+		}
+		callCtx, cancel := s.callCtx(ctx, t)
+		trans, err := ct.GetSolidLog(callCtx, h)
+		cancel()
+		if err != nil {
+			s.confirmFailed(t, "get_solid_log_failed", h, err)
+			return
+		}
+		pending, err := s.loadPending(t, h)
+		if err != nil {
+			s.confirmFailed(t, "load_pending_failed", h, err)
+			return
+		}
+		if !s.confirmBlock(ctx, t, h, trans, pending) {
+			return
+		}
+	}
+}
+
+// reloadSolid 启用租约时确认进度以存储为准，分片 0 易主后新的实例从上一个实例确认到的地方继续
+func (s *Scan) reloadSolid(t *storeTool) bool {
+	t.mu.Lock()
+	leased := t.leases != nil
+	t.mu.Unlock()
+	if !leased {
+		return true
+	}
+	solid, err := s.getKey(t, s.getSolidKey(t))
+	if err != nil {
+		s.confirmFailed(t, "load_solid_failed", -1, err)
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.solid = solid
+	return true
+}
+
+func (s *Scan) confirmFailed(t *storeTool, event string, h int64, err error) {
+	if s.zap_l != nil {
+		s.zap_l.Error("scan.confirm",
+			zap.String("event", event),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int64("block", h),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+func (s *Scan) confirmBlock(ctx context.Context, t *storeTool, h int64, trans, pending []*ContractTokenTran) bool {
+	t.mu.Lock()
+	next, safe := t.solid+1, t.safe
+	t.mu.Unlock()
+	if h != next {
+		// 期间被强制改了起始高度
+		return false
+	}
+	seen := make(map[string]bool, len(trans))
+	out := make([]*ContractTokenTran, 0, len(trans))
+	for _, tran := range trans {
+		tran.Event = EventConfirmed
+		tran.SafeHeight = safe
+		seen[tran.TxId] = true
+		out = append(out, tran)
+	}
+	for _, tran := range pending {
+		if seen[tran.TxId] {
+			continue
+		}
+		r := tran.Retract()
+		r.SafeHeight = safe
+		out = append(out, r)
+	}
+	// 投递不持有 t.mu，避免慢 Sink 卡住分片提交
+	if !s.deliver(ctx, out) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h != t.solid+1 {
+		// 投递期间被强制改了起始高度；固化数据不会分叉，不必看 epoch
+		return false
+	}
+	s.setSolid(t, h)
+	if t.solid != h {
+		return false
+	}
+	s.dropPending(t, h)
+	return true
+}
@@ -0,0 +1,52 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// solidChain 可查固化高度的链桩，测试直接调用 confirmBlock，这两个方法不会被用到
+type solidChain struct{ stubTool }
+
+func (solidChain) SolidHeight(context.Context) (int64, error) { return 0, nil }
+
+func (solidChain) GetSolidLog(context.Context, int64) ([]*ContractTokenTran, error) { return nil, nil }
+
+func TestConfirmBlockDeliversUnlocked(t *testing.T) {
+	ctx := context.Background()
+	s, tl, sink := newLockedScan(toolOpts{tool: solidChain{stubTool{chain: CHAIN_ETH}}, cfg: ChainScanCfg{TronFast: true}})
+	tl.solid = 9
+	pending := []*ContractTokenTran{
+		{Type: CHAIN_ETH, TxId: "0xa", BlockNum: 10, Event: EventPending},
+		{Type: CHAIN_ETH, TxId: "0xb", BlockNum: 10, Event: EventPending},
+	}
+	tl.pending[10] = pending
+	trans := []*ContractTokenTran{{Type: CHAIN_ETH, TxId: "0xa", BlockNum: 10}}
+	confirm := func() error {
+		if !s.confirmBlock(ctx, tl, 10, trans, pending) {
+			return errors.New("not confirmed")
+		}
+		return nil
+	}
+	// 投递期间被强制改了起始高度：不推进确认进度
+	sink.during = func(t *storeTool) { t.solid = 100 }
+	if err := within(t, 5*time.Second, confirm); err == nil || tl.solid != 100 {
+		t.Fatalf("confirmed across force start: %v solid=%d", err, tl.solid)
+	}
+	tl.solid = 9
+	sink.during = nil
+	sink.reset()
+	if err := within(t, 5*time.Second, confirm); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tl.pending[10]; ok || tl.solid != 10 {
+		t.Fatalf("solid=%d pending=%v", tl.solid, tl.pending)
+	}
+	// 固化后仍在的发 confirmed，已不在固化区块里的撤回
+	if got := fmt.Sprint(sink.events()); got != "[0xa:confirmed 0xb:retracted]" {
+		t.Fatalf("delivered %s", got)
+	}
+}
@@ -0,0 +1,464 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errNotCommitted 区块没有提交，原因已在日志里，如投递失败、发现分叉
+var errNotCommitted = errors.New("block not committed")
+
+const (
+	defaultMaxAttempts = 5
+	defaultBaseDelay   = 500 * time.Millisecond
+	defaultMaxDelay    = 30 * time.Second
+)
+
+// RetryCfg 单个高度拉取失败时的重试策略
+type RetryCfg struct {
+	MaxAttempts int           // 单个高度最多尝试次数，用完记入死信后跳过，之后每轮 Process 按退避自动重试；0=默认5，<0 一直重试不记死信
+	BaseDelay   time.Duration // 首次重试等待，之后每次翻倍，0=默认500ms
+	MaxDelay    time.Duration // 单次等待上限，0=默认30s
+}
+
+func (c RetryCfg) attempts() int {
+	if c.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+// backoff 第 n 次重试前的等待：指数增长，取上半段随机抖动，避免各分片同时重试
+func (c RetryCfg) backoff(n int) time.Duration {
+	base, top := c.BaseDelay, c.MaxDelay
+	if base <= 0 {
+		base = defaultBaseDelay
+	}
+	if top <= 0 {
+		top = defaultMaxDelay
+	}
+	d := base
+	for i := 1; i < n && d < top; i++ {
+		d *= 2
+	}
+	d = min(d, top)
+	return d/2 + rand.N(d/2+1)
+}
+
+// getDeadPrefix 实时扫描分片 idx 的死信列表，<prefix>:count 为条数，<prefix>:<i> 为各条高度；高度 h 属于分片 h % GoNum
+// 启用租约时各分片的列表由持有者带 fencing token 写入，实例之间不会互相覆盖
+func (s *Scan) getDeadPrefix(t *storeTool, idx int) string {
+	return fmt.Sprintf("%s:scan:shard:%d:dead", t.ChainType().Name(), idx)
+}
+
+// getChainDeadPrefix 按分片保存之前整条链共用的死信列表，加载时迁移
+func (s *Scan) getChainDeadPrefix(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:dead", t.ChainType().Name())
+}
+
+// loadDead 读出各分片的死信，旧版本整条链共用的列表迁移到各分片；调用方持有 t.mu
+func (s *Scan) loadDead(t *storeTool) error {
+	dead, err := s.readShardDead(t, t.GoNum)
+	if err != nil {
+		return err
+	}
+	prefix := s.getChainDeadPrefix(t)
+	old, err := s.readDead(t, prefix)
+	if err != nil {
+		return err
+	}
+	t.dead = dead
+	if len(old) == 0 {
+		return nil
+	}
+	for _, h := range old {
+		if !slices.Contains(t.dead, h) {
+			t.dead = append(t.dead, h)
+		}
+	}
+	if err := s.moveDead(t, t.GoNum); err != nil {
+		return err
+	}
+	count, err := s.getKey(t, prefix+":count")
+	if err != nil {
+		return err
+	}
+	stale := []string{prefix + ":count"}
+	for i := range count {
+		stale = append(stale, fmt.Sprintf("%s:%d", prefix, i))
+	}
+	return t.disk.Delete(stale...)
+}
+
+// readShardDead 读出 goNum 个分片的死信列表
+func (s *Scan) readShardDead(t *storeTool, goNum int64) ([]int64, error) {
+	dead := make([]int64, 0)
+	for i := 0; i < int(goNum); i++ {
+		part, err := s.readDead(t, s.getDeadPrefix(t, i))
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range part {
+			if !slices.Contains(dead, h) {
+				dead = append(dead, h)
+			}
+		}
+	}
+	return dead, nil
+}
+
+// moveDead 把 t.dead 按当前分片数重新写到各分片，prev 为原来的分片数，多出来的旧分片列表删除；不带租约，只在加载时调用
+func (s *Scan) moveDead(t *storeTool, prev int64) error {
+	kv := make(map[string]int64)
+	for i := 0; i < int(t.GoNum); i++ {
+		for key, val := range deadKV(s.getDeadPrefix(t, i), s.shardDead(t, i)) {
+			kv[key] = val
+		}
+	}
+	if err := s.rewindBatch(t, kv); err != nil {
+		return err
+	}
+	stale := make([]string, 0)
+	for i := int(t.GoNum); i < int(prev); i++ {
+		prefix := s.getDeadPrefix(t, i)
+		count, err := s.getKey(t, prefix+":count")
+		if err != nil {
+			return err
+		}
+		stale = append(stale, prefix+":count")
+		for j := 0; j < int(count); j++ {
+			stale = append(stale, fmt.Sprintf("%s:%d", prefix, j))
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return t.disk.Delete(stale...)
+}
+
+// shardDead t.dead 中属于分片 idx 的高度，调用方持有 t.mu
+func (s *Scan) shardDead(t *storeTool, idx int) []int64 {
+	out := make([]int64, 0)
+	for _, h := range t.dead {
+		if int(h%t.GoNum) == idx {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// saveDead 持久化分片 idx 的死信列表，old 为之前的条数；启用租约时带该分片的 fencing token；调用方持有 t.mu
+func (s *Scan) saveDead(t *storeTool, idx int, old int) error {
+	fence, err := s.fence(t, idx)
+	if err != nil {
+		return err
+	}
+	prefix := s.getDeadPrefix(t, idx)
+	dead := s.shardDead(t, idx)
+	if fence == nil {
+		return s.writeDead(t, prefix, dead, old)
+	}
+	// 多出的旧槽位在同一次写入里清零，不单独删除，失去租约后也不会删掉接手的实例写入的条目
+	kv := deadKV(prefix, dead)
+	for i := len(dead); i < old; i++ {
+		kv[fmt.Sprintf("%s:%d", prefix, i)] = 0
+	}
+	return t.disk.(LeaseStore).RewindFenced(*fence, kv)
+}
+
+// refreshDead 从存储刷新他人持有的分片 idx 的死信，调用方持有 t.mu
+func (s *Scan) refreshDead(t *storeTool, idx int) error {
+	part, err := s.readDead(t, s.getDeadPrefix(t, idx))
+	if err != nil {
+		return err
+	}
+	t.dead = slices.DeleteFunc(t.dead, func(h int64) bool { return int(h%t.GoNum) == idx })
+	t.dead = append(t.dead, part...)
+	return nil
+}
+
+func (s *Scan) readDead(t *storeTool, prefix string) ([]int64, error) {
+	count, err := s.getKey(t, prefix+":count")
+	if err != nil {
+		return nil, err
+	}
+	dead := make([]int64, 0, count)
+	for i := 0; i < int(count); i++ {
+		h, err := s.getKey(t, fmt.Sprintf("%s:%d", prefix, i))
+		if err != nil {
+			return nil, err
+		}
+		if h > 0 {
+			dead = append(dead, h)
+		}
+	}
+	return dead, nil
+}
+
+func deadKV(prefix string, dead []int64) map[string]int64 {
+	kv := map[string]int64{prefix + ":count": int64(len(dead))}
+	for i, h := range dead {
+		kv[fmt.Sprintf("%s:%d", prefix, i)] = h
+	}
+	return kv
+}
+
+// writeDead 持久化死信列表，old 为之前的条数，多出的旧槽位删除
+func (s *Scan) writeDead(t *storeTool, prefix string, dead []int64, old int) error {
+	if err := s.rewindBatch(t, deadKV(prefix, dead)); err != nil {
+		return err
+	}
+	stale := make([]string, 0, max(old-len(dead), 0))
+	for i := len(dead); i < old; i++ {
+		stale = append(stale, fmt.Sprintf("%s:%d", prefix, i))
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return t.disk.Delete(stale...)
+}
+
+// addDead 记入实时扫描的死信，已存在则忽略；启用租约时失去分片返回错误
+func (s *Scan) addDead(t *storeTool, h int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if slices.Contains(t.dead, h) {
+		return nil
+	}
+	idx := int(h % t.GoNum)
+	t.dead = append(t.dead, h)
+	if err := s.saveDead(t, idx, len(s.shardDead(t, idx))-1); err != nil {
+		t.dead = t.dead[:len(t.dead)-1]
+		s.lostLease(t, idx, err)
+		return err
+	}
+	s.updateWatermark(t)
+	return nil
+}
+
+// retryBlock 拉取失败的高度按指数退避加抖动重试；次数用完交给 dead 记入死信，返回空区块让分片继续
+// 返回 nil 表示已取消/停止，或死信保存失败
+func (s *Scan) retryBlock(ctx context.Context, t *storeTool, idx int, h int64, err error, dead func(int64) error) *BlockLog {
+	chainName := t.ChainType().Name()
+	policy := t.cfg.Retry
+	for attempt := 1; policy.attempts() < 0 || attempt < policy.attempts(); attempt++ {
+		wait := policy.backoff(attempt)
+		if s.zap_l != nil {
+			s.zap_l.Warn("scan.process",
+				zap.String("event", "getlog_failed"),
+				zap.String("chain", chainName),
+				zap.Int("shard", idx),
+				zap.Int64("block", h),
+				zap.Int("attempt", attempt),
+				zap.Duration("retry_in", wait),
+				zap.String("err", err.Error()),
+			)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-s.stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		block, e := s.getBlock(ctx, t, h)
+		if e == nil {
+			return block
+		}
+		err = e
+	}
+	if ctx.Err() != nil {
+		// 取消导致的失败不记死信，下次从该高度继续
+		return nil
+	}
+	if e := dead(h); e != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.process",
+				zap.String("event", "dead_save_failed"),
+				zap.String("chain", chainName),
+				zap.Int("shard", idx),
+				zap.Int64("block", h),
+				zap.String("err", e.Error()),
+			)
+		}
+		return nil
+	}
+	if s.zap_l != nil {
+		s.zap_l.Error("scan.process",
+			zap.String("event", "dead_letter"),
+			zap.String("chain", chainName),
+			zap.Int("shard", idx),
+			zap.Int64("block", h),
+			zap.Int("attempts", policy.attempts()),
+			zap.String("err", err.Error()),
+		)
+	}
+	return &BlockLog{Num: h}
+}
+
+// DeadBlocks 该链重试用完被跳过的高度
+func (s *Scan) DeadBlocks(chain ChainType) []int64 {
+	t := s.tool(chain)
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.dead)
+}
+
+// RetryDead 重新拉取一个死信高度并投递，成功后移出死信列表并放开连续水位；不影响分片 checkpoint
+// 与分片扫描一样做分叉检测并记入 ring，之后分叉时同样会撤回；启用租约时只能重试本实例持有的分片
+// Close 之后返回错误
+func (s *Scan) RetryDead(ctx context.Context, chain ChainType, h int64) error {
+	t := s.tool(chain)
+	if t == nil {
+		return fmt.Errorf("chain %s not configured", chain.Name())
+	}
+	return s.tracked(func() error {
+		if err := s.load(t); err != nil {
+			return err
+		}
+		return s.retryDead(ctx, t, h)
+	})
+}
+
+// retryDead 与分片提交走同一条路径：分叉检测、投递、epoch 与租约校验、记入 ring，最后在锁内移出死信
+func (s *Scan) retryDead(ctx context.Context, t *storeTool, h int64) error {
+	t.mu.Lock()
+	found := slices.Contains(t.dead, h)
+	idx := int(h % t.GoNum)
+	held := s.holds(t, idx)
+	epoch := t.epoch
+	t.mu.Unlock()
+	if !found {
+		return fmt.Errorf("block %d is not in dead letters", h)
+	}
+	if !held {
+		return fmt.Errorf("retry dead block %d: %w", h, errLeaseLost)
+	}
+	block, err := s.getBlock(ctx, t, h)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	solid := t.solid
+	t.mu.Unlock()
+	for _, tran := range block.Trans {
+		// 快速模式下已固化的高度不会再有确认，直接按确认发出
+		if tran.Event == EventPending && h <= solid {
+			tran.Event = EventConfirmed
+		}
+	}
+	var settleErr error
+	if s.commitWith(ctx, t, idx, epoch, block, func() error {
+		settleErr = s.removeDead(t, h)
+		return settleErr
+	}) {
+		return nil
+	}
+	// 没有提交：保留死信，之后再重试
+	t.mu.Lock()
+	rolled := t.epoch != epoch
+	t.mu.Unlock()
+	switch {
+	case settleErr != nil:
+		return settleErr
+	case rolled:
+		return fmt.Errorf("retry dead block %d: %w", h, errRolledBack)
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	return fmt.Errorf("retry dead block %d: %w", h, errNotCommitted)
+}
+
+// removeDead 移出死信并放开连续水位，调用方持有 t.mu
+func (s *Scan) removeDead(t *storeTool, h int64) error {
+	i := slices.Index(t.dead, h)
+	if i < 0 {
+		return nil
+	}
+	idx := int(h % t.GoNum)
+	old := len(s.shardDead(t, idx))
+	t.dead = slices.Delete(t.dead, i, i+1)
+	if err := s.saveDead(t, idx, old); err != nil {
+		t.dead = append(t.dead, h)
+		return err
+	}
+	s.updateWatermark(t)
+	return nil
+}
+
+// reviveDead 死信高度按退避自动重试，节点短暂故障恢复后连续水位随之放开，不必等人工 RetryDead
+// 启用租约时只重试本实例持有的分片
+func (s *Scan) reviveDead(ctx context.Context, t *storeTool) {
+	select {
+	case t.reviving <- struct{}{}:
+	default:
+		return
+	}
+	defer func() {
+		<-t.reviving
+	}()
+	t.mu.Lock()
+	heights := make([]int64, 0, len(t.dead))
+	if !time.Now().Before(t.reviveAt) {
+		for _, h := range t.dead {
+			if s.holds(t, int(h%t.GoNum)) {
+				heights = append(heights, h)
+			}
+		}
+	}
+	t.mu.Unlock()
+	if len(heights) == 0 {
+		return
+	}
+	var err error
+	for _, h := range heights {
+		if err = s.retryDead(ctx, t, h); err != nil {
+			break
+		}
+		if s.zap_l != nil {
+			s.zap_l.Info("scan.process",
+				zap.String("event", "dead_revived"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.Int64("block", h),
+			)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		t.reviveTry = 0
+		return
+	}
+	t.reviveTry++
+	t.reviveAt = time.Now().Add(t.cfg.Retry.backoff(t.reviveTry))
+	if s.zap_l != nil && ctx.Err() == nil {
+		s.zap_l.Warn("scan.process",
+			zap.String("event", "dead_revive_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int("attempt", t.reviveTry),
+			zap.Time("retry_at", t.reviveAt),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+func (s *Scan) tool(chain ChainType) *storeTool {
+	v, ok := s.chain.Load(chain)
+	if !ok {
+		return nil
+	}
+	t, _ := v.(*storeTool)
+	return t
+}
@@ -0,0 +1,295 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryDeadAfterClose(t *testing.T) {
+	s := NewScan(1, nil, nil)
+	tl := newTestTool(newMemStore(), toolOpts{})
+	s.chain.Store(CHAIN_ETH, tl)
+	if err := s.addDead(tl, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭后不再投递到已关闭的 Result
+	if err := s.RetryDead(context.Background(), CHAIN_ETH, 10); !errors.Is(err, errScanClosed) {
+		t.Fatalf("retry after close: %v", err)
+	}
+	if dead := s.DeadBlocks(CHAIN_ETH); len(dead) != 1 || dead[0] != 10 {
+		t.Fatalf("dead %v", dead)
+	}
+}
+
+// flakyTool down 为 true 时拉取失败
+type flakyTool struct {
+	stubTool
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+func (f *flakyTool) GetLog(_ context.Context, n int64) ([]*ContractTokenTran, error) {
+	f.calls.Add(1)
+	if f.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return []*ContractTokenTran{{Type: CHAIN_ETH, TxId: fmt.Sprint(n), BlockNum: n}}, nil
+}
+
+func TestReviveDead(t *testing.T) {
+	s := NewScan(1, nil, nil)
+	f := &flakyTool{stubTool: stubTool{chain: CHAIN_ETH}}
+	f.down.Store(true)
+	tl := newTestTool(newMemStore(), toolOpts{tool: f, marks: []int64{20}})
+	if err := s.addDead(tl, 10); err != nil {
+		t.Fatal(err)
+	}
+	if tl.safe != 9 {
+		t.Fatalf("safe %d with dead letter", tl.safe)
+	}
+	ctx := context.Background()
+	// 节点仍不可用：保留死信并退避
+	s.reviveDead(ctx, tl)
+	if len(tl.dead) != 1 || tl.reviveTry != 1 || !tl.reviveAt.After(time.Now()) {
+		t.Fatalf("after failure: dead=%v try=%d at=%v", tl.dead, tl.reviveTry, tl.reviveAt)
+	}
+	s.reviveDead(ctx, tl)
+	if n := f.calls.Load(); n != 1 {
+		t.Fatalf("retried during backoff, %d calls", n)
+	}
+	// 退避到期且节点恢复：投递并放开水位
+	f.down.Store(false)
+	tl.reviveAt = time.Time{}
+	s.reviveDead(ctx, tl)
+	if len(tl.dead) != 0 || tl.reviveTry != 0 || tl.safe != 20 {
+		t.Fatalf("after revive: dead=%v try=%d safe=%d", tl.dead, tl.reviveTry, tl.safe)
+	}
+	if batch := <-s.Result(); len(batch) != 1 || batch[0].TxId != "10" || batch[0].Event != EventConfirmed {
+		t.Fatalf("delivered %+v", batch)
+	}
+}
+
+func TestRetryDeadDeliversUnlocked(t *testing.T) {
+	ctx := context.Background()
+	s, tl, sink := newLockedScan(toolOpts{tool: &flakyTool{stubTool: stubTool{chain: CHAIN_ETH}}, marks: []int64{20}})
+	sink.during = rollbackDuring
+	if err := s.addDead(tl, 10); err != nil {
+		t.Fatal(err)
+	}
+	// 投递期间回滚：保留死信，之后再重试
+	if err := within(t, 5*time.Second, func() error { return s.retryDead(ctx, tl, 10) }); !errors.Is(err, errRolledBack) {
+		t.Fatalf("retry during rollback: %v", err)
+	}
+	if len(tl.dead) != 1 || tl.safe != 9 {
+		t.Fatalf("dead=%v safe=%d", tl.dead, tl.safe)
+	}
+	sink.during = nil
+	if err := within(t, 5*time.Second, func() error { return s.retryDead(ctx, tl, 10) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(tl.dead) != 0 || tl.safe != 20 {
+		t.Fatalf("dead=%v safe=%d", tl.dead, tl.safe)
+	}
+	// 复活的高度按已确认投递；回滚打断的那次已经发出，至少一次，下游去重
+	if got := fmt.Sprint(sink.events()); got != "[10:confirmed 10:confirmed]" {
+		t.Fatalf("delivered %s", got)
+	}
+}
+
+func TestBackfillCommitDeliversUnlocked(t *testing.T) {
+	ctx := context.Background()
+	s, tl, sink := newLockedScan(toolOpts{marks: []int64{20}})
+	disk := tl.disk
+	s.updateWatermark(tl)
+	const key = "ETH:backfill:t:shard:0:checkpoint"
+	block := &BlockLog{Num: 5, Trans: []*ContractTokenTran{{Type: CHAIN_ETH, TxId: "0x5", BlockNum: 5}}}
+	if err := within(t, 5*time.Second, func() error { return s.backfillCommit(ctx, tl, key, block) }); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := disk.Load(key); val != 5 {
+		t.Fatalf("checkpoint %d", val)
+	}
+	if got := fmt.Sprint(sink.events()); got != "[0x5:confirmed]" {
+		t.Fatalf("delivered %s", got)
+	}
+}
+
+func TestLeasedDeadLetters(t *testing.T) {
+	d := newMemStore()
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}}
+	a, b := NewScan(2, nil, nil), NewScan(2, nil, nil)
+	ta := leasedTool(t, a, d, toolOpts{tool: c}, "a", 0)
+	tb := leasedTool(t, b, d, toolOpts{tool: c}, "b", 1)
+	ta.marks, tb.marks = []int64{20, 21}, []int64{20, 21}
+	for i, last := range ta.marks {
+		if err := d.Save(a.getSaveKey(ta, i), last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 各自写自己分片的死信，不会覆盖对方的
+	if err := a.addDead(ta, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.addDead(tb, 11); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.addDead(tb, 12); !errors.Is(err, errLeaseLost) {
+		t.Fatalf("b wrote a's shard: %v", err)
+	}
+	restarted := newTestTool(d, toolOpts{marks: make([]int64, 2)})
+	if err := a.loadDead(restarted); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(restarted.dead)
+	if fmt.Sprint(restarted.dead) != "[10 11]" {
+		t.Fatalf("persisted dead %v", restarted.dead)
+	}
+	// 水位只由分片 0 的持有者写入，b 只更新内存
+	if val, _, _ := d.Load(a.getWatermarkKey(ta)); val != 9 {
+		t.Fatalf("watermark %d", val)
+	}
+	if tb.safe != 10 {
+		t.Fatalf("b safe %d", tb.safe)
+	}
+	// 续期时刷新对方分片的死信
+	a.renewLeases(ta)
+	b.renewLeases(tb)
+	if len(ta.dead) != 2 || len(tb.dead) != 2 || ta.safe != 9 || tb.safe != 9 {
+		t.Fatalf("a dead=%v safe=%d, b dead=%v safe=%d", ta.dead, ta.safe, tb.dead, tb.safe)
+	}
+	// b 补上 11 后 a 的视图随之更新，落盘的水位仍停在 a 的死信之前
+	if err := b.retryDead(context.Background(), tb, 11); err != nil {
+		t.Fatal(err)
+	}
+	a.renewLeases(ta)
+	if fmt.Sprint(ta.dead) != "[10]" {
+		t.Fatalf("a dead %v", ta.dead)
+	}
+	if val, _, _ := d.Load(a.getWatermarkKey(ta)); val != 9 {
+		t.Fatalf("watermark %d", val)
+	}
+}
+
+func TestDeadLettersFollowShards(t *testing.T) {
+	d := newMemStore()
+	s := NewScan(1, nil, nil)
+	tl := newTestTool(d, toolOpts{marks: make([]int64, 2)})
+	// 旧版本整条链一个列表，加载时按分片拆开
+	if err := s.writeDead(tl, s.getChainDeadPrefix(tl), []int64{7, 8}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.load(tl); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := d.Load(s.getChainDeadPrefix(tl) + ":count"); found {
+		t.Fatal("chain-wide list kept")
+	}
+	if val, _, _ := d.Load(s.getDeadPrefix(tl, 1) + ":0"); val != 7 {
+		t.Fatalf("shard 1 dead %d", val)
+	}
+	// 改分片数后按新的分片重新分配
+	resharded := newTestTool(d, toolOpts{marks: make([]int64, 3)})
+	if err := s.load(resharded); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := d.Load(s.getDeadPrefix(resharded, 2) + ":0"); val != 8 {
+		t.Fatalf("shard 2 dead %d", val)
+	}
+	slices.Sort(resharded.dead)
+	if fmt.Sprint(resharded.dead) != "[7 8]" {
+		t.Fatalf("dead %v", resharded.dead)
+	}
+}
+
+// checkRewindFenced 持有租约时整批覆盖（可以变小），token 过期时整批不写
+func checkRewindFenced(t *testing.T, d LeaseStore) {
+	t.Helper()
+	const lease = "ETH:scan:shard:0:lease"
+	tokA, ok, err := d.Acquire(lease, "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("a acquire: %v %v", ok, err)
+	}
+	kv := map[string]int64{"ETH:scan:shard:0:dead:count": 2, "ETH:scan:shard:0:dead:0": 10, "ETH:scan:shard:0:dead:1": 12}
+	if err := d.RewindFenced(Fence{Lease: lease, Token: tokA}, kv); err != nil {
+		t.Fatal(err)
+	}
+	kv = map[string]int64{"ETH:scan:shard:0:dead:count": 1, "ETH:scan:shard:0:dead:0": 12, "ETH:scan:shard:0:dead:1": 0}
+	if err := d.RewindFenced(Fence{Lease: lease, Token: tokA}, kv); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := d.Load("ETH:scan:shard:0:dead:count"); val != 1 {
+		t.Fatalf("count %d", val)
+	}
+	if _, err := d.Seize(lease, "b", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	kv = map[string]int64{"ETH:scan:shard:0:dead:count": 0, "ETH:scan:shard:0:dead:0": 0}
+	if err := d.RewindFenced(Fence{Lease: lease, Token: tokA}, kv); !errors.Is(err, ErrFenced) {
+		t.Fatalf("stale token: %v", err)
+	}
+	if val, _, _ := d.Load("ETH:scan:shard:0:dead:0"); val != 12 {
+		t.Fatalf("stale write applied: %d", val)
+	}
+}
+
+func TestMemStoreRewindFenced(t *testing.T) {
+	checkRewindFenced(t, newMemStore())
+}
+
+func TestRetryDeadJoinsRing(t *testing.T) {
+	ctx := context.Background()
+	s := NewScan(1, nil, nil)
+	sink := &recordSink{}
+	s.SetSink(sink)
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}, canonical: map[int64]string{1: "a1", 2: "a2", 3: "a3", 4: "a4", 5: "a5"}}
+	tl := newTestTool(newMemStore(), toolOpts{tool: c})
+	// 3 重试用完记入死信，分片继续提交 4
+	for _, h := range []int64{1, 2, 4} {
+		block, _ := c.GetBlockLog(ctx, h)
+		if !s.commit(ctx, tl, 0, tl.epoch, block) {
+			t.Fatalf("commit %d failed", h)
+		}
+	}
+	if err := s.addDead(tl, 3); err != nil {
+		t.Fatal(err)
+	}
+	// 补回的区块与分片提交的一样校验父哈希：对不上时回滚，死信保留
+	c.canonical[2] = "b2"
+	if err := s.retryDead(ctx, tl, 3); err == nil {
+		t.Fatal("revived a block on top of a replaced parent")
+	}
+	if fmt.Sprint(tl.dead) != "[3]" || tl.marks[0] != 1 {
+		t.Fatalf("dead=%v marks=%v", tl.dead, tl.marks)
+	}
+	c.canonical[2] = "a2"
+	for _, h := range []int64{2, 4} {
+		block, _ := c.GetBlockLog(ctx, h)
+		if !s.commit(ctx, tl, 0, tl.epoch, block) {
+			t.Fatalf("recommit %d failed", h)
+		}
+	}
+	sink.reset()
+	if err := s.retryDead(ctx, tl, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tl.ring.blocks[3]; !ok || len(tl.dead) != 0 {
+		t.Fatalf("revived block not remembered: dead=%v", tl.dead)
+	}
+	// 之后 3 被替换时，补回时投递的交易一样会撤回
+	c.canonical[3], c.canonical[4], c.canonical[5] = "c3", "c4", "c5"
+	block, _ := c.GetBlockLog(ctx, 5)
+	if s.commit(ctx, tl, 0, tl.epoch, block) {
+		t.Fatal("committed on top of a replaced parent")
+	}
+	if got := fmt.Sprint(sink.events()); got != "[tx3:confirmed tx4:retracted tx3:retracted]" {
+		t.Fatalf("delivered %s", got)
+	}
+}
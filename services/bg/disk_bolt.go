@@ -0,0 +1,161 @@
+package bg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBucket     = []byte("yscan")
+	boltBlobBucket = []byte("yscan_blob")
+)
+
+// BoltDisk 基于 bbolt 的单文件 Store，每次 Save、SaveBatch 一个事务，提交时 fsync，崩溃后不会读到半写的值
+// 文件带锁，同一时间只能被一个进程打开
+type BoltDisk struct {
+	db *bolt.DB
+}
+
+func NewBoltDisk(path string) (*BoltDisk, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltBlobBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDisk{db: db}, nil
+}
+
+func (d *BoltDisk) Save(key string, val int64) error {
+	return d.SaveBatch(map[string]int64{key: val})
+}
+
+func (d *BoltDisk) SaveBatch(kv map[string]int64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for key, val := range kv {
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, uint64(val))
+			if err := b.Put([]byte(key), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *BoltDisk) Load(key string) (int64, bool, error) {
+	var (
+		out   int64
+		found bool
+	)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		val, err := boltValue(key, v)
+		out, found = val, true
+		return err
+	})
+	return out, found, err
+}
+
+// Get 不存在或读取失败返回 0
+func (d *BoltDisk) Get(key string) int64 {
+	val, _, _ := d.Load(key)
+	return val
+}
+
+func (d *BoltDisk) List(prefix string) (map[string]int64, error) {
+	out := make(map[string]int64)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			val, err := boltValue(string(k), v)
+			if err != nil {
+				return err
+			}
+			out[string(k)] = val
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (d *BoltDisk) Delete(keys ...string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *BoltDisk) SaveBlob(key string, val []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlobBucket).Put([]byte(key), val)
+	})
+}
+
+func (d *BoltDisk) LoadBlob(key string) ([]byte, bool, error) {
+	var out []byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		// 事务结束后 v 不再有效
+		out = bytes.Clone(tx.Bucket(boltBlobBucket).Get([]byte(key)))
+		return nil
+	})
+	return out, out != nil, err
+}
+
+func (d *BoltDisk) ListBlobs(prefix string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBlobBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			// 事务结束后 v 不再有效
+			out[string(k)] = bytes.Clone(v)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (d *BoltDisk) DeleteBlobs(keys ...string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBlobBucket)
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func boltValue(key string, v []byte) (int64, error) {
+	if len(v) != 8 {
+		return 0, fmt.Errorf("bolt: bad value for %s: %d bytes", key, len(v))
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
+
+func (d *BoltDisk) Close() error {
+	return d.db.Close()
+}
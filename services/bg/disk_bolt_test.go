@@ -0,0 +1,155 @@
+package bg
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltDisk(t *testing.T) (*BoltDisk, string) {
+	path := filepath.Join(t.TempDir(), "yscan.db")
+	d, err := NewBoltDisk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, path
+}
+
+func TestBoltDiskSaveList(t *testing.T) {
+	d, _ := newTestBoltDisk(t)
+	const key = "ETH:scan:shard:0:checkpoint"
+	if _, found, err := d.Load(key); err != nil || found {
+		t.Fatalf("load missing: found=%v err=%v", found, err)
+	}
+	if err := d.Save(key, 100); err != nil {
+		t.Fatal(err)
+	}
+	// 单进程存储，不做单调检查：回滚直接写小的值，Scan 不把它当 RewindDisk
+	if err := d.Save(key, 90); err != nil {
+		t.Fatal(err)
+	}
+	if val, found, err := d.Load(key); err != nil || !found || val != 90 {
+		t.Fatalf("after rewind: %d %v %v", val, found, err)
+	}
+	if _, ok := any(d).(RewindDisk); ok {
+		t.Fatal("BoltDisk unexpectedly monotonic")
+	}
+	if err := d.SaveBatch(map[string]int64{"ETH:scan:shard:1:checkpoint": 91, "ETH:scan:shards": 2, "ETH2:scan:shards": 4, "BSC:scan:shards": 1}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := d.List("ETH:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[key] != 90 || list["ETH:scan:shard:1:checkpoint"] != 91 || list["ETH:scan:shards"] != 2 {
+		t.Fatalf("list %v", list)
+	}
+	if err := d.Delete(key, "ETH:scan:missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := d.Load(key); found {
+		t.Fatal("key not deleted")
+	}
+	if val := d.Get("ETH2:scan:shards"); val != 4 {
+		t.Fatalf("other chain %d", val)
+	}
+}
+
+func TestBoltDiskBlobs(t *testing.T) {
+	d, _ := newTestBoltDisk(t)
+	if err := d.Save("ETH:scan:ring:count", 1); err != nil {
+		t.Fatal(err)
+	}
+	for h, v := range map[string]string{"ETH:scan:ring:100": `{"hash":"0x1"}`, "ETH:scan:ring:101": `{"hash":"0x2"}`, "BSC:scan:ring:100": `{}`} {
+		if err := d.SaveBlob(h, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// blob 与整数分开存，List 读不到 blob，ListBlobs 也读不到整数
+	if list, err := d.List("ETH:scan:ring:"); err != nil || len(list) != 1 {
+		t.Fatalf("list %v %v", list, err)
+	}
+	blobs, err := d.ListBlobs("ETH:scan:ring:")
+	if err != nil || len(blobs) != 2 || string(blobs["ETH:scan:ring:101"]) != `{"hash":"0x2"}` {
+		t.Fatalf("blobs %v %v", blobs, err)
+	}
+	// 读出的值在事务结束后仍然有效，再写不会改到它
+	val, found, err := d.LoadBlob("ETH:scan:ring:100")
+	if err != nil || !found || string(val) != `{"hash":"0x1"}` {
+		t.Fatalf("load blob: %s %v %v", val, found, err)
+	}
+	if err := d.SaveBlob("ETH:scan:ring:100", []byte(`{"hash":"0x9"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != `{"hash":"0x1"}` || string(blobs["ETH:scan:ring:100"]) != `{"hash":"0x1"}` {
+		t.Fatalf("returned blobs changed: %s %s", val, blobs["ETH:scan:ring:100"])
+	}
+	if err := d.DeleteBlobs("ETH:scan:ring:100", "ETH:scan:ring:101"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := d.LoadBlob("ETH:scan:ring:100"); err != nil || found {
+		t.Fatalf("deleted blob: %v %v", found, err)
+	}
+	if blobs, _ := d.ListBlobs(""); len(blobs) != 1 {
+		t.Fatalf("remaining blobs %v", blobs)
+	}
+}
+
+func TestBoltDiskReopen(t *testing.T) {
+	d, path := newTestBoltDisk(t)
+	if err := d.SaveBatch(map[string]int64{"ETH:scan:shard:0:checkpoint": 100, "ETH:scan:shards": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveBlob("ETH:scan:ring:100", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	// 文件带锁，另一个进程（或另一次打开）等锁超时失败
+	if other, err := NewBoltDisk(path); err == nil {
+		other.Close()
+		t.Fatal("opened a locked file")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewBoltDisk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if val := d.Get("ETH:scan:shard:0:checkpoint"); val != 100 {
+		t.Fatalf("checkpoint after reopen %d", val)
+	}
+	if val, found, _ := d.LoadBlob("ETH:scan:ring:100"); !found || string(val) != "x" {
+		t.Fatalf("blob after reopen %q %v", val, found)
+	}
+}
+
+func TestBoltDiskBadValue(t *testing.T) {
+	d, _ := newTestBoltDisk(t)
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte("ETH:scan:shards"), []byte{1, 2, 3})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Load("ETH:scan:shards"); err == nil {
+		t.Fatal("short value loaded")
+	}
+	if _, err := d.List("ETH:"); err == nil {
+		t.Fatal("short value listed")
+	}
+}
+
+func TestBoltDiskNoLeases(t *testing.T) {
+	d, _ := newTestBoltDisk(t)
+	// 单进程的文件存储没有租约和 fencing，多实例分工需要共用的存储
+	if _, ok := any(d).(LeaseStore); ok {
+		t.Fatal("BoltDisk unexpectedly implements LeaseStore")
+	}
+	s := NewScan(1, nil, nil)
+	s.chain.Store(CHAIN_ETH, newTestTool(d, toolOpts{}))
+	if err := s.EnableLeases(LeaseCfg{Owner: "a"}); err == nil {
+		t.Fatal("leases enabled on BoltDisk")
+	}
+}
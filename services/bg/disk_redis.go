@@ -0,0 +1,435 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrBackwards Save 的值小于已存的值，被单调存储拒绝
+var ErrBackwards = errors.New("checkpoint would move backwards")
+
+const defaultRedisDiskTimeout = 5 * time.Second
+
+// 不存在或新值不小于旧值才写入，返回写入后的值
+var monotonicSet = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur and tonumber(cur) > tonumber(ARGV[1]) then
+	return tonumber(cur)
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return tonumber(ARGV[1])
+`)
+
+// 多个键的 monotonicSet：全部不小于旧值才一起写入返回 0，否则都不写，返回第一个会变小的键的序号（从 1 开始）
+var monotonicSetBatch = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	local cur = redis.call('GET', key)
+	if cur and tonumber(cur) > tonumber(ARGV[i]) then
+		return i
+	end
+end
+for i, key in ipairs(KEYS) do
+	redis.call('SET', key, ARGV[i])
+end
+return 0
+`)
+
+// 租约存在 hash 里：owner、token、expire（Redis 服务器时间，毫秒）
+// 他人持有且未过期返回 {0, token}，否则写入并返回 {1, token}；易主或过期后重新获得 token 加一
+var leaseAcquire = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local owner = redis.call('HGET', KEYS[1], 'owner')
+local token = tonumber(redis.call('HGET', KEYS[1], 'token') or '0')
+local expire = tonumber(redis.call('HGET', KEYS[1], 'expire') or '0')
+if owner and owner ~= ARGV[1] and expire > now then
+	return {0, token}
+end
+if owner ~= ARGV[1] or expire <= now then
+	token = token + 1
+end
+redis.call('HSET', KEYS[1], 'owner', ARGV[1], 'token', token, 'expire', now + tonumber(ARGV[2]))
+return {1, token}
+`)
+
+var leaseSeize = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local token = tonumber(redis.call('HGET', KEYS[1], 'token') or '0') + 1
+redis.call('HSET', KEYS[1], 'owner', ARGV[1], 'token', token, 'expire', now + tonumber(ARGV[2]))
+return token
+`)
+
+var leaseRelease = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'owner') == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'expire', 0)
+end
+return 0
+`)
+
+// token 一致时把 KEYS[2..] 直接写成 ARGV[2..]，返回 1；不一致返回 0
+var fencedSetBatch = redis.NewScript(`
+if tonumber(redis.call('HGET', KEYS[1], 'token') or '0') ~= tonumber(ARGV[1]) then
+	return 0
+end
+for i = 2, #KEYS do
+	redis.call('SET', KEYS[i], ARGV[i])
+end
+return 1
+`)
+
+// 值仍是 ARGV[1] 时删除，返回删除的个数
+var compareDelete = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// token 一致时按 monotonicSet 写入，返回 {1, 写入后的值}；不一致返回 {0, 0}
+var fencedSet = redis.NewScript(`
+if tonumber(redis.call('HGET', KEYS[1], 'token') or '0') ~= tonumber(ARGV[1]) then
+	return {0, 0}
+end
+local cur = redis.call('GET', KEYS[2])
+if cur and tonumber(cur) > tonumber(ARGV[2]) then
+	return {1, tonumber(cur)}
+end
+redis.call('SET', KEYS[2], ARGV[2])
+return {1, tonumber(ARGV[2])}
+`)
+
+// RedisDisk 基于 Redis 的 Store，Save 用 Lua 做比较后写入，值只增不减；有意回退走 Rewind、RewindBatch
+// 多个部署共用一个 Redis 时用 prefix 区分；集群模式下 SaveBatch、RewindBatch、SaveFenced、RewindFenced 要求键在同一个槽，prefix 需带 hash tag，如 {yscan}
+// 同时实现 LeaseStore，租约到期按 Redis 服务器时间判断
+type RedisDisk struct {
+	client  redis.UniversalClient
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedisDisk prefix 非空时实际 key 为 prefix:key
+func NewRedisDisk(client redis.UniversalClient, prefix string) *RedisDisk {
+	return &RedisDisk{client: client, prefix: prefix, timeout: defaultRedisDiskTimeout}
+}
+
+func (d *RedisDisk) key(key string) string {
+	if d.prefix == "" {
+		return key
+	}
+	return d.prefix + ":" + key
+}
+
+func (d *RedisDisk) Save(key string, val int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	cur, err := monotonicSet.Run(ctx, d.client, []string{d.key(key)}, val).Int64()
+	if err != nil {
+		return err
+	}
+	if cur != val {
+		return fmt.Errorf("%w: %s is %d, refused %d", ErrBackwards, key, cur, val)
+	}
+	return nil
+}
+
+func (d *RedisDisk) Rewind(key string, val int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return d.client.Set(ctx, d.key(key), val, 0).Err()
+}
+
+func (d *RedisDisk) Load(key string) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	val, err := d.client.Get(ctx, d.key(key)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return val, true, nil
+}
+
+// Get 不存在或读取失败返回 0
+func (d *RedisDisk) Get(key string) int64 {
+	val, _, _ := d.Load(key)
+	return val
+}
+
+// SaveBatch 与 Save 一样单调：任何一个键会变小则整批都不写，返回 ErrBackwards；有意回退走 RewindBatch
+func (d *RedisDisk) SaveBatch(kv map[string]int64) error {
+	if len(kv) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	keys := make([]string, 0, len(kv))
+	rawKeys := make([]string, 0, len(kv))
+	vals := make([]any, 0, len(kv))
+	for key, val := range kv {
+		keys = append(keys, key)
+		rawKeys = append(rawKeys, d.key(key))
+		vals = append(vals, val)
+	}
+	i, err := monotonicSetBatch.Run(ctx, d.client, rawKeys, vals...).Int64()
+	if err != nil {
+		return err
+	}
+	if i > 0 {
+		return fmt.Errorf("%w: %s, refused %d", ErrBackwards, keys[i-1], kv[keys[i-1]])
+	}
+	return nil
+}
+
+// RewindBatch 在一个 MULTI 里直接覆盖，值可以变小
+func (d *RedisDisk) RewindBatch(kv map[string]int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	_, err := d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, val := range kv {
+			pipe.Set(ctx, d.key(key), val, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+// List 用 SCAN 遍历，返回的键不带 prefix
+func (d *RedisDisk) List(prefix string) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	keys, err := d.scanKeys(ctx, redisGlobEscape(d.key(prefix))+"*", func(key string) bool {
+		return strings.HasPrefix(key, d.leaseKey("")) || strings.HasPrefix(key, d.blobKey(""))
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return out, nil
+	}
+	cmds, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		val, err := cmd.(*redis.StringCmd).Int64()
+		if errors.Is(err, redis.Nil) {
+			// 遍历后被删除
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[strings.TrimPrefix(keys[i], d.key(""))] = val
+	}
+	return out, nil
+}
+
+// scanKeys SCAN 遍历匹配的键，集群模式下逐个主节点遍历；skip 非 nil 时跳过返回 true 的键
+func (d *RedisDisk) scanKeys(ctx context.Context, match string, skip func(string) bool) ([]string, error) {
+	keys := make([]string, 0)
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, match, 1000).Iterator()
+		for iter.Next(ctx) {
+			if skip != nil && skip(iter.Val()) {
+				continue
+			}
+			keys = append(keys, iter.Val())
+		}
+		return iter.Err()
+	}
+	if cc, ok := d.client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		err := cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return scan(ctx, c)
+		})
+		return keys, err
+	}
+	return keys, scan(ctx, d.client)
+}
+
+func (d *RedisDisk) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	_, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, d.key(key))
+		}
+		return nil
+	})
+	return err
+}
+
+// blobKey 字节值与 checkpoint 分开存放，List 不会扫到
+func (d *RedisDisk) blobKey(key string) string {
+	return d.key("blob:" + key)
+}
+
+func (d *RedisDisk) SaveBlob(key string, val []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return d.client.Set(ctx, d.blobKey(key), val, 0).Err()
+}
+
+func (d *RedisDisk) LoadBlob(key string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	val, err := d.client.Get(ctx, d.blobKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// ListBlobs 与 List 一样用 SCAN 遍历，返回的键不带 prefix
+func (d *RedisDisk) ListBlobs(prefix string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	keys, err := d.scanKeys(ctx, redisGlobEscape(d.blobKey(prefix))+"*", nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return out, nil
+	}
+	cmds, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		val, err := cmd.(*redis.StringCmd).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[strings.TrimPrefix(keys[i], d.blobKey(""))] = val
+	}
+	return out, nil
+}
+
+func (d *RedisDisk) DeleteBlobs(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	_, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, d.blobKey(key))
+		}
+		return nil
+	})
+	return err
+}
+
+// leaseKey 租约与 checkpoint 分开存放，List 不会扫到
+func (d *RedisDisk) leaseKey(key string) string {
+	return d.key("lease:" + key)
+}
+
+func (d *RedisDisk) Acquire(key, owner string, ttl time.Duration) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	res, err := leaseAcquire.Run(ctx, d.client, []string{d.leaseKey(key)}, owner, ttl.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, false, err
+	}
+	return res[1], res[0] == 1, nil
+}
+
+func (d *RedisDisk) Seize(key, owner string, ttl time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return leaseSeize.Run(ctx, d.client, []string{d.leaseKey(key)}, owner, ttl.Milliseconds()).Int64()
+}
+
+func (d *RedisDisk) Release(key, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return leaseRelease.Run(ctx, d.client, []string{d.leaseKey(key)}, owner).Err()
+}
+
+func (d *RedisDisk) SaveFenced(fence Fence, key string, val int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	res, err := fencedSet.Run(ctx, d.client, []string{d.leaseKey(fence.Lease), d.key(key)}, fence.Token, val).Int64Slice()
+	if err != nil {
+		return err
+	}
+	if res[0] == 0 {
+		return fmt.Errorf("%w: %s", ErrFenced, fence.Lease)
+	}
+	if res[1] != val {
+		return fmt.Errorf("%w: %s is %d, refused %d", ErrBackwards, key, res[1], val)
+	}
+	return nil
+}
+
+func (d *RedisDisk) RewindFenced(fence Fence, kv map[string]int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	keys := []string{d.leaseKey(fence.Lease)}
+	args := []any{fence.Token}
+	for key, val := range kv {
+		keys = append(keys, d.key(key))
+		args = append(args, val)
+	}
+	ok, err := fencedSetBatch.Run(ctx, d.client, keys, args...).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return fmt.Errorf("%w: %s", ErrFenced, fence.Lease)
+	}
+	return nil
+}
+
+func (d *RedisDisk) CompareAndDelete(key string, val int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	n, err := compareDelete.Run(ctx, d.client, []string{d.key(key)}, val).Int64()
+	return n > 0, err
+}
+
+// redisGlobEscape 转义 SCAN MATCH 的通配符
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,209 @@
+package bg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRedisDiskMonotonic(t *testing.T) {
+	_, client := newTestRedis(t)
+	d := NewRedisDisk(client, "yscan")
+	if _, found, err := d.Load("ETH:scan:shard:0:checkpoint"); err != nil || found {
+		t.Fatalf("load missing: found=%v err=%v", found, err)
+	}
+	if err := d.Save("ETH:scan:shard:0:checkpoint", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save("ETH:scan:shard:0:checkpoint", 100); err != nil {
+		t.Fatalf("same value refused: %v", err)
+	}
+	if err := d.Save("ETH:scan:shard:0:checkpoint", 90); !errors.Is(err, ErrBackwards) {
+		t.Fatalf("backwards save: %v", err)
+	}
+	if val, found, err := d.Load("ETH:scan:shard:0:checkpoint"); err != nil || !found || val != 100 {
+		t.Fatalf("after backwards save: %d %v %v", val, found, err)
+	}
+	// 有意回退走 Rewind
+	if err := d.Rewind("ETH:scan:shard:0:checkpoint", 90); err != nil {
+		t.Fatal(err)
+	}
+	if val := d.Get("ETH:scan:shard:0:checkpoint"); val != 90 {
+		t.Fatalf("after rewind: %d", val)
+	}
+	if err := d.Save("ETH:scan:shard:0:checkpoint", 95); err != nil {
+		t.Fatal(err)
+	}
+	// SaveBatch 同样单调，有一个键会变小则整批不写
+	if err := d.SaveBatch(map[string]int64{"ETH:scan:shard:0:checkpoint": 10, "ETH:scan:shards": 2}); !errors.Is(err, ErrBackwards) {
+		t.Fatalf("backwards batch: %v", err)
+	}
+	if _, found, _ := d.Load("ETH:scan:shards"); found {
+		t.Fatal("backwards batch partially written")
+	}
+	if err := d.SaveBatch(map[string]int64{"ETH:scan:shard:0:checkpoint": 96, "ETH:scan:shards": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if val := d.Get("ETH:scan:shard:0:checkpoint"); val != 96 {
+		t.Fatalf("after batch: %d", val)
+	}
+	// 有意回退走 RewindBatch
+	if err := d.RewindBatch(map[string]int64{"ETH:scan:shard:0:checkpoint": 10, "ETH:scan:shards": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if val := d.Get("ETH:scan:shard:0:checkpoint"); val != 10 {
+		t.Fatalf("after rewind batch: %d", val)
+	}
+}
+
+func TestRedisDiskPrefix(t *testing.T) {
+	_, client := newTestRedis(t)
+	a, b := NewRedisDisk(client, "a"), NewRedisDisk(client, "b")
+	if err := a.Save("ETH:scan:shard:0:checkpoint", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save("ETH:scan:shard:0:checkpoint", 5); err != nil {
+		t.Fatal(err)
+	}
+	if val := a.Get("ETH:scan:shard:0:checkpoint"); val != 100 {
+		t.Fatalf("a: %d", val)
+	}
+	if val := b.Get("ETH:scan:shard:0:checkpoint"); val != 5 {
+		t.Fatalf("b: %d", val)
+	}
+	if got, err := client.Get(t.Context(), "a:ETH:scan:shard:0:checkpoint").Int64(); err != nil || got != 100 {
+		t.Fatalf("raw key: %d %v", got, err)
+	}
+	list, err := a.List("ETH:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list["ETH:scan:shard:0:checkpoint"] != 100 {
+		t.Fatalf("list a: %v", list)
+	}
+	if err := b.Delete("ETH:scan:shard:0:checkpoint"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := b.Load("ETH:scan:shard:0:checkpoint"); found {
+		t.Fatal("b not deleted")
+	}
+	if _, found, _ := a.Load("ETH:scan:shard:0:checkpoint"); !found {
+		t.Fatal("delete in b removed a's key")
+	}
+}
+
+func TestRedisDiskListSkipsLeasesAndBlobs(t *testing.T) {
+	_, client := newTestRedis(t)
+	for _, prefix := range []string{"", "yscan"} {
+		d := NewRedisDisk(client, prefix)
+		if err := d.Save("ETH:scan:member:x", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := d.Acquire("ETH:scan:shard:0:lease", "x", time.Minute); err != nil || !ok {
+			t.Fatalf("acquire: %v %v", ok, err)
+		}
+		if err := d.SaveBlob("ETH:scan:ring:100", []byte(`{"hash":"0x1"}`)); err != nil {
+			t.Fatal(err)
+		}
+		// 租约是 hash、blob 不是整数，列出全部键时不能读到它们
+		list, err := d.List("")
+		if err != nil {
+			t.Fatalf("prefix %q: %v", prefix, err)
+		}
+		if len(list) != 1 || list["ETH:scan:member:x"] != 1 {
+			t.Fatalf("prefix %q list: %v", prefix, list)
+		}
+		blobs, err := d.ListBlobs("ETH:scan:ring:")
+		if err != nil || len(blobs) != 1 || string(blobs["ETH:scan:ring:100"]) != `{"hash":"0x1"}` {
+			t.Fatalf("prefix %q blobs: %v %v", prefix, blobs, err)
+		}
+		if val, found, err := d.LoadBlob("ETH:scan:ring:100"); err != nil || !found || string(val) != `{"hash":"0x1"}` {
+			t.Fatalf("prefix %q load blob: %s %v %v", prefix, val, found, err)
+		}
+		if _, found, err := d.LoadBlob("ETH:scan:ring:101"); err != nil || found {
+			t.Fatalf("prefix %q load missing blob: %v %v", prefix, found, err)
+		}
+	}
+}
+
+func TestRedisDiskLeaseFencing(t *testing.T) {
+	mr, client := newTestRedis(t)
+	d := NewRedisDisk(client, "yscan")
+	const lease, key = "ETH:scan:shard:0:lease", "ETH:scan:shard:0:checkpoint"
+	now := time.Now()
+	mr.SetTime(now)
+
+	tokA, ok, err := d.Acquire(lease, "a", time.Second)
+	if err != nil || !ok {
+		t.Fatalf("a acquire: %v %v", ok, err)
+	}
+	// 续期 token 不变
+	if tok, ok, _ := d.Acquire(lease, "a", time.Second); !ok || tok != tokA {
+		t.Fatalf("renew: %d %v, want %d", tok, ok, tokA)
+	}
+	if _, ok, _ := d.Acquire(lease, "b", time.Second); ok {
+		t.Fatal("b acquired a live lease")
+	}
+	if err := d.SaveFenced(Fence{Lease: lease, Token: tokA}, key, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveFenced(Fence{Lease: lease, Token: tokA}, key, 50); !errors.Is(err, ErrBackwards) {
+		t.Fatalf("fenced backwards: %v", err)
+	}
+
+	// 过期后易主，token 加一，旧 token 的写入被拒绝
+	mr.SetTime(now.Add(2 * time.Second))
+	tokB, ok, err := d.Acquire(lease, "b", time.Second)
+	if err != nil || !ok || tokB != tokA+1 {
+		t.Fatalf("b acquire: %d %v %v", tokB, ok, err)
+	}
+	if err := d.SaveFenced(Fence{Lease: lease, Token: tokA}, key, 200); !errors.Is(err, ErrFenced) {
+		t.Fatalf("stale token: %v", err)
+	}
+	if err := d.SaveFenced(Fence{Lease: lease, Token: tokB}, key, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	// 主动释放后他人可立即获得，token 再加一
+	if err := d.Release(lease, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := d.Acquire(lease, "a", time.Second); ok {
+		t.Fatal("release by non-owner took effect")
+	}
+	if err := d.Release(lease, "b"); err != nil {
+		t.Fatal(err)
+	}
+	tokA2, ok, err := d.Acquire(lease, "a", time.Second)
+	if err != nil || !ok || tokA2 != tokB+1 {
+		t.Fatalf("a reacquire: %d %v %v", tokA2, ok, err)
+	}
+	if val := d.Get(key); val != 200 {
+		t.Fatalf("checkpoint %d", val)
+	}
+
+	// 回滚时被分片 0 的持有者收回：未过期也转手，token 加一，原持有者既写不进也续不了
+	tokC, err := d.Seize(lease, "c", time.Second)
+	if err != nil || tokC != tokA2+1 {
+		t.Fatalf("seize: %d %v", tokC, err)
+	}
+	if err := d.SaveFenced(Fence{Lease: lease, Token: tokA2}, key, 300); !errors.Is(err, ErrFenced) {
+		t.Fatalf("seized token: %v", err)
+	}
+	if _, ok, _ := d.Acquire(lease, "a", time.Second); ok {
+		t.Fatal("a renewed a seized lease")
+	}
+	if tok, ok, _ := d.Acquire(lease, "c", time.Second); !ok || tok != tokC {
+		t.Fatalf("c renew: %d %v", tok, ok)
+	}
+}
+
+func TestRedisDiskCompareAndDelete(t *testing.T) {
+	_, client := newTestRedis(t)
+	checkCompareAndDelete(t, NewRedisDisk(client, "yscan"))
+}
+
+func TestRedisDiskRewindFenced(t *testing.T) {
+	_, client := newTestRedis(t)
+	checkRewindFenced(t, NewRedisDisk(client, "yscan"))
+}
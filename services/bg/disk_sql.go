@@ -0,0 +1,533 @@
+package bg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Dialect SQL 方言
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// bind 把 ? 占位符换成方言的写法
+func (d Dialect) bind(q string) string {
+	if d != Postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (d Dialect) schema() []string {
+	serial := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if d == Postgres {
+		serial = "BIGSERIAL PRIMARY KEY"
+	}
+	return []string{
+		`CREATE TABLE IF NOT EXISTS yscan_kv (k TEXT PRIMARY KEY, v BIGINT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS yscan_transfer (
+			msg_id TEXT PRIMARY KEY,
+			chain TEXT NOT NULL,
+			tx_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			block_num BIGINT NOT NULL,
+			block_hash TEXT NOT NULL,
+			data TEXT NOT NULL,
+			created_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS yscan_transfer_tx ON yscan_transfer (chain, tx_id)`,
+		`CREATE TABLE IF NOT EXISTS yscan_outbox (id ` + serial + `, msg_id TEXT NOT NULL, chain TEXT NOT NULL, data TEXT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS yscan_lease (k TEXT PRIMARY KEY, owner TEXT NOT NULL, token BIGINT NOT NULL, expire BIGINT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS yscan_blob (k TEXT PRIMARY KEY, v TEXT NOT NULL)`,
+	}
+}
+
+// forUpdate 读取租约时加行锁，SQLite 写事务本身串行不需要
+func (d Dialect) forUpdate() string {
+	if d == Postgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// TxDisk 交易和 checkpoint 在同一事务里保存，Scan 的投递目标是该存储本身时不再单独投递已确认区块
+// fence 非 nil 时租约 token 不一致则整个事务放弃并返回 ErrFenced
+type TxDisk interface {
+	Store
+	SaveWithTrans(ctx context.Context, fence *Fence, key string, val int64, trans []*ContractTokenTran) error
+}
+
+// SQLDisk 基于 database/sql 的 Store，同时记录交易表和 outbox
+// 交易按去重 ID 只入库一次，新入库的同时写 outbox，由 OutboxRelay 投递到真正的 Sink
+// 作为 NewScan 的 disk 时自动成为 Scan 的 Sink；驱动由调用方导入
+// 同时实现 LeaseStore，租约到期按各实例本地时钟判断
+// SQLite 的写入在本进程内排队并以 BEGIN IMMEDIATE 开启，读取与写入互斥；多个进程共用同一个文件时 DSN 需设置 busy_timeout
+type SQLDisk struct {
+	db      *sql.DB
+	dialect Dialect
+	notify  chan struct{} // 有新的 outbox 记录
+	rw      sync.RWMutex  // SQLite 同一时间只能有一个写事务，回滚日志模式下读取碰上提交也会返回 SQLITE_BUSY
+}
+
+// NewSQLDisk 建表（已存在则跳过）
+func NewSQLDisk(db *sql.DB, dialect Dialect) (*SQLDisk, error) {
+	for _, q := range dialect.schema() {
+		if _, err := db.Exec(q); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLDisk{db: db, dialect: dialect, notify: make(chan struct{}, 1)}, nil
+}
+
+func (d *SQLDisk) Save(key string, val int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	return d.write(ctx, func(tx sqlTx) error {
+		return d.saveKV(ctx, tx, key, val)
+	})
+}
+
+func (d *SQLDisk) Load(key string) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	defer d.reading()()
+	var out int64
+	err := d.db.QueryRowContext(ctx, d.dialect.bind(`SELECT v FROM yscan_kv WHERE k = ?`), key).Scan(&out)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return out, true, nil
+}
+
+// Get 不存在或读取失败返回 0
+func (d *SQLDisk) Get(key string) int64 {
+	val, _, _ := d.Load(key)
+	return val
+}
+
+func (d *SQLDisk) SaveBatch(kv map[string]int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	return d.inTx(ctx, func(tx sqlTx) error {
+		for key, val := range kv {
+			if err := d.saveKV(ctx, tx, key, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *SQLDisk) List(prefix string) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	defer d.reading()()
+	rows, err := d.db.QueryContext(ctx, d.dialect.bind(`SELECT k, v FROM yscan_kv WHERE substr(k, 1, ?) = ?`),
+		utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]int64)
+	for rows.Next() {
+		var (
+			key string
+			val int64
+		)
+		if err := rows.Scan(&key, &val); err != nil {
+			return nil, err
+		}
+		out[key] = val
+	}
+	return out, rows.Err()
+}
+
+func (d *SQLDisk) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	args := make([]any, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	q := `DELETE FROM yscan_kv WHERE k IN (?` + strings.Repeat(", ?", len(keys)-1) + `)`
+	return d.exec(ctx, q, args...)
+}
+
+// SaveBlob 值按文本保存，Scan 写入的都是 JSON
+func (d *SQLDisk) SaveBlob(key string, val []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	return d.exec(ctx, `INSERT INTO yscan_blob (k, v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v`, key, string(val))
+}
+
+func (d *SQLDisk) LoadBlob(key string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	defer d.reading()()
+	var val string
+	err := d.db.QueryRowContext(ctx, d.dialect.bind(`SELECT v FROM yscan_blob WHERE k = ?`), key).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return []byte(val), true, nil
+}
+
+func (d *SQLDisk) ListBlobs(prefix string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	defer d.reading()()
+	rows, err := d.db.QueryContext(ctx, d.dialect.bind(`SELECT k, v FROM yscan_blob WHERE substr(k, 1, ?) = ?`),
+		utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]byte)
+	for rows.Next() {
+		var key, val string
+		if err := rows.Scan(&key, &val); err != nil {
+			return nil, err
+		}
+		out[key] = []byte(val)
+	}
+	return out, rows.Err()
+}
+
+func (d *SQLDisk) DeleteBlobs(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	args := make([]any, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	q := `DELETE FROM yscan_blob WHERE k IN (?` + strings.Repeat(", ?", len(keys)-1) + `)`
+	return d.exec(ctx, q, args...)
+}
+
+// Publish 只写交易表和 outbox
+func (d *SQLDisk) Publish(ctx context.Context, batch []*ContractTokenTran) error {
+	return d.inTx(ctx, func(tx sqlTx) error {
+		return d.insertTrans(ctx, tx, batch)
+	})
+}
+
+func (d *SQLDisk) SaveWithTrans(ctx context.Context, fence *Fence, key string, val int64, trans []*ContractTokenTran) error {
+	return d.inTx(ctx, func(tx sqlTx) error {
+		if fence != nil {
+			if err := d.checkFence(ctx, tx, *fence); err != nil {
+				return err
+			}
+		}
+		if err := d.insertTrans(ctx, tx, trans); err != nil {
+			return err
+		}
+		return d.saveKV(ctx, tx, key, val)
+	})
+}
+
+func (d *SQLDisk) Acquire(key, owner string, ttl time.Duration) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	now := time.Now().UnixMilli()
+	var (
+		token int64
+		ok    bool
+	)
+	err := d.inTx(ctx, func(tx sqlTx) error {
+		// 他人持有且未过期时不更新；易主或过期后重新获得 token 加一
+		res, err := tx.ExecContext(ctx, d.dialect.bind(
+			`INSERT INTO yscan_lease (k, owner, token, expire) VALUES (?, ?, 1, ?)
+			ON CONFLICT (k) DO UPDATE SET
+				token = CASE WHEN yscan_lease.owner = excluded.owner AND yscan_lease.expire > ? THEN yscan_lease.token ELSE yscan_lease.token + 1 END,
+				owner = excluded.owner,
+				expire = excluded.expire
+			WHERE yscan_lease.owner = excluded.owner OR yscan_lease.expire <= ?`),
+			key, owner, now+ttl.Milliseconds(), now, now)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		ok = true
+		return tx.QueryRowContext(ctx, d.dialect.bind(`SELECT token FROM yscan_lease WHERE k = ?`), key).Scan(&token)
+	})
+	return token, ok, err
+}
+
+func (d *SQLDisk) Seize(key, owner string, ttl time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	var token int64
+	err := d.inTx(ctx, func(tx sqlTx) error {
+		_, err := tx.ExecContext(ctx, d.dialect.bind(
+			`INSERT INTO yscan_lease (k, owner, token, expire) VALUES (?, ?, 1, ?)
+			ON CONFLICT (k) DO UPDATE SET token = yscan_lease.token + 1, owner = excluded.owner, expire = excluded.expire`),
+			key, owner, time.Now().UnixMilli()+ttl.Milliseconds())
+		if err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, d.dialect.bind(`SELECT token FROM yscan_lease WHERE k = ?`), key).Scan(&token)
+	})
+	return token, err
+}
+
+func (d *SQLDisk) Release(key, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	return d.exec(ctx, `UPDATE yscan_lease SET expire = 0 WHERE k = ? AND owner = ?`, key, owner)
+}
+
+func (d *SQLDisk) SaveFenced(fence Fence, key string, val int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	return d.inTx(ctx, func(tx sqlTx) error {
+		if err := d.checkFence(ctx, tx, fence); err != nil {
+			return err
+		}
+		return d.saveKV(ctx, tx, key, val)
+	})
+}
+
+func (d *SQLDisk) RewindFenced(fence Fence, kv map[string]int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	return d.inTx(ctx, func(tx sqlTx) error {
+		if err := d.checkFence(ctx, tx, fence); err != nil {
+			return err
+		}
+		for key, val := range kv {
+			if err := d.saveKV(ctx, tx, key, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *SQLDisk) CompareAndDelete(key string, val int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	var deleted bool
+	err := d.write(ctx, func(tx sqlTx) error {
+		res, err := tx.ExecContext(ctx, d.dialect.bind(`DELETE FROM yscan_kv WHERE k = ? AND v = ?`), key, val)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		deleted = n > 0
+		return err
+	})
+	return deleted, err
+}
+
+// checkFence 锁住租约行直到事务结束，接手的实例要等本次写入提交后才能拿到新 token
+func (d *SQLDisk) checkFence(ctx context.Context, tx sqlTx, fence Fence) error {
+	var token int64
+	err := tx.QueryRowContext(ctx, d.dialect.bind(`SELECT token FROM yscan_lease WHERE k = ?`+d.dialect.forUpdate()), fence.Lease).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && token != fence.Token) {
+		return fmt.Errorf("%w: %s", ErrFenced, fence.Lease)
+	}
+	return err
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// sqlTx 写事务里用到的方法，*sql.Tx 和 SQLite 手动开启事务的 *sql.Conn 都满足
+type sqlTx interface {
+	execer
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (d *SQLDisk) saveKV(ctx context.Context, db execer, key string, val int64) error {
+	_, err := db.ExecContext(ctx, d.dialect.bind(
+		`INSERT INTO yscan_kv (k, v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v`), key, val)
+	return err
+}
+
+func (d *SQLDisk) insertTrans(ctx context.Context, tx sqlTx, trans []*ContractTokenTran) error {
+	if len(trans) == 0 {
+		return nil
+	}
+	bodies, err := marshalBatch(trans)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for i, tran := range trans {
+		id := tranMsgID(tran)
+		res, err := tx.ExecContext(ctx, d.dialect.bind(
+			`INSERT INTO yscan_transfer (msg_id, chain, tx_id, event, block_num, block_hash, data, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (msg_id) DO NOTHING`),
+			id, tran.Type.Name(), tran.TxId, string(tran.Event), tran.BlockNum, tran.BlockHash, string(bodies[i]), now)
+		if err != nil {
+			return err
+		}
+		// 重扫的重复交易不再进 outbox
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		_, err = tx.ExecContext(ctx, d.dialect.bind(
+			`INSERT INTO yscan_outbox (msg_id, chain, data) VALUES (?, ?, ?)`), id, tran.Type.Name(), string(bodies[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTx 在写事务里执行 fn，提交后唤醒 OutboxRelay
+func (d *SQLDisk) inTx(ctx context.Context, fn func(tx sqlTx) error) error {
+	if err := d.write(ctx, fn); err != nil {
+		return err
+	}
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// exec 单条写语句，SQLite 下同样排队
+func (d *SQLDisk) exec(ctx context.Context, q string, args ...any) error {
+	return d.write(ctx, func(tx sqlTx) error {
+		_, err := tx.ExecContext(ctx, d.dialect.bind(q), args...)
+		return err
+	})
+}
+
+// reading SQLite 下读取等本进程的写事务结束，返回解锁函数
+func (d *SQLDisk) reading() func() {
+	if d.dialect != SQLite {
+		return func() {}
+	}
+	d.rw.RLock()
+	return d.rw.RUnlock
+}
+
+// write 开启写事务执行 fn
+// SQLite 默认的 BEGIN 先读后写时无法升级为写锁，并发的写事务会直接返回 SQLITE_BUSY；
+// 这里在本进程内排队，并在独占的连接上以 BEGIN IMMEDIATE 开启，等锁的时间交给 busy_timeout
+func (d *SQLDisk) write(ctx context.Context, fn func(tx sqlTx) error) error {
+	if d.dialect != SQLite {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	d.rw.Lock()
+	defer d.rw.Unlock()
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA busy_timeout = `+strconv.FormatInt(defaultCallTimeout.Milliseconds(), 10)); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return err
+	}
+	err = fn(conn)
+	if err == nil {
+		_, err = conn.ExecContext(ctx, `COMMIT`)
+	}
+	if err != nil {
+		if _, rerr := conn.ExecContext(context.Background(), `ROLLBACK`); rerr != nil {
+			// 事务状态不明的连接不放回连接池
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}
+	return err
+}
+
+// outboxRow 一条待投递记录
+type outboxRow struct {
+	id   int64
+	tran *ContractTokenTran
+}
+
+// pending 按写入顺序取最多 limit 条待投递记录
+func (d *SQLDisk) pending(ctx context.Context, limit int) ([]outboxRow, error) {
+	defer d.reading()()
+	rows, err := d.db.QueryContext(ctx, d.dialect.bind(`SELECT id, chain, data FROM yscan_outbox ORDER BY id LIMIT ?`), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]outboxRow, 0, limit)
+	for rows.Next() {
+		var (
+			row   outboxRow
+			chain string
+			data  string
+		)
+		if err := rows.Scan(&row.id, &chain, &data); err != nil {
+			return nil, err
+		}
+		row.tran = &ContractTokenTran{}
+		if err := json.Unmarshal([]byte(data), row.tran); err != nil {
+			return nil, err
+		}
+		row.tran.Type = NewNodeChain(chain)
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+// ack 删除已投递的记录
+func (d *SQLDisk) ack(ctx context.Context, rows []outboxRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(rows))
+	for _, row := range rows {
+		args = append(args, row.id)
+	}
+	q := `DELETE FROM yscan_outbox WHERE id IN (?` + strings.Repeat(", ?", len(rows)-1) + `)`
+	return d.exec(ctx, q, args...)
+}
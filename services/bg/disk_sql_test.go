@@ -0,0 +1,426 @@
+package bg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestSQLDisk 临时目录里的 SQLite 文件，DSN 不带任何 pragma
+func newTestSQLDisk(t *testing.T) *SQLDisk {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "yscan.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d, err := NewSQLDisk(db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// countRows 与 SQLDisk 自己的读取一样等本进程的写事务结束，relay 在后台写入时不会碰到 SQLITE_BUSY
+func countRows(t *testing.T, d *SQLDisk, table string) int {
+	defer d.reading()()
+	var n int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLDiskTransDedupe(t *testing.T) {
+	d := newTestSQLDisk(t)
+	ctx := context.Background()
+	if err := d.SaveWithTrans(ctx, nil, "ETH:scan:shard:0:checkpoint", 100, sinkBatch()); err != nil {
+		t.Fatal(err)
+	}
+	// 重扫同一批只入库一次，不再进 outbox
+	if err := d.SaveWithTrans(ctx, nil, "ETH:scan:shard:0:checkpoint", 100, sinkBatch()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Publish(ctx, sinkBatch()); err != nil {
+		t.Fatal(err)
+	}
+	// 同一笔交易的新事件是另一条记录
+	if err := d.Publish(ctx, []*ContractTokenTran{sinkBatch()[0].Retract()}); err != nil {
+		t.Fatal(err)
+	}
+	want := len(sinkBatch()) + 1
+	if n := countRows(t, d, "yscan_transfer"); n != want {
+		t.Fatalf("transfer rows %d, want %d", n, want)
+	}
+	if n := countRows(t, d, "yscan_outbox"); n != want {
+		t.Fatalf("outbox rows %d, want %d", n, want)
+	}
+	if val := d.Get("ETH:scan:shard:0:checkpoint"); val != 100 {
+		t.Fatalf("checkpoint %d", val)
+	}
+}
+
+func TestSQLDiskOutboxPendingAck(t *testing.T) {
+	d := newTestSQLDisk(t)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		tran := &ContractTokenTran{Type: CHAIN_ETH, TxId: fmt.Sprintf("0x%02d", i), Event: EventConfirmed, BlockNum: int64(i)}
+		if err := d.Publish(ctx, []*ContractTokenTran{tran}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := d.pending(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 按写入顺序取，链从 chain 列恢复
+	if len(rows) != 3 || rows[0].tran.TxId != "0x00" || rows[2].tran.TxId != "0x02" || rows[0].tran.Type != CHAIN_ETH {
+		t.Fatalf("pending %+v", rows)
+	}
+	if err := d.ack(ctx, rows[:2]); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = d.pending(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].tran.TxId != "0x02" {
+		t.Fatalf("after ack %+v", rows)
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	d := newTestSQLDisk(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &recordSink{fail: 2}
+	relay := NewOutboxRelay(d, sink, RelayCfg{BatchSize: 2, PollInterval: 10 * time.Millisecond,
+		Retry: RetryCfg{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}, nil)
+	done := make(chan error, 1)
+	go func() { done <- relay.Run(ctx) }()
+
+	ids := []string{"a", "b", "c", "d", "e"}
+	for _, id := range ids {
+		if err := d.Publish(ctx, []*ContractTokenTran{{Type: CHAIN_ETH, TxId: id, Event: EventConfirmed}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 投递失败后重试，按写入顺序全部送达后 outbox 清空
+	waitFor(t, "relay drained", func() bool { return len(sink.received()) == len(ids) })
+	if got := fmt.Sprint(sink.received()); got != fmt.Sprint(ids) {
+		t.Fatalf("relayed %s", got)
+	}
+	waitFor(t, "outbox acked", func() bool { return countRows(t, d, "yscan_outbox") == 0 })
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("run returned %v", err)
+	}
+}
+
+func TestSQLDiskFence(t *testing.T) {
+	d := newTestSQLDisk(t)
+	ctx := context.Background()
+	const lease, key = "ETH:scan:shard:0:lease", "ETH:scan:shard:0:checkpoint"
+	missing := &Fence{Lease: lease, Token: 1}
+	if err := d.SaveWithTrans(ctx, missing, key, 10, sinkBatch()); !errors.Is(err, ErrFenced) {
+		t.Fatalf("no lease row: %v", err)
+	}
+	tokA, ok, err := d.Acquire(lease, "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("a acquire: %v %v", ok, err)
+	}
+	if err := d.SaveWithTrans(ctx, &Fence{Lease: lease, Token: tokA}, key, 100, sinkBatch()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	// 释放后被 b 接手，a 的旧 token 整个事务放弃：交易和 checkpoint 都不写
+	if err := d.Release(lease, "a"); err != nil {
+		t.Fatal(err)
+	}
+	tokB, ok, err := d.Acquire(lease, "b", time.Minute)
+	if err != nil || !ok || tokB != tokA+1 {
+		t.Fatalf("b acquire: %d %v %v", tokB, ok, err)
+	}
+	if err := d.SaveWithTrans(ctx, &Fence{Lease: lease, Token: tokA}, key, 200, sinkBatch()[1:]); !errors.Is(err, ErrFenced) {
+		t.Fatalf("stale token: %v", err)
+	}
+	if err := d.SaveFenced(Fence{Lease: lease, Token: tokA}, key, 200); !errors.Is(err, ErrFenced) {
+		t.Fatalf("stale token SaveFenced: %v", err)
+	}
+	if val := d.Get(key); val != 100 {
+		t.Fatalf("checkpoint %d", val)
+	}
+	if n := countRows(t, d, "yscan_transfer"); n != 1 {
+		t.Fatalf("transfer rows %d", n)
+	}
+	if err := d.SaveWithTrans(ctx, &Fence{Lease: lease, Token: tokB}, key, 200, sinkBatch()[1:]); err != nil {
+		t.Fatal(err)
+	}
+	// 回滚时被分片 0 的持有者收回：未过期也转手，b 的 token 作废且续不了
+	tokC, err := d.Seize(lease, "c", time.Minute)
+	if err != nil || tokC != tokB+1 {
+		t.Fatalf("seize: %d %v", tokC, err)
+	}
+	if err := d.SaveFenced(Fence{Lease: lease, Token: tokB}, key, 300); !errors.Is(err, ErrFenced) {
+		t.Fatalf("seized token: %v", err)
+	}
+	if _, ok, _ := d.Acquire(lease, "b", time.Minute); ok {
+		t.Fatal("b renewed a seized lease")
+	}
+}
+
+func TestSQLDiskConcurrentWrites(t *testing.T) {
+	d := newTestSQLDisk(t)
+	ctx := context.Background()
+	const shards, rounds = 10, 50
+	fences := make([]*Fence, shards)
+	for i := range fences {
+		lease := fmt.Sprintf("ETH:scan:shard:%d:lease", i)
+		tok, ok, err := d.Acquire(lease, "a", time.Minute)
+		if err != nil || !ok {
+			t.Fatalf("acquire %d: %v %v", i, ok, err)
+		}
+		fences[i] = &Fence{Lease: lease, Token: tok}
+	}
+	// 各分片并发提交并读取进度：先读租约再写的事务不能因锁升级失败，读取不能碰上提交返回 SQLITE_BUSY
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for i := 0; i < shards; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := int64(1); h <= rounds; h++ {
+				tran := &ContractTokenTran{Type: CHAIN_ETH, TxId: fmt.Sprintf("%d-%d", i, h), Event: EventConfirmed, BlockNum: h}
+				key := fmt.Sprintf("ETH:scan:shard:%d:checkpoint", i)
+				if err := d.SaveWithTrans(ctx, fences[i], key, h, []*ContractTokenTran{tran}); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+				if _, _, err := d.Load(key); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("load: %w", err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		t.Fatalf("%d calls failed, first: %v", len(errs), errs[0])
+	}
+	if n := countRows(t, d, "yscan_outbox"); n != shards*rounds {
+		t.Fatalf("outbox rows %d", n)
+	}
+}
+
+func TestSQLDiskCommit(t *testing.T) {
+	ctx := context.Background()
+	block := func(h int64) *BlockLog {
+		return &BlockLog{Num: h, Trans: []*ContractTokenTran{{Type: CHAIN_ETH, TxId: fmt.Sprintf("0x%d", h), BlockNum: h}}}
+	}
+	// 默认投递目标就是存储本身，交易进 outbox
+	d := newTestSQLDisk(t)
+	s := NewScan(1, d, nil)
+	tl := newTestTool(d, toolOpts{})
+	if !s.commit(ctx, tl, 0, 0, block(1)) {
+		t.Fatal("commit failed")
+	}
+	if n := countRows(t, d, "yscan_outbox"); n != 1 {
+		t.Fatalf("outbox rows %d", n)
+	}
+	// 替换了 Sink 后已确认交易与其他事件一样走新的 Sink
+	d = newTestSQLDisk(t)
+	s = NewScan(1, d, nil)
+	sink := &recordSink{}
+	s.SetSink(sink)
+	tl = newTestTool(d, toolOpts{})
+	if !s.commit(ctx, tl, 0, 0, block(1)) {
+		t.Fatal("commit failed")
+	}
+	if got := sink.received(); len(got) != 1 || got[0] != "0x1" {
+		t.Fatalf("sink got %v", got)
+	}
+	if n := countRows(t, d, "yscan_outbox"); n != 0 {
+		t.Fatalf("outbox rows %d", n)
+	}
+	if val := d.Get(s.getSaveKey(tl, 0)); val != 1 {
+		t.Fatalf("checkpoint %d", val)
+	}
+}
+
+func TestSQLDiskCompareAndDelete(t *testing.T) {
+	checkCompareAndDelete(t, newTestSQLDisk(t))
+}
+
+func TestSQLDiskRewindFenced(t *testing.T) {
+	checkRewindFenced(t, newTestSQLDisk(t))
+}
+
+// sqlLog 记下驱动收到的语句和参数个数，不连真实的数据库，用来检查各方言生成的 SQL
+// 查询一律返回一行一列 token；写入一律影响一行
+type sqlLog struct {
+	mu    sync.Mutex
+	token int64
+	stmts []loggedStmt
+}
+
+type loggedStmt struct {
+	q    string // 空白压缩成单个空格
+	args int
+}
+
+func (l *sqlLog) add(q string, args int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stmts = append(l.stmts, loggedStmt{q: strings.Join(strings.Fields(q), " "), args: args})
+}
+
+func (l *sqlLog) take() []loggedStmt {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := l.stmts
+	l.stmts = nil
+	return out
+}
+
+func (l *sqlLog) Connect(context.Context) (driver.Conn, error) { return &logConn{l}, nil }
+func (l *sqlLog) Driver() driver.Driver                        { return l }
+func (l *sqlLog) Open(string) (driver.Conn, error)             { return &logConn{l}, nil }
+
+type logConn struct{ log *sqlLog }
+
+func (c *logConn) Prepare(q string) (driver.Stmt, error) { return &logStmt{c.log, q}, nil }
+func (c *logConn) Close() error                          { return nil }
+func (c *logConn) Begin() (driver.Tx, error)             { c.log.add("<begin>", 0); return c, nil }
+func (c *logConn) Commit() error                         { c.log.add("<commit>", 0); return nil }
+func (c *logConn) Rollback() error                       { c.log.add("<rollback>", 0); return nil }
+
+type logStmt struct {
+	log *sqlLog
+	q   string
+}
+
+func (s *logStmt) Close() error  { return nil }
+func (s *logStmt) NumInput() int { return -1 }
+
+func (s *logStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.log.add(s.q, len(args))
+	return driver.RowsAffected(1), nil
+}
+
+func (s *logStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.log.add(s.q, len(args))
+	return &logRows{val: s.log.token}, nil
+}
+
+type logRows struct {
+	val  int64
+	done bool
+}
+
+func (r *logRows) Columns() []string { return []string{"v"} }
+func (r *logRows) Close() error      { return nil }
+
+func (r *logRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.val
+	return nil
+}
+
+// placeholders 语句里的占位符个数；Postgres 要求按 $1..$n 依次编号且不含 ?
+func placeholders(dialect Dialect, q string) (int, error) {
+	if dialect != Postgres {
+		return strings.Count(q, "?"), nil
+	}
+	if strings.Contains(q, "?") {
+		return 0, errors.New("? left in postgres query")
+	}
+	n := 0
+	for strings.Contains(q, fmt.Sprintf("$%d", n+1)) {
+		n++
+	}
+	if strings.Count(q, "$") != n {
+		return 0, errors.New("placeholders out of order")
+	}
+	return n, nil
+}
+
+func TestSQLDialects(t *testing.T) {
+	for _, tc := range []struct {
+		dialect Dialect
+		name    string
+		want    []string // 依次出现的语句
+	}{
+		{SQLite, "sqlite", []string{
+			"CREATE TABLE IF NOT EXISTS yscan_outbox (id INTEGER PRIMARY KEY AUTOINCREMENT, msg_id TEXT NOT NULL, chain TEXT NOT NULL, data TEXT NOT NULL)",
+			// 写事务在本进程排队后以 BEGIN IMMEDIATE 开启
+			"BEGIN IMMEDIATE",
+			"INSERT INTO yscan_kv (k, v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v",
+			"COMMIT",
+			"SELECT token FROM yscan_lease WHERE k = ?",
+			"DELETE FROM yscan_kv WHERE k IN (?, ?)",
+		}},
+		{Postgres, "postgres", []string{
+			"CREATE TABLE IF NOT EXISTS yscan_outbox (id BIGSERIAL PRIMARY KEY, msg_id TEXT NOT NULL, chain TEXT NOT NULL, data TEXT NOT NULL)",
+			"<begin>",
+			"INSERT INTO yscan_kv (k, v) VALUES ($1, $2) ON CONFLICT (k) DO UPDATE SET v = excluded.v",
+			"<commit>",
+			// 租约行锁到事务结束
+			"SELECT token FROM yscan_lease WHERE k = $1 FOR UPDATE",
+			"DELETE FROM yscan_kv WHERE k IN ($1, $2)",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := &sqlLog{token: 7}
+			d, err := NewSQLDisk(sql.OpenDB(log), tc.dialect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.db.Close()
+			if err := d.Save("k", 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.SaveFenced(Fence{Lease: "l", Token: 7}, "k", 2); err != nil {
+				t.Fatal(err)
+			}
+			if token, ok, err := d.Acquire("l", "a", time.Minute); err != nil || !ok || token != 7 {
+				t.Fatalf("acquire %d %v %v", token, ok, err)
+			}
+			if err := d.Delete("a", "b"); err != nil {
+				t.Fatal(err)
+			}
+			if val, found, err := d.Load("k"); err != nil || !found || val != 7 {
+				t.Fatalf("load %d %v %v", val, found, err)
+			}
+			stmts := log.take()
+			next := 0
+			for _, st := range stmts {
+				n, err := placeholders(tc.dialect, st.q)
+				if err != nil || n != st.args {
+					t.Fatalf("%s: %d placeholders for %d args: %v", st.q, n, st.args, err)
+				}
+				if next < len(tc.want) && st.q == tc.want[next] {
+					next++
+				}
+			}
+			if next < len(tc.want) {
+				t.Fatalf("missing %q in\n%v", tc.want[next], stmts)
+			}
+		})
+	}
+}
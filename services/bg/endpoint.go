@@ -0,0 +1,183 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 波场 API key 默认放在这个头里
+const tronKeyHeader = "TRON-PRO-API-KEY"
+
+const defaultQuotaWindow = 24 * time.Hour
+
+// errKeysExhausted 节点的 key 配额都已用完，等窗口重置；节点池不把它算作节点故障
+var errKeysExhausted = errors.New("all api keys exhausted")
+
+// Endpoint 一个 RPC 节点的连接配置
+type Endpoint struct {
+	URL      string
+	Headers  map[string]string // 每个请求都带上的自定义头
+	User     string            // basic auth
+	Password string
+	Bearer   string // 非空时带 Authorization: Bearer
+
+	Keys        []string      // API key 列表，按请求轮换
+	KeyHeader   string        // 放 key 的请求头，波场空=TRON-PRO-API-KEY，其他链配置了 Keys 时必填
+	KeyQuota    int64         // 每个 key 每个窗口内最多请求次数，0=不限制
+	QuotaWindow time.Duration // 配额窗口，0=默认24h
+
+	RateLimit    float64 // 该节点每秒最多请求数，整条链所有分片共用，0=不限制
+	KeyRateLimit float64 // 每个 key 每秒最多请求数，0=不限制
+	Burst        int     // 令牌桶容量，0=1
+}
+
+func (ep Endpoint) burst() int {
+	if ep.Burst <= 0 {
+		return 1
+	}
+	return ep.Burst
+}
+
+// newLimiter rps<=0 返回 nil 表示不限速
+func newLimiter(rps float64, burst int) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rps), burst)
+}
+
+// retryAfter 429 响应里的 Retry-After，支持秒数和 HTTP 日期，没有时按 failCooldown
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return failCooldown
+}
+
+// sleepCtx 等待 d 或 ctx 结束
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// endpointsFromRpc 兼容旧的 Rpc 写法：地址各自成为节点，波场的非地址项作为所有节点共用的 key
+func endpointsFromRpc(chain ChainType, rpc []string) []Endpoint {
+	out := make([]Endpoint, 0, len(rpc))
+	keys := make([]string, 0)
+	for _, raw := range rpc {
+		if strings.Contains(raw, "://") {
+			out = append(out, Endpoint{URL: raw})
+			continue
+		}
+		if chain == CHAIN_TRON && raw != "" {
+			keys = append(keys, raw)
+		}
+	}
+	for i := range out {
+		out[i].Keys = keys
+	}
+	return out
+}
+
+// apiKey 一个 key 的配额计数，由 keyRing.mu 保护
+type apiKey struct {
+	value       string
+	used        int64
+	windowStart time.Time
+	until       time.Time     // 被限流后到这个时间之前不用
+	limiter     *rate.Limiter // nil 表示不限速
+}
+
+// keyRing 一个节点的 key 轮换和配额统计
+type keyRing struct {
+	header string
+	quota  int64
+	window time.Duration
+
+	mu   sync.Mutex
+	keys []*apiKey
+	next int
+}
+
+// newKeyRing 未配置 key 返回 nil；KeyHeader 为空时只有波场有默认头，其他链各服务商的头不同，不猜
+func newKeyRing(chain ChainType, ep Endpoint) (*keyRing, error) {
+	if len(ep.Keys) == 0 {
+		return nil, nil
+	}
+	r := &keyRing{
+		header: ep.KeyHeader,
+		quota:  ep.KeyQuota,
+		window: ep.QuotaWindow,
+	}
+	if r.header == "" {
+		if chain != CHAIN_TRON {
+			return nil, fmt.Errorf("endpoint %s: KeyHeader is required for %s api keys", ep.URL, chain.Name())
+		}
+		r.header = tronKeyHeader
+	}
+	if r.window <= 0 {
+		r.window = defaultQuotaWindow
+	}
+	for _, k := range ep.Keys {
+		r.keys = append(r.keys, &apiKey{value: k, limiter: newLimiter(ep.KeyRateLimit, ep.burst())})
+	}
+	return r, nil
+}
+
+// acquire 从上次位置往后找一个未限流、配额未用完的 key 并计数一次
+// 都不可用时返回 nil 和最早解除限流的时间，只剩配额用完的 key 时该时间为零值
+func (r *keyRing) acquire(now time.Time) (*apiKey, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var next time.Time
+	for i := 0; i < len(r.keys); i++ {
+		k := r.keys[(r.next+i)%len(r.keys)]
+		if now.Sub(k.windowStart) >= r.window {
+			k.windowStart = now
+			k.used = 0
+		}
+		if r.quota > 0 && k.used >= r.quota {
+			continue
+		}
+		if now.Before(k.until) {
+			if next.IsZero() || k.until.Before(next) {
+				next = k.until
+			}
+			continue
+		}
+		k.used++
+		r.next = (r.next + i + 1) % len(r.keys)
+		return k, time.Time{}
+	}
+	return nil, next
+}
+
+// exhaust 该 key 被节点限流，until 之前不再使用
+func (r *keyRing) exhaust(k *apiKey, until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if until.After(k.until) {
+		k.until = until
+	}
+}
@@ -0,0 +1,292 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// headerLog 记下节点收到的每个请求
+type headerLog struct {
+	mu   sync.Mutex
+	reqs []*http.Request
+}
+
+func (h *headerLog) node(t *testing.T) string {
+	return newRPCNode(t, nil, func(r *http.Request, _ []byte) (int, string) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.reqs = append(h.reqs, r)
+		return 200, `{}`
+	}).URL
+}
+
+func (h *headerLog) values(name string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]string, 0, len(h.reqs))
+	for _, r := range h.reqs {
+		out = append(out, r.Header.Get(name))
+	}
+	return out
+}
+
+// endpointPost 直接经单个节点发一个请求
+func endpointPost(t *testing.T, chain ChainType, ep Endpoint, path string) error {
+	t.Helper()
+	e, err := newEndpoint(chain, ep, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: e}).Post(poolBaseURL+path, "application/json", strings.NewReader(`{}`))
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestEndpointAuthHeaders(t *testing.T) {
+	var log headerLog
+	url := log.node(t)
+	if err := endpointPost(t, CHAIN_ETH, Endpoint{URL: url + "/v3/project?tag=a", Headers: map[string]string{"X-Custom": "c"}, User: "u", Password: "p"}, "/rpc?x=1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := endpointPost(t, CHAIN_ETH, Endpoint{URL: url, Bearer: "tok"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	r := log.reqs[0]
+	// 节点地址的路径作为前缀，查询参数合并
+	if r.URL.Path != "/v3/project/rpc" || r.URL.RawQuery != "tag=a&x=1" {
+		t.Fatalf("url %s", r.URL)
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "u" || pass != "p" || r.Header.Get("X-Custom") != "c" {
+		t.Fatalf("headers %v", r.Header)
+	}
+	if got := log.reqs[1].Header.Get("Authorization"); got != "Bearer tok" {
+		t.Fatalf("bearer %q", got)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	var tron, eth headerLog
+	ep := Endpoint{URL: tron.node(t), Keys: []string{"a", "b", "c"}}
+	e, err := newEndpoint(CHAIN_TRON, ep, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: e}
+	for i := 0; i < 4; i++ {
+		resp, err := client.Post(poolBaseURL+"/wallet/getnowblock", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if got := strings.Join(tron.values(tronKeyHeader), ","); got != "a,b,c,a" {
+		t.Fatalf("tron keys %s", got)
+	}
+	// 其他链的 key 放在配置的头里，没配置头不猜
+	if _, err := newEndpoint(CHAIN_ETH, Endpoint{URL: eth.node(t), Keys: []string{"k"}}, http.DefaultTransport); err == nil {
+		t.Fatal("eth keys accepted without KeyHeader")
+	}
+	if NewToolWithCfg(ChainScanCfg{Chain: CHAIN_BSC, Endpoints: []Endpoint{{URL: "http://127.0.0.1:1", Keys: []string{"k"}}}}) != nil {
+		t.Fatal("tool created with keys but no KeyHeader")
+	}
+	if err := endpointPost(t, CHAIN_ETH, Endpoint{URL: eth.node(t), Keys: []string{"k"}, KeyHeader: "X-Api-Key"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := eth.values("X-Api-Key"); len(got) != 1 || got[0] != "k" || eth.values(tronKeyHeader)[0] != "" {
+		t.Fatalf("eth headers %v", eth.reqs[0].Header)
+	}
+}
+
+func TestKeyQuotaExhausted(t *testing.T) {
+	var log headerLog
+	e, err := newEndpoint(CHAIN_TRON, Endpoint{URL: log.node(t), Keys: []string{"a", "b"}, KeyQuota: 2}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: e}
+	for i := 0; i < 4; i++ {
+		resp, err := client.Post(poolBaseURL, "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+	}
+	// 两个 key 各用满 2 次后不再发请求
+	if _, err := client.Post(poolBaseURL, "application/json", strings.NewReader(`{}`)); !errors.Is(err, errKeysExhausted) {
+		t.Fatalf("fifth request: %v", err)
+	}
+	if got := strings.Join(log.values(tronKeyHeader), ","); got != "a,b,a,b" {
+		t.Fatalf("keys %s", got)
+	}
+	// 窗口过后配额重新计数
+	if k, _ := e.keys.acquire(time.Now().Add(defaultQuotaWindow)); k == nil {
+		t.Fatal("quota not reset after the window")
+	}
+}
+
+func TestPoolKeysExhausted(t *testing.T) {
+	var a, b headerLog
+	p, err := newPool(CHAIN_TRON, []Endpoint{{URL: a.node(t), Keys: []string{"k"}, KeyQuota: 1}, {URL: b.node(t)}}, http.DefaultTransport, PoolCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.next.Store(1)
+	for i := 0; i < 3; i++ {
+		if code, _ := poolPost(t, p, `{}`); code != 200 {
+			t.Fatalf("request %d: status %d", i, code)
+		}
+	}
+	// 第一个节点配额用完后请求转到第二个节点，但它没被当成故障停用
+	if len(a.values(tronKeyHeader)) != 1 || len(b.values(tronKeyHeader)) != 2 {
+		t.Fatalf("requests %d %d", len(a.reqs), len(b.reqs))
+	}
+	p.probe = func(ctx context.Context, r *resty.Request) (int64, error) {
+		_, err := r.Post("")
+		return 1, err
+	}
+	p.check(context.Background())
+	if p.endpoints[0].down(time.Now()) {
+		t.Fatal("endpoint with exhausted keys marked down")
+	}
+}
+
+func TestEndpointRateLimit(t *testing.T) {
+	var log headerLog
+	url := log.node(t)
+	// 节点限速 20/s：5 个请求至少间隔 4 个 50ms
+	start := time.Now()
+	e, err := newEndpoint(CHAIN_ETH, Endpoint{URL: url, RateLimit: 20}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: e}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Post(poolBaseURL, "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("5 requests at 20/s took %s", elapsed)
+	}
+	// 每个 key 限速 10/s、容量 2：两个 key 共 4 个令牌立即可用，第 5 个要等
+	e, err = newEndpoint(CHAIN_TRON, Endpoint{URL: url, Keys: []string{"a", "b"}, KeyRateLimit: 10, Burst: 2}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: e}
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		resp, err := client.Post(poolBaseURL, "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); i < 4 && elapsed > 50*time.Millisecond {
+			t.Fatalf("request %d waited %s within the burst", i, elapsed)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("request beyond the key burst took %s", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"3", 3 * time.Second},
+		{now.Add(5 * time.Second).UTC().Format(http.TimeFormat), 5 * time.Second},
+		{"", failCooldown},
+		{"soon", failCooldown},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set("Retry-After", tc.header)
+		}
+		// HTTP 日期只精确到秒
+		if got := retryAfter(resp, now); got > tc.want || got <= tc.want-time.Second {
+			t.Fatalf("Retry-After %q: %s, want %s", tc.header, got, tc.want)
+		}
+	}
+}
+
+// throttledNode 前 n 个请求返回 429 和 Retry-After: 1，之后正常应答
+func throttledNode(t *testing.T, n int64, log *headerLog) string {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if log != nil {
+			log.mu.Lock()
+			log.reqs = append(log.reqs, r)
+			log.mu.Unlock()
+		}
+		if hits.Add(1) <= n {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestEndpointRetryAfter(t *testing.T) {
+	// 不带 key：429 原样返回，节点按 Retry-After 暂停，下一个请求等到暂停结束才发
+	e, err := newEndpoint(CHAIN_ETH, Endpoint{URL: throttledNode(t, 1, nil)}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: e}
+	start := time.Now()
+	resp, err := client.Post(poolBaseURL, "application/json", strings.NewReader(`{}`))
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("first request: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	resp, err = client.Post(poolBaseURL, "application/json", strings.NewReader(`{}`))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("second request: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("second request sent after %s, before Retry-After", elapsed)
+	}
+
+	// 带 key：被限流的 key 暂停，立即换下一个 key 重发
+	var log headerLog
+	e, err = newEndpoint(CHAIN_TRON, Endpoint{URL: throttledNode(t, 1, &log), Keys: []string{"a", "b"}}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: e}
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(poolBaseURL, "application/json", strings.NewReader(`{}`))
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("request %d: %v %v", i, resp, err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("key rotation waited %s", elapsed)
+	}
+	if got := strings.Join(log.values(tronKeyHeader), ","); got != "a,b,b" {
+		t.Fatalf("keys %s", got)
+	}
+}
@@ -2,8 +2,8 @@ package bg
 
 ///采用新的bsc client
 import (
+	"context"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
@@ -16,6 +16,7 @@ import (
 	"github.com/suiguo/yscan/services/utils"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/shopspring/decimal"
 )
 
 const TransferFix = "0xa9059cbb"
@@ -66,6 +67,20 @@ type BlockByNumberTransaction struct {
 	ChainID          string `json:"chainId"`
 }
 
+type BlockHeaderResp struct {
+	Jsonrpc string             `json:"jsonrpc"`
+	ID      int64              `json:"id"`
+	Error   Error              `json:"error"`
+	Result  *BlockHeaderResult `json:"result"`
+}
+
+type BlockHeaderResult struct {
+	Hash       string `json:"hash"`
+	Number     string `json:"number"`
+	ParentHash string `json:"parentHash"`
+	Timestamp  string `json:"timestamp"`
+}
+
 ///
 
 type BlockNumber struct {
@@ -80,9 +95,14 @@ type Error struct {
 	Message string `json:"message"`
 }
 
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
 type ReceiptRespon struct {
 	Jsonrpc string `json:"jsonrpc"`
 	ID      int64  `json:"id"`
+	Error   Error  `json:"error"`
 	Result  Result `json:"result"`
 }
 
@@ -100,8 +120,13 @@ type Result struct {
 	TransactionHash   string      `json:"transactionHash"`
 	TransactionIndex  string      `json:"transactionIndex"`
 	Type              string      `json:"type"`
+	BlobGasUsed       string      `json:"blobGasUsed,omitempty"`
+	BlobGasPrice      string      `json:"blobGasPrice,omitempty"`
 }
 
+// 节点不支持该方法
+const methodNotFound = -32601
+
 type Status string
 
 const (
@@ -118,7 +143,8 @@ type JsonRpcParam struct {
 
 // ///////
 type ContractTokenTran struct {
-	BlockNum int64 `json:"blockNum"`
+	BlockNum  int64  `json:"blockNum"`
+	BlockHash string `json:"blockHash"`
 	// Chain          string    `json:"chain"`
 	Type          ChainType `json:"-"`
 	Confirmations int64     `json:"confirmations"`
@@ -134,6 +160,31 @@ type ContractTokenTran struct {
 	TransferTimestamp int64               `json:"transferTimestamp"`
 	Transfers         []*CallbackTransfer `json:"transfers"`
 	TxId              string              `json:"txid"`
+	Event             TranEvent           `json:"event"`      //confirmed=正常入账 retracted=所在区块被分叉回滚 pending=未固化，之后另发 confirmed/retracted seen/confirming=未达确认数的进度
+	SafeHeight        int64               `json:"safeHeight"` //投递时该链的连续水位，<= 此高度的区块已全部投递
+}
+
+type TranEvent string
+
+const (
+	EventConfirmed TranEvent = "confirmed"
+	EventRetracted TranEvent = "retracted"
+	EventPending   TranEvent = "pending"
+	// 生命周期模式：出块即发 seen，确认数到达里程碑发 confirming，最终仍发 confirmed
+	EventSeen       TranEvent = "seen"
+	EventConfirming TranEvent = "confirming"
+)
+
+// Retract 复制一份作为回滚事件，原对象已投递给下游不能修改
+func (c *ContractTokenTran) Retract() *ContractTokenTran {
+	out := *c
+	out.Event = EventRetracted
+	out.Transfers = make([]*CallbackTransfer, 0, len(c.Transfers))
+	for _, tr := range c.Transfers {
+		cp := *tr
+		out.Transfers = append(out.Transfers, &cp)
+	}
+	return &out
 }
 
 type CallbackTransfer struct {
@@ -150,6 +201,15 @@ type ethTool struct {
 	requestId  atomic.Int64
 	chain_type ChainType
 	httpclient *resty.Client
+	useLogs    bool // true=代币转账走 eth_getLogs，false=解析顶层 transfer 调用
+	pool       *rpcPool
+
+	noBlockReceipts atomic.Bool // 节点不支持 eth_getBlockReceipts
+}
+
+// Close 停止节点池的后台健康检查
+func (t *ethTool) Close() error {
+	return t.pool.Close()
 }
 
 func (t *ethTool) AddContract(c ...Contract) {
@@ -159,13 +219,16 @@ func (t *ethTool) AddContract(c ...Contract) {
 		t.monitorMap.Store(data.Addr, &data)
 	}
 }
-func (t *ethTool) R() *resty.Request {
-	return t.httpclient.R()
+func (t *ethTool) R(ctx context.Context) *resty.Request {
+	return t.httpclient.R().SetContext(ctx)
 }
-func (t *ethTool) GetBlockNum() (int64, error) {
-	idx := t.requestId.Add(1)
+func (t *ethTool) GetBlockNum(ctx context.Context) (int64, error) {
+	return ethHead(t.R(ctx), t.requestId.Add(1))
+}
+
+func ethHead(r *resty.Request, idx int64) (int64, error) {
 	resp := &BlockNumber{}
-	_, err := t.R().SetResult(resp).SetBody(&JsonRpcParam{
+	_, err := r.SetResult(resp).SetBody(&JsonRpcParam{
 		Jsonrpc: "2.0",
 		Method:  "eth_blockNumber",
 		ID:      idx,
@@ -191,44 +254,198 @@ func (t *ethTool) GetContract(address string) (*Contract, bool) {
 	}
 	return contractInfo, true
 }
+
+// IsSuccess 单独查询一笔交易是否成功
+//
+// Deprecated: 扫描结果的 Success 已从回执填充
 func IsSuccess(hash string, rpc string) (bool, error) {
-	req := &JsonRpcParam{
+	t, ok := NewTool(CHAIN_ETH, []string{rpc}).(*ethTool)
+	if !ok {
+		return false, fmt.Errorf("unsupported rpc")
+	}
+	receipt, err := t.getReceipt(context.Background(), hash)
+	if err != nil {
+		return false, err
+	}
+	return receipt.Status == SuccessStatus, nil
+}
+
+func (t *ethTool) getReceipt(ctx context.Context, hash string) (*Result, error) {
+	idx := t.requestId.Add(1)
+	resp := &ReceiptRespon{}
+	_, err := t.R(ctx).SetResult(resp).SetBody(&JsonRpcParam{
 		Jsonrpc: "2.0",
 		Method:  "eth_getTransactionReceipt",
 		Params:  []any{hash},
-		ID:      0,
-	}
-	//直接写死没时间改了
-	r, code, err := utils.Req(utils.Post, rpc, nil, req)
+		ID:      idx,
+	}).Post("")
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if resp.Error.Code != 0 {
+		return nil, errors.New(resp.Error.Message)
 	}
-	if code != 200 {
-		return false, fmt.Errorf("code not 200")
+	if !strings.EqualFold(resp.Result.TransactionHash, hash) {
+		return nil, fmt.Errorf("receipt %s not found", hash)
 	}
-	resp := &ReceiptRespon{}
-	err = json.Unmarshal(r, resp)
+	return &resp.Result, nil
+}
+
+// fillReceipts 用回执补全状态和手续费，gasPrice 为 txid->gasPrice，老节点回执没有 effectiveGasPrice 时使用
+// 先按区块批量 eth_getBlockReceipts，节点不支持或缺失的再批量逐笔查询；失败时返回出错交易中最低的区块高度
+func (t *ethTool) fillReceipts(ctx context.Context, trans []*ContractTokenTran, gasPrice map[string]string) (int64, error) {
+	receipts := make(map[string]*Result)
+	if !t.noBlockReceipts.Load() {
+		calls := make([]*rpcCall, 0)
+		fetched := make(map[string]bool)
+		for _, tran := range trans {
+			if tran.BlockHash == "" || fetched[tran.BlockHash] {
+				continue
+			}
+			fetched[tran.BlockHash] = true
+			calls = append(calls, &rpcCall{
+				Method: "eth_getBlockReceipts",
+				Params: []any{tran.BlockHash},
+				Result: &[]Result{},
+			})
+		}
+		if err := t.batchCall(ctx, calls); err != nil {
+			return minBlock(trans), err
+		}
+		for _, c := range calls {
+			var rerr *Error
+			if errors.As(c.Err, &rerr) && rerr.Code == methodNotFound {
+				t.noBlockReceipts.Store(true)
+				break
+			}
+			if c.Err != nil {
+				continue
+			}
+			list := *c.Result.(*[]Result)
+			for i := range list {
+				receipts[strings.ToLower(list[i].TransactionHash)] = &list[i]
+			}
+		}
+	}
+	missing := make([]*ContractTokenTran, 0)
+	calls := make([]*rpcCall, 0)
+	for _, tran := range trans {
+		if _, ok := receipts[strings.ToLower(tran.TxId)]; ok {
+			continue
+		}
+		missing = append(missing, tran)
+		calls = append(calls, &rpcCall{
+			Method: "eth_getTransactionReceipt",
+			Params: []any{tran.TxId},
+			Result: &Result{},
+		})
+	}
+	if err := t.batchCall(ctx, calls); err != nil {
+		return minBlock(missing), err
+	}
+	failed := int64(-1)
+	var failErr error
+	for i, c := range calls {
+		receipt := c.Result.(*Result)
+		if c.Err == nil && !strings.EqualFold(receipt.TransactionHash, missing[i].TxId) {
+			c.Err = fmt.Errorf("receipt %s not found", missing[i].TxId)
+		}
+		if c.Err != nil {
+			if failed < 0 || missing[i].BlockNum < failed {
+				failed, failErr = missing[i].BlockNum, c.Err
+			}
+			continue
+		}
+		receipts[strings.ToLower(missing[i].TxId)] = receipt
+	}
+	for _, tran := range trans {
+		receipt, ok := receipts[strings.ToLower(tran.TxId)]
+		if !ok {
+			continue
+		}
+		fee, err := receiptFee(receipt, gasPrice[tran.TxId])
+		if err != nil {
+			if failed < 0 || tran.BlockNum < failed {
+				failed, failErr = tran.BlockNum, err
+			}
+			continue
+		}
+		tran.Success = receipt.Status == SuccessStatus
+		if tran.Success {
+			tran.Remark = Success
+		} else {
+			tran.Remark = Revert
+		}
+		tran.FeeSymbol = t.ChainType().Coin()
+		tran.FeeAmountCoin = fee
+	}
+	return failed, failErr
+}
+
+func minBlock(trans []*ContractTokenTran) int64 {
+	out := int64(-1)
+	for _, tran := range trans {
+		if out < 0 || tran.BlockNum < out {
+			out = tran.BlockNum
+		}
+	}
+	return out
+}
+
+// receiptFee gasUsed*effectiveGasPrice + blobGasUsed*blobGasPrice，单位为本币
+func receiptFee(receipt *Result, gasPrice string) (string, error) {
+	price := receipt.EffectiveGasPrice
+	if price == "" {
+		price = gasPrice
+	}
+	gasUsed, err := hexBig(receipt.GasUsed)
 	if err != nil {
-		return false, err
+		return "", err
+	}
+	priceVal, err := hexBig(price)
+	if err != nil {
+		return "", err
+	}
+	fee := new(big.Int).Mul(gasUsed, priceVal)
+	if receipt.BlobGasUsed != "" && receipt.BlobGasPrice != "" {
+		blobUsed, err := hexBig(receipt.BlobGasUsed)
+		if err != nil {
+			return "", err
+		}
+		blobPrice, err := hexBig(receipt.BlobGasPrice)
+		if err != nil {
+			return "", err
+		}
+		fee.Add(fee, new(big.Int).Mul(blobUsed, blobPrice))
 	}
-	if resp.Result.TransactionHash != hash {
-		return false, fmt.Errorf("please retry")
+	// 直接按 18 位小数构造，Div 有默认精度会把 wei 级的尾数舍掉
+	return decimal.NewFromBigInt(fee, -18).String(), nil
+}
+
+func hexBig(s string) (*big.Int, error) {
+	val, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid hex %q", s)
 	}
-	return resp.Result.Status == SuccessStatus, nil
+	return val, nil
 }
 
-func (t *ethTool) GetLog(blockNum int64) ([]*ContractTokenTran, error) {
-	nowblock, err := t.GetBlockNum()
+func (t *ethTool) GetLog(ctx context.Context, blockNum int64) ([]*ContractTokenTran, error) {
+	nowblock, err := t.GetBlockNum(ctx)
 	if err != nil {
 		return nil, err
 	}
 	var has bool
 	for i := 0; i < 5; i++ {
-		has, err = t.hasTransfer(blockNum)
+		has, err = t.hasTransfer(ctx, blockNum)
 		if has && err == nil {
 			break
 		}
-		time.Sleep(time.Millisecond * 500)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond * 500):
+		}
 	}
 	if err != nil {
 		return nil, err
@@ -236,35 +453,87 @@ func (t *ethTool) GetLog(blockNum int64) ([]*ContractTokenTran, error) {
 	if !has {
 		return []*ContractTokenTran{}, nil
 	}
-	transfer, err := t.getBlockByNum(blockNum, nowblock)
+	block, err := t.getBlockByNum(ctx, blockNum, nowblock)
 	if err != nil {
 		return nil, err
 	}
-	return transfer, err
+	return block.Trans, err
 }
-func (t *ethTool) getBlockByNum(blockNum int64, nowblock int64) ([]*ContractTokenTran, error) {
+
+// GetBlockLog 与 GetLog 相同但带上区块哈希，空块也返回，用于分叉检测
+func (t *ethTool) GetBlockLog(ctx context.Context, blockNum int64) (*BlockLog, error) {
+	nowblock, err := t.GetBlockNum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.getBlockByNum(ctx, blockNum, nowblock)
+}
+
+// GetBlockHash 只取区块头，返回当前主链上该高度的哈希
+func (t *ethTool) GetBlockHash(ctx context.Context, blockNum int64) (string, error) {
 	idx := t.requestId.Add(1)
-	info := &BlockByNumberResp{}
-	_, err := t.R().SetResult(info).SetBody(&JsonRpcParam{
+	info := &BlockHeaderResp{}
+	_, err := t.R(ctx).SetResult(info).SetBody(&JsonRpcParam{
 		Jsonrpc: "2.0",
 		Method:  "eth_getBlockByNumber",
 		ID:      idx,
-		Params:  []any{fmt.Sprintf("0x%x", blockNum), true},
+		Params:  []any{fmt.Sprintf("0x%x", blockNum), false},
 	}).Post("")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if info.Error.Code != 0 {
-		return nil, fmt.Errorf(info.Error.Message)
+		return "", errors.New(info.Error.Message)
+	}
+	if info.Result == nil || info.Result.Hash == "" {
+		return "", fmt.Errorf("block %d not found", blockNum)
+	}
+	return info.Result.Hash, nil
+}
+
+func (t *ethTool) GetBlockTime(ctx context.Context, blockNum int64) (time.Time, error) {
+	idx := t.requestId.Add(1)
+	info := &BlockHeaderResp{}
+	_, err := t.R(ctx).SetResult(info).SetBody(&JsonRpcParam{
+		Jsonrpc: "2.0",
+		Method:  "eth_getBlockByNumber",
+		ID:      idx,
+		Params:  []any{fmt.Sprintf("0x%x", blockNum), false},
+	}).Post("")
+	if err != nil {
+		return time.Time{}, err
 	}
+	if info.Error.Code != 0 {
+		return time.Time{}, errors.New(info.Error.Message)
+	}
+	if info.Result == nil || info.Result.Timestamp == "" {
+		return time.Time{}, fmt.Errorf("block %d not found", blockNum)
+	}
+	ts, err := strconv.ParseInt(info.Result.Timestamp, 0, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts, 0), nil
+}
+
+func (t *ethTool) getBlockByNum(ctx context.Context, blockNum int64, nowblock int64) (*BlockLog, error) {
+	blocks, err := t.getBlockLogs(ctx, []int64{blockNum}, nowblock)
+	if len(blocks) == 0 {
+		return nil, err
+	}
+	return blocks[0], nil
+}
+
+// parseBlock 解析本币转账和顶层 transfer 调用；日志模式下代币转账另从日志取
+func (t *ethTool) parseBlock(info *BlockByNumberResult, blockNum int64, nowblock int64) ([]*ContractTokenTran, error) {
 	outtransfer := make([]*ContractTokenTran, 0)
 	//bnb本币
-	for _, tran := range info.Result.Transactions {
+	for _, tran := range info.Transactions {
 		transfertmp := &ContractTokenTran{
 			Type:          t.ChainType(),
 			Confirmations: nowblock - blockNum,
-			FeeAmountCoin: t.ChainType().Name(),
 			BlockNum:      blockNum,
+			BlockHash:     info.Hash,
 			TxId:          tran.Hash,
 			Transfers:     make([]*CallbackTransfer, 0),
 		}
@@ -284,10 +553,13 @@ func (t *ethTool) getBlockByNum(blockNum int64, nowblock int64) ([]*ContractToke
 					Contract:    "",
 					Amount:      realamount.String(),
 					ToAddress:   tran.To,
-					Symbol:      t.chain_type.Name(),
+					Symbol:      t.ChainType().Coin(),
 				})
 		} else {
-			//合约交易
+			//合约交易；日志模式下统一从 Transfer 日志解析
+			if t.useLogs {
+				continue
+			}
 			contract, ok := t.GetContract(tran.To)
 			if !ok {
 				continue
@@ -298,8 +570,8 @@ func (t *ethTool) getBlockByNum(blockNum int64, nowblock int64) ([]*ContractToke
 			if !strings.HasPrefix(tran.Input, TransferFix) {
 				continue
 			}
-			toAddr := tran.Input[len(TransferFix) : len(TransferFix)+64]
-			toAddr = fmt.Sprintf("0x%s", strings.TrimLeft(toAddr, "0"))
+			// 参数左补零到 32 字节，取后 20 字节；不能去掉前导零，地址本身可能以 0 开头
+			toAddr := "0x" + tran.Input[len(TransferFix)+24:len(TransferFix)+64]
 			value := tran.Input[len(TransferFix)+64:]
 			val := new(big.Int)
 			tran_val, err := hex.DecodeString(value)
@@ -329,10 +601,10 @@ func (t *ethTool) ChainType() ChainType {
 	return t.chain_type
 }
 
-func (t *ethTool) hasTransfer(block int64) (bool, error) {
+func (t *ethTool) hasTransfer(ctx context.Context, block int64) (bool, error) {
 	idx := t.requestId.Add(1)
 	resp := &BlockNumber{}
-	_, err := t.R().SetResult(resp).SetBody(&JsonRpcParam{
+	_, err := t.R(ctx).SetResult(resp).SetBody(&JsonRpcParam{
 		Jsonrpc: "2.0",
 		Method:  "eth_getBlockTransactionCountByNumber",
 		ID:      idx,
@@ -342,7 +614,7 @@ func (t *ethTool) hasTransfer(block int64) (bool, error) {
 		return false, err
 	}
 	if resp.Error.Message != "" {
-		return false, fmt.Errorf(resp.Error.Message)
+		return false, errors.New(resp.Error.Message)
 	}
 	num, err := strconv.ParseInt(resp.Result, 0, 64)
 	if err != nil {
@@ -0,0 +1,192 @@
+package bg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// 单个批量请求最多包含的调用数，多数节点限制在 100~1000
+const maxBatchCalls = 100
+
+// rpcCall 批量请求中的一项，Result 为反序列化目标，Err 为该项自己的错误
+type rpcCall struct {
+	Method string
+	Params []any
+	Result any
+	Err    error
+}
+
+type rpcResp struct {
+	ID     int64           `json:"id"`
+	Error  *Error          `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
+// batchCall 按 maxBatchCalls 分批发送 JSON-RPC batch，按 id 回填每一项；
+// 返回 error 表示整批失败（网络、HTTP 状态、响应无法解析），单项失败记录在 rpcCall.Err
+func (t *ethTool) batchCall(ctx context.Context, calls []*rpcCall) error {
+	for from := 0; from < len(calls); from += maxBatchCalls {
+		to := min(from+maxBatchCalls, len(calls))
+		if err := t.batchOnce(ctx, calls[from:to]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *ethTool) batchOnce(ctx context.Context, calls []*rpcCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	reqs := make([]*JsonRpcParam, 0, len(calls))
+	byID := make(map[int64]*rpcCall, len(calls))
+	for _, c := range calls {
+		idx := t.requestId.Add(1)
+		params := c.Params
+		if params == nil {
+			params = []any{}
+		}
+		reqs = append(reqs, &JsonRpcParam{
+			Jsonrpc: "2.0",
+			Method:  c.Method,
+			Params:  params,
+			ID:      idx,
+		})
+		byID[idx] = c
+	}
+	resp, err := t.R(ctx).SetBody(reqs).Post("")
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("batch http status %d", resp.StatusCode())
+	}
+	out := make([]rpcResp, 0, len(calls))
+	if err := json.Unmarshal(resp.Body(), &out); err != nil {
+		// 整批被拒时部分节点返回单个错误对象
+		single := &rpcResp{}
+		if json.Unmarshal(resp.Body(), single) == nil && single.Error != nil {
+			return single.Error
+		}
+		return err
+	}
+	for _, r := range out {
+		c, ok := byID[r.ID]
+		if !ok {
+			continue
+		}
+		delete(byID, r.ID)
+		if r.Error != nil && r.Error.Code != 0 {
+			c.Err = r.Error
+			continue
+		}
+		if c.Result != nil {
+			c.Err = json.Unmarshal(r.Result, c.Result)
+		}
+	}
+	for _, c := range byID {
+		c.Err = fmt.Errorf("no response for %s", c.Method)
+	}
+	return nil
+}
+
+// GetBlockLogs 一次批量请求取多个高度（连同最新高度），按 nums 顺序返回；
+// 某个高度失败时返回它之前已成功的区块和该错误，nums 需升序
+func (t *ethTool) GetBlockLogs(ctx context.Context, nums []int64) ([]*BlockLog, error) {
+	return t.getBlockLogs(ctx, nums, 0)
+}
+
+// getBlockLogs nowblock<=0 时在同一批里查询最新高度
+func (t *ethTool) getBlockLogs(ctx context.Context, nums []int64, nowblock int64) ([]*BlockLog, error) {
+	calls := make([]*rpcCall, 0, len(nums)+1)
+	var head string
+	if nowblock <= 0 {
+		calls = append(calls, &rpcCall{Method: "eth_blockNumber", Result: &head})
+	}
+	infos := make([]*BlockByNumberResult, len(nums))
+	for i, h := range nums {
+		infos[i] = &BlockByNumberResult{}
+		calls = append(calls, &rpcCall{
+			Method: "eth_getBlockByNumber",
+			Params: []any{fmt.Sprintf("0x%x", h), true},
+			Result: infos[i],
+		})
+	}
+	if err := t.batchCall(ctx, calls); err != nil {
+		return nil, err
+	}
+	if nowblock <= 0 {
+		if calls[0].Err != nil {
+			return nil, calls[0].Err
+		}
+		now, err := strconv.ParseInt(head, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		nowblock = now
+		calls = calls[1:]
+	}
+	out := make([]*BlockLog, 0, len(nums))
+	var fail error
+	for i, h := range nums {
+		if calls[i].Err != nil {
+			fail = fmt.Errorf("block %d: %w", h, calls[i].Err)
+			break
+		}
+		if infos[i].Hash == "" {
+			fail = fmt.Errorf("block %d not found", h)
+			break
+		}
+		trans, err := t.parseBlock(infos[i], h, nowblock)
+		if err != nil {
+			fail = fmt.Errorf("block %d: %w", h, err)
+			break
+		}
+		out = append(out, &BlockLog{
+			Num:        h,
+			Hash:       infos[i].Hash,
+			ParentHash: infos[i].ParentHash,
+			Trans:      trans,
+		})
+	}
+	if t.useLogs && len(out) > 0 && len(t.contractAddrs()) > 0 {
+		byNum, stale, err := t.transferLogs(ctx, out)
+		if err != nil {
+			return nil, err
+		}
+		for i, bl := range out {
+			if stale > 0 && bl.Num >= stale {
+				out, fail = out[:i], fmt.Errorf("logs %d: block hash changed", stale)
+				break
+			}
+			logs, err := t.parseTransferLogs(byNum[bl.Num], nowblock)
+			if err != nil {
+				out, fail = out[:i], fmt.Errorf("logs %d: %w", bl.Num, err)
+				break
+			}
+			bl.Trans = mergeByTx(bl.Trans, logs)
+		}
+	}
+	trans := make([]*ContractTokenTran, 0)
+	gasPrice := make(map[string]string)
+	for i, bl := range out {
+		trans = append(trans, bl.Trans...)
+		for _, tran := range infos[i].Transactions {
+			gasPrice[tran.Hash] = tran.GasPrice
+		}
+	}
+	if len(trans) == 0 {
+		return out, fail
+	}
+	failed, err := t.fillReceipts(ctx, trans, gasPrice)
+	if err != nil {
+		for i, bl := range out {
+			if bl.Num >= failed {
+				return out[:i], fmt.Errorf("receipt %d: %w", bl.Num, err)
+			}
+		}
+	}
+	return out, fail
+}
@@ -0,0 +1,159 @@
+package bg
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/suiguo/yscan/services/utils"
+)
+
+type EthLog struct {
+	Address          string   `json:"address"`
+	Topics           []string `json:"topics"`
+	Data             string   `json:"data"`
+	BlockNumber      string   `json:"blockNumber"`
+	BlockHash        string   `json:"blockHash"`
+	TransactionHash  string   `json:"transactionHash"`
+	TransactionIndex string   `json:"transactionIndex"`
+	LogIndex         string   `json:"logIndex"`
+	Removed          bool     `json:"removed"`
+}
+
+func (t *ethTool) contractAddrs() []string {
+	out := make([]string, 0)
+	t.monitorMap.Range(func(k, _ any) bool {
+		if addr, ok := k.(string); ok && addr != "" {
+			out = append(out, addr)
+		}
+		return true
+	})
+	return out
+}
+
+// transferFilter 在区间条件上加监控合约和 Transfer topic
+func (t *ethTool) transferFilter(filter map[string]any) map[string]any {
+	filter["address"] = t.contractAddrs()
+	filter["topics"] = []any{ChainTransferTopic}
+	return filter
+}
+
+// transferLogs 一次 eth_getLogs 取 blocks 所在区间的 Transfer 日志，按高度分给各区块
+// 分片的高度跨 GoNum 不连续，区间内其他分片的日志丢弃；日志的区块哈希与 blocks 不一致说明两次请求之间分叉了，
+// stale 为最低的这种高度，调用方只保留它之前的区块，其余下一轮重新拉取
+func (t *ethTool) transferLogs(ctx context.Context, blocks []*BlockLog) (byNum map[int64][]EthLog, stale int64, err error) {
+	hashes := make(map[int64]string, len(blocks))
+	for _, bl := range blocks {
+		hashes[bl.Num] = bl.Hash
+	}
+	logs := make([]EthLog, 0)
+	call := &rpcCall{
+		Method: "eth_getLogs",
+		Params: []any{t.transferFilter(map[string]any{
+			"fromBlock": fmt.Sprintf("0x%x", blocks[0].Num),
+			"toBlock":   fmt.Sprintf("0x%x", blocks[len(blocks)-1].Num),
+		})},
+		Result: &logs,
+	}
+	if err := t.batchCall(ctx, []*rpcCall{call}); err != nil {
+		return nil, 0, err
+	}
+	if call.Err != nil {
+		return nil, 0, call.Err
+	}
+	byNum = make(map[int64][]EthLog, len(blocks))
+	for _, lg := range logs {
+		n, err := strconv.ParseInt(lg.BlockNumber, 0, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		hash, ok := hashes[n]
+		if !ok {
+			continue
+		}
+		if !strings.EqualFold(lg.BlockHash, hash) {
+			if stale == 0 || n < stale {
+				stale = n
+			}
+			continue
+		}
+		byNum[n] = append(byNum[n], lg)
+	}
+	return byNum, stale, nil
+}
+
+// parseTransferLogs 同一笔交易的多条日志合并
+func (t *ethTool) parseTransferLogs(logs []EthLog, nowblock int64) ([]*ContractTokenTran, error) {
+	out := make([]*ContractTokenTran, 0)
+	byTx := make(map[string]*ContractTokenTran)
+	for _, lg := range logs {
+		// removed=true 的日志已被分叉丢弃；4 个 topic 的是 ERC721
+		if lg.Removed || len(lg.Topics) != 3 || lg.Topics[0] != ChainTransferTopic {
+			continue
+		}
+		if len(lg.Topics[1]) != 66 || len(lg.Topics[2]) != 66 {
+			continue
+		}
+		contract, ok := t.GetContract(lg.Address)
+		if !ok {
+			continue
+		}
+		blockNum, err := strconv.ParseInt(lg.BlockNumber, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		logIdx, err := strconv.ParseInt(lg.LogIndex, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		tranVal, err := hex.DecodeString(strings.TrimPrefix(lg.Data, "0x"))
+		if err != nil || len(tranVal) == 0 {
+			continue
+		}
+		realamount, err := utils.ChainValue(new(big.Int).SetBytes(tranVal).String(), contract.Decimals)
+		if err != nil {
+			continue
+		}
+		tran, ok := byTx[lg.TransactionHash]
+		if !ok {
+			tran = &ContractTokenTran{
+				Type:          t.ChainType(),
+				Confirmations: nowblock - blockNum,
+				BlockNum:      blockNum,
+				BlockHash:     lg.BlockHash,
+				TxId:          lg.TransactionHash,
+				Transfers:     make([]*CallbackTransfer, 0),
+			}
+			byTx[lg.TransactionHash] = tran
+			out = append(out, tran)
+		}
+		tran.Transfers = append(tran.Transfers, &CallbackTransfer{
+			FromAddress: "0x" + lg.Topics[1][26:],
+			ToAddress:   "0x" + lg.Topics[2][26:],
+			Contract:    contract.Addr,
+			Amount:      realamount.String(),
+			Symbol:      contract.TokenName,
+			LogIdx:      int(logIdx),
+		})
+	}
+	return out, nil
+}
+
+// mergeByTx 把 extra 中的转账并入 base 的同一笔交易，没有的追加
+func mergeByTx(base []*ContractTokenTran, extra []*ContractTokenTran) []*ContractTokenTran {
+	byTx := make(map[string]*ContractTokenTran, len(base))
+	for _, tran := range base {
+		byTx[tran.TxId] = tran
+	}
+	for _, tran := range extra {
+		if exist, ok := byTx[tran.TxId]; ok {
+			exist.Transfers = append(exist.Transfers, tran.Transfers...)
+			continue
+		}
+		base = append(base, tran)
+	}
+	return base
+}
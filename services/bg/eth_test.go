@@ -0,0 +1,476 @@
+package bg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ethNode JSON-RPC 节点桩：按方法名应答，batch 可以倒序返回、漏掉部分 id
+type ethNode struct {
+	mu      sync.Mutex
+	methods map[string]func(params []json.RawMessage) (any, *Error)
+	reverse bool            // batch 倒序返回
+	drop    map[string]bool // batch 中不返回这些方法
+	short   int             // 非零时 batch 只返回前 short 项
+	batches int             // 收到的 batch 请求数
+}
+
+type ethReq struct {
+	ID     int64             `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+func (n *ethNode) answer(req ethReq) map[string]any {
+	out := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+	fn, ok := n.methods[req.Method]
+	if !ok {
+		out["error"] = &Error{Code: methodNotFound, Message: "the method " + req.Method + " does not exist"}
+		return out
+	}
+	result, err := fn(req.Params)
+	if err != nil {
+		out["error"] = err
+		return out
+	}
+	out["result"] = result
+	return out
+}
+
+func (n *ethNode) start(t *testing.T) *ethTool {
+	url := newRPCNode(t, nil, func(_ *http.Request, body []byte) (int, string) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		var out any
+		if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+			n.batches++
+			var reqs []ethReq
+			if err := json.Unmarshal(body, &reqs); err != nil {
+				return 400, err.Error()
+			}
+			list := make([]map[string]any, 0, len(reqs))
+			for _, req := range reqs {
+				if !n.drop[req.Method] {
+					list = append(list, n.answer(req))
+				}
+			}
+			if n.short > 0 && len(list) > n.short {
+				list = list[:n.short]
+			}
+			if n.reverse {
+				slices.Reverse(list)
+			}
+			out = list
+		} else {
+			var req ethReq
+			if err := json.Unmarshal(body, &req); err != nil {
+				return 400, err.Error()
+			}
+			out = n.answer(req)
+		}
+		raw, _ := json.Marshal(out)
+		return 200, string(raw)
+	}).URL
+	tool, ok := NewToolWithCfg(ChainScanCfg{Chain: CHAIN_ETH, Endpoints: []Endpoint{{URL: url}}, Pool: PoolCfg{HealthInterval: 1 << 40}}).(*ethTool)
+	if !ok {
+		t.Fatal("eth tool not created")
+	}
+	t.Cleanup(func() { tool.Close() })
+	return tool
+}
+
+// hexParam 第 i 个参数按十六进制高度解析
+func hexParam(params []json.RawMessage, i int) int64 {
+	var s string
+	json.Unmarshal(params[i], &s)
+	var n int64
+	fmt.Sscanf(s, "0x%x", &n)
+	return n
+}
+
+func strParam(params []json.RawMessage, i int) string {
+	var s string
+	json.Unmarshal(params[i], &s)
+	return s
+}
+
+func TestBatchCallMatchesByID(t *testing.T) {
+	echo := func(v string) func([]json.RawMessage) (any, *Error) {
+		return func([]json.RawMessage) (any, *Error) { return v, nil }
+	}
+	for _, tc := range []struct {
+		name    string
+		reverse bool
+		drop    map[string]bool
+		short   int
+		want    string
+	}{
+		{"in order", false, nil, 0, "a:ra b:rb c:err -32000 d:err -32601"},
+		{"out of order", true, nil, 0, "a:ra b:rb c:err -32000 d:err -32601"},
+		{"missing id", true, map[string]bool{"b": true}, 0, "a:ra b:missing c:err -32000 d:err -32601"},
+		// 应答数组比请求短：没有应答的项各自失败，已有的结果照用
+		{"short reply", true, nil, 2, "a:ra b:rb c:missing d:missing"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := &ethNode{reverse: tc.reverse, drop: tc.drop, short: tc.short, methods: map[string]func([]json.RawMessage) (any, *Error){
+				"a": echo("ra"),
+				"b": echo("rb"),
+				"c": func([]json.RawMessage) (any, *Error) { return nil, &Error{Code: -32000, Message: "header not found"} },
+			}}
+			tool := node.start(t)
+			calls := make([]*rpcCall, 0, 4)
+			for _, m := range []string{"a", "b", "c", "d"} {
+				var out string
+				calls = append(calls, &rpcCall{Method: m, Result: &out})
+			}
+			if err := tool.batchCall(t.Context(), calls); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(calls))
+			for _, c := range calls {
+				var rerr *Error
+				switch {
+				case errors.As(c.Err, &rerr):
+					got = append(got, fmt.Sprintf("%s:err %d", c.Method, rerr.Code))
+				case c.Err != nil:
+					got = append(got, c.Method+":missing")
+				default:
+					got = append(got, c.Method+":"+*c.Result.(*string))
+				}
+			}
+			if strings.Join(got, " ") != tc.want {
+				t.Fatalf("got %s", strings.Join(got, " "))
+			}
+		})
+	}
+}
+
+func TestBatchCallSplitsAndFails(t *testing.T) {
+	node := &ethNode{methods: map[string]func([]json.RawMessage) (any, *Error){
+		"eth_blockNumber": func([]json.RawMessage) (any, *Error) { return "0x1", nil },
+	}}
+	tool := node.start(t)
+	calls := make([]*rpcCall, maxBatchCalls+1)
+	for i := range calls {
+		var out string
+		calls[i] = &rpcCall{Method: "eth_blockNumber", Result: &out}
+	}
+	if err := tool.batchCall(t.Context(), calls); err != nil {
+		t.Fatal(err)
+	}
+	if node.batches != 2 || calls[maxBatchCalls].Err != nil || *calls[maxBatchCalls].Result.(*string) != "0x1" {
+		t.Fatalf("batches %d, last %v", node.batches, calls[maxBatchCalls].Err)
+	}
+	// 整批被拒时节点返回单个错误对象
+	rejected := newRPCNode(t, nil, func(*http.Request, []byte) (int, string) {
+		return 200, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"batch too large"}}`
+	}).URL
+	tool = NewToolWithCfg(ChainScanCfg{Chain: CHAIN_ETH, Endpoints: []Endpoint{{URL: rejected}}, Pool: PoolCfg{HealthInterval: 1 << 40}}).(*ethTool)
+	defer tool.Close()
+	var rerr *Error
+	if err := tool.batchCall(t.Context(), calls[:2]); !errors.As(err, &rerr) || rerr.Code != -32600 {
+		t.Fatalf("rejected batch: %v", err)
+	}
+}
+
+func TestReceiptFee(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		receipt  Result
+		gasPrice string
+		want     string
+	}{
+		{"effective price", Result{GasUsed: "0x5208", EffectiveGasPrice: "0x3b9aca00"}, "0x1", "0.000021"},
+		{"legacy gas price", Result{GasUsed: "0x5208"}, "0x3b9aca00", "0.000021"},
+		{"single wei", Result{GasUsed: "0x1", EffectiveGasPrice: "0x1"}, "", "0.000000000000000001"},
+		{"whole coins", Result{GasUsed: "0x1c9c380", EffectiveGasPrice: "0x174876e800"}, "", "3"},
+		{"blob gas", Result{GasUsed: "0x5208", EffectiveGasPrice: "0x1", BlobGasUsed: "0x20000", BlobGasPrice: "0x2"}, "", "0.000000000000283144"},
+		{"no price", Result{GasUsed: "0x5208"}, "", ""},
+		{"bad gas used", Result{GasUsed: "0xzz", EffectiveGasPrice: "0x1"}, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := receiptFee(&tc.receipt, tc.gasPrice)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("fee %s, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("fee %s %v, want %s", got, err, tc.want)
+			}
+		})
+	}
+}
+
+const (
+	usdtAddr  = "0xdac17f958d2ee523a2206206994597c13d831ec7"
+	aliceAddr = "0x00000000000000000000000000000000000a11ce"
+	bobAddr   = "0x0000000000000000000000000000000000000b0b"
+)
+
+func addrTopic(addr string) string {
+	return "0x" + strings.Repeat("0", 24) + strings.TrimPrefix(addr, "0x")
+}
+
+func TestParseTransferLogs(t *testing.T) {
+	tool := &ethTool{chain_type: CHAIN_ETH}
+	tool.AddContract(Contract{Addr: usdtAddr, TokenName: "USDT", Decimals: 6})
+	transfer := func(tx string, idx int, amount string) EthLog {
+		return EthLog{Address: usdtAddr, Topics: []string{ChainTransferTopic, addrTopic(aliceAddr), addrTopic(bobAddr)},
+			Data: amount, BlockNumber: "0x64", BlockHash: "0xb100", TransactionHash: tx, LogIndex: fmt.Sprintf("0x%x", idx)}
+	}
+	for _, tc := range []struct {
+		name string
+		log  func(EthLog) EthLog
+		want string
+	}{
+		{"erc20", func(l EthLog) EthLog { return l }, "0xt1 100 3: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 1.5 USDT #2"},
+		{"removed", func(l EthLog) EthLog { l.Removed = true; return l }, ""},
+		{"erc721", func(l EthLog) EthLog { l.Topics = append(l.Topics, addrTopic("0x1")); return l }, ""},
+		{"other event", func(l EthLog) EthLog { l.Topics[0] = "0x8c5be1e5"; return l }, ""},
+		{"unwatched contract", func(l EthLog) EthLog { l.Address = bobAddr; return l }, ""},
+		{"upper-case contract", func(l EthLog) EthLog { l.Address = "0x" + strings.ToUpper(usdtAddr[2:]); return l }, "0xt1 100 3: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 1.5 USDT #2"},
+		{"empty data", func(l EthLog) EthLog { l.Data = "0x"; return l }, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := []EthLog{tc.log(transfer("0xt1", 2, "0x"+fmt.Sprintf("%064x", 1500000)))}
+			out, err := tool.parseTransferLogs(logs, 103)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describeTrans(out); got != tc.want {
+				t.Fatalf("got %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+	// 同一笔交易的多条日志合并为一笔，转账按日志顺序
+	out, err := tool.parseTransferLogs([]EthLog{
+		transfer("0xt1", 1, fmt.Sprintf("0x%064x", 1)),
+		transfer("0xt2", 2, fmt.Sprintf("0x%064x", 2)),
+		transfer("0xt1", 3, fmt.Sprintf("0x%064x", 3)),
+	}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || len(out[0].Transfers) != 2 || out[0].Transfers[1].Amount != "0.000003" || out[0].Transfers[1].LogIdx != 3 {
+		t.Fatalf("merged %s", describeTrans(out))
+	}
+	if _, err := tool.parseTransferLogs([]EthLog{func() EthLog { l := transfer("0xt1", 1, "0x01"); l.BlockNumber = "x"; return l }()}, 100); err == nil {
+		t.Fatal("bad block number accepted")
+	}
+}
+
+// describeTrans 每笔交易一行：txid 高度 确认数: from->to 数量 币种 #日志序号
+func describeTrans(trans []*ContractTokenTran) string {
+	lines := make([]string, 0, len(trans))
+	for _, tran := range trans {
+		parts := make([]string, 0, len(tran.Transfers))
+		for _, tr := range tran.Transfers {
+			parts = append(parts, fmt.Sprintf("%s->%s %s %s #%d", tr.FromAddress, tr.ToAddress, tr.Amount, tr.Symbol, tr.LogIdx))
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %d: %s", tran.TxId, tran.BlockNum, tran.Confirmations, strings.Join(parts, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// blockNode 高度 100、101 两个区块的节点：100 有一笔 ETH 转账和一笔失败的 USDT transfer，101 有一笔 transferFrom 产生的日志
+func blockNode(receiptsByBlock bool) *ethNode {
+	transferInput := TransferFix + fmt.Sprintf("%064s%064x", strings.TrimPrefix(bobAddr, "0x"), 2500000)
+	blocks := map[int64]map[string]any{
+		100: {"hash": "0xb100", "parentHash": "0xb099", "transactions": []map[string]string{
+			{"hash": "0xeth", "from": aliceAddr, "to": bobAddr, "input": "0x", "value": "0xde0b6b3a7640000", "gasPrice": "0x3b9aca00"},
+			{"hash": "0xusdt", "from": aliceAddr, "to": usdtAddr, "input": transferInput, "value": "0x0", "gasPrice": "0x2"},
+		}},
+		101: {"hash": "0xb101", "parentHash": "0xb100", "transactions": []map[string]string{
+			{"hash": "0xfrom", "from": aliceAddr, "to": "0x00000000000000000000000000000000000c0de0", "input": "0x23b872dd", "value": "0x0", "gasPrice": "0x1"},
+		}},
+	}
+	receipts := map[string]map[string]string{
+		"0xeth":  {"transactionHash": "0xeth", "blockHash": "0xb100", "status": "0x1", "gasUsed": "0x5208", "effectiveGasPrice": "0x3b9aca00"},
+		"0xusdt": {"transactionHash": "0xusdt", "blockHash": "0xb100", "status": "0x0", "gasUsed": "0x7530"},
+		"0xfrom": {"transactionHash": "0xfrom", "blockHash": "0xb101", "status": "0x1", "gasUsed": "0x1", "effectiveGasPrice": "0x1"},
+	}
+	logs := []EthLog{
+		{Address: usdtAddr, Topics: []string{ChainTransferTopic, addrTopic(aliceAddr), addrTopic(bobAddr)},
+			Data: fmt.Sprintf("0x%064x", 7000000), BlockNumber: "0x65", BlockHash: "0xb101", TransactionHash: "0xfrom", LogIndex: "0x0"},
+	}
+	methods := map[string]func([]json.RawMessage) (any, *Error){
+		"eth_blockNumber": func([]json.RawMessage) (any, *Error) { return "0x70", nil },
+		"eth_getBlockByNumber": func(p []json.RawMessage) (any, *Error) {
+			return blocks[hexParam(p, 0)], nil
+		},
+		"eth_getTransactionReceipt": func(p []json.RawMessage) (any, *Error) {
+			return receipts[strParam(p, 0)], nil
+		},
+		"eth_getLogs": func(p []json.RawMessage) (any, *Error) {
+			var filter struct {
+				From string `json:"fromBlock"`
+				To   string `json:"toBlock"`
+			}
+			json.Unmarshal(p[0], &filter)
+			var from, to int64
+			fmt.Sscanf(filter.From, "0x%x", &from)
+			fmt.Sscanf(filter.To, "0x%x", &to)
+			out := make([]EthLog, 0)
+			for _, lg := range logs {
+				var n int64
+				fmt.Sscanf(lg.BlockNumber, "0x%x", &n)
+				if n >= from && n <= to {
+					out = append(out, lg)
+				}
+			}
+			return out, nil
+		},
+	}
+	if receiptsByBlock {
+		methods["eth_getBlockReceipts"] = func(p []json.RawMessage) (any, *Error) {
+			out := make([]map[string]string, 0)
+			for _, r := range receipts {
+				if r["blockHash"] == strParam(p, 0) {
+					out = append(out, r)
+				}
+			}
+			return out, nil
+		}
+	}
+	return &ethNode{reverse: true, methods: methods}
+}
+
+// describeFees 每笔交易一行：txid 成败 手续费
+func describeFees(blocks []*BlockLog) string {
+	lines := make([]string, 0)
+	for _, bl := range blocks {
+		for _, tran := range bl.Trans {
+			lines = append(lines, fmt.Sprintf("%s %s %s %s", tran.TxId, tran.Remark, tran.FeeAmountCoin, tran.FeeSymbol))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestGetBlockLogs(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		useLogs         bool
+		receiptsByBlock bool
+		trans           string
+		fees            string
+	}{
+		{"top-level transfers", false, true,
+			"0xeth 100 12: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 1 ETH #0\n" +
+				"0xusdt 100 12: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 2.5 USDT #0",
+			"0xeth SUCCESS 0.000021 ETH\n0xusdt REVERT 0.00000000000006 ETH"},
+		// 节点不支持 eth_getBlockReceipts 时逐笔查回执
+		{"receipts per tx", false, false,
+			"0xeth 100 12: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 1 ETH #0\n" +
+				"0xusdt 100 12: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 2.5 USDT #0",
+			"0xeth SUCCESS 0.000021 ETH\n0xusdt REVERT 0.00000000000006 ETH"},
+		// 日志模式下代币转账只从日志取，合约内的 transferFrom 也能抓到
+		{"transfer logs", true, true,
+			"0xeth 100 12: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 1 ETH #0\n" +
+				"0xfrom 101 11: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 7 USDT #0",
+			"0xeth SUCCESS 0.000021 ETH\n0xfrom SUCCESS 0.000000000000000001 ETH"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tool := blockNode(tc.receiptsByBlock).start(t)
+			tool.useLogs = tc.useLogs
+			tool.AddContract(Contract{Addr: usdtAddr, TokenName: "USDT", Decimals: 6})
+			blocks, err := tool.GetBlockLogs(t.Context(), []int64{100, 101})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != 2 || blocks[0].Hash != "0xb100" || blocks[1].ParentHash != "0xb100" {
+				t.Fatalf("blocks %+v", blocks)
+			}
+			all := append(slices.Clone(blocks[0].Trans), blocks[1].Trans...)
+			if got := describeTrans(all); got != tc.trans {
+				t.Fatalf("trans\n%s\nwant\n%s", got, tc.trans)
+			}
+			if got := describeFees(blocks); got != tc.fees {
+				t.Fatalf("fees\n%s\nwant\n%s", got, tc.fees)
+			}
+		})
+	}
+	// 某个高度不存在：返回它之前的区块和错误
+	tool := blockNode(true).start(t)
+	blocks, err := tool.GetBlockLogs(t.Context(), []int64{100, 102})
+	if err == nil || len(blocks) != 1 || blocks[0].Num != 100 {
+		t.Fatalf("missing block: %d blocks, %v", len(blocks), err)
+	}
+	// 本币转账与手续费同用链的本币符号
+	bsc := blockNode(true).start(t)
+	bsc.chain_type = CHAIN_BSC
+	blocks, err = bsc.GetBlockLogs(t.Context(), []int64{100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describeTrans(blocks[0].Trans[:1]); !strings.HasSuffix(got, " 1 BNB #0") || blocks[0].Trans[0].FeeSymbol != "BNB" {
+		t.Fatalf("bsc native transfer %s fee %s", got, blocks[0].Trans[0].FeeSymbol)
+	}
+}
+
+func TestGetBlockLogsRange(t *testing.T) {
+	node := blockNode(true)
+	var ranges []string
+	getLogs := node.methods["eth_getLogs"]
+	node.methods["eth_getLogs"] = func(p []json.RawMessage) (any, *Error) {
+		ranges = append(ranges, string(p[0]))
+		return getLogs(p)
+	}
+	tool := node.start(t)
+	tool.useLogs = true
+	tool.AddContract(Contract{Addr: usdtAddr, TokenName: "USDT", Decimals: 6})
+	// 分片只取 100，区间里 101 的日志不属于它
+	blocks, err := tool.GetBlockLogs(t.Context(), []int64{100})
+	if err != nil || len(blocks) != 1 || describeTrans(blocks[0].Trans) != "0xeth 100 12: 0x00000000000000000000000000000000000a11ce->0x0000000000000000000000000000000000000b0b 1 ETH #0" {
+		t.Fatalf("blocks %d %v: %s", len(blocks), err, describeTrans(blocks[0].Trans))
+	}
+	// 一批只发一次区间查询
+	ranges = nil
+	if _, err := tool.GetBlockLogs(t.Context(), []int64{100, 101}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 1 || !strings.Contains(ranges[0], `"fromBlock":"0x64"`) || !strings.Contains(ranges[0], `"toBlock":"0x65"`) {
+		t.Fatalf("log queries %v", ranges)
+	}
+	// 两次请求之间 101 被换掉：日志哈希对不上，只返回之前的区块
+	node.methods["eth_getLogs"] = func(p []json.RawMessage) (any, *Error) {
+		out, _ := getLogs(p)
+		logs := out.([]EthLog)
+		for i := range logs {
+			logs[i].BlockHash = "0xc101"
+		}
+		return logs, nil
+	}
+	blocks, err = tool.GetBlockLogs(t.Context(), []int64{100, 101})
+	if err == nil || len(blocks) != 1 || blocks[0].Num != 100 {
+		t.Fatalf("stale logs: %d blocks, %v", len(blocks), err)
+	}
+}
+
+func TestGetBlockLogsTipLag(t *testing.T) {
+	node := blockNode(true)
+	getBlock := node.methods["eth_getBlockByNumber"]
+	node.methods["eth_getBlockByNumber"] = func(p []json.RawMessage) (any, *Error) {
+		if hexParam(p, 0) == 101 {
+			return nil, &Error{Code: -32000, Message: "header not found"}
+		}
+		return getBlock(p)
+	}
+	tool := node.start(t)
+	// 落后的节点对链头的高度报错：之前的区块照常返回，节点不停用，101 由扫描重试
+	blocks, err := tool.GetBlockLogs(t.Context(), []int64{100, 101})
+	if err == nil || !strings.Contains(err.Error(), "header not found") || len(blocks) != 1 || blocks[0].Num != 100 {
+		t.Fatalf("%d blocks, %v", len(blocks), err)
+	}
+	if tool.pool.endpoints[0].down(time.Now()) {
+		t.Fatal("endpoint benched for one lagging item")
+	}
+}
@@ -1,6 +1,7 @@
 package bg
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"time"
@@ -16,14 +17,52 @@ type Contract struct {
 	Decimals  uint8
 }
 
+// ScanTool 各链实现，所有 RPC 调用随 ctx 取消或超时
 type ScanTool interface {
-	GetBlockNum() (int64, error)
-	GetLog(blockNum int64) ([]*ContractTokenTran, error)
+	GetBlockNum(ctx context.Context) (int64, error)
+	GetLog(ctx context.Context, blockNum int64) ([]*ContractTokenTran, error)
 	ChainType() ChainType
 	AddContract(...Contract)
 }
 
+// BlockLog 单个高度的扫描结果，带区块哈希用于分叉检测
+type BlockLog struct {
+	Num        int64
+	Hash       string
+	ParentHash string
+	Trans      []*ContractTokenTran
+}
+
+// ReorgTool 可能分叉的链（ETH/BSC）额外实现，Scan 据此记录区块哈希并回滚
+type ReorgTool interface {
+	GetBlockLog(ctx context.Context, blockNum int64) (*BlockLog, error)
+	GetBlockHash(ctx context.Context, blockNum int64) (string, error)
+}
+
+// BatchTool 支持一次拉取多个高度的链实现（ETH/BSC JSON-RPC batch）
+// 返回按 nums 顺序，某个高度失败时返回之前已成功的部分和错误
+type BatchTool interface {
+	GetBlockLogs(ctx context.Context, nums []int64) ([]*BlockLog, error)
+}
+
+// ConfirmTool 先扫未固化区块发 pending，固化后再按固化数据确认
+type ConfirmTool interface {
+	SolidHeight(ctx context.Context) (int64, error)
+	GetSolidLog(ctx context.Context, n int64) ([]*ContractTokenTran, error)
+}
+
+// TimeTool 可按高度查询出块时间，用于把起始时间换算成高度
+type TimeTool interface {
+	GetBlockTime(ctx context.Context, n int64) (time.Time, error)
+}
+
 func NewTool(chain ChainType, rpc []string, contracts ...Contract) ScanTool {
+	return NewToolWithCfg(ChainScanCfg{Chain: chain, Rpc: rpc, ContractList: contracts})
+}
+
+// NewToolWithCfg 按链配置创建，多个节点组成节点池，失败自动切换；未配置 Endpoints 时按 Rpc 兼容处理
+// 节点池在后台定期做健康检查，工具不再使用时调用其 Close 停止（Scan.Close 会一并关闭）
+func NewToolWithCfg(cfg ChainScanCfg) ScanTool {
 	dail := &net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 3 * time.Second,
@@ -34,23 +73,33 @@ func NewTool(chain ChainType, rpc []string, contracts ...Contract) ScanTool {
 		MaxIdleConns:        200,
 		TLSHandshakeTimeout: 2 * time.Second,
 	}
+	eps := cfg.Endpoints
+	if len(eps) == 0 {
+		eps = endpointsFromRpc(cfg.Chain, cfg.Rpc)
+	}
+	pool, err := newPool(cfg.Chain, eps, transport, cfg.Pool)
+	if err != nil {
+		return nil
+	}
 	cli := &http.Client{
-		Transport: transport,
+		Transport: pool,
 	}
 	tmp := resty.NewWithClient(cli)
-	tmp = tmp.SetBaseURL(rpc[0])
-	switch chain {
+	tmp = tmp.SetBaseURL(poolBaseURL)
+	switch cfg.Chain {
 	case CHAIN_TRON:
-		//波场处理
-		if len(rpc) > 2 {
-			tmp = tmp.SetHeader("TRON-PRO-API-KEY", rpc[1])
-		}
-		t := &tronTool{httpclient: tmp}
-		t.AddContract(contracts...)
+		t := &tronTool{httpclient: tmp, fast: cfg.TronFast, pool: pool}
+		pool.watch(func(_ context.Context, r *resty.Request) (int64, error) {
+			return tronHead(r, cfg.TronFast)
+		})
+		t.AddContract(cfg.ContractList...)
 		return t
 	case CHAIN_ETH, CHAIN_BSC:
-		t := &ethTool{chain_type: chain, httpclient: tmp}
-		t.AddContract(contracts...)
+		t := &ethTool{chain_type: cfg.Chain, httpclient: tmp, useLogs: cfg.UseLogs, pool: pool}
+		pool.watch(func(_ context.Context, r *resty.Request) (int64, error) {
+			return ethHead(r, t.requestId.Add(1))
+		})
+		t.AddContract(cfg.ContractList...)
 		return t
 	}
 	return nil
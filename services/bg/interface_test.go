@@ -0,0 +1,93 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// hangingNode 收到请求后不应答，直到请求被取消
+func hangingNode(t *testing.T) string {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.Close()
+	})
+	return srv.URL
+}
+
+// cancelAfter 50ms 后取消 ctx，返回 fn 的错误和耗时
+func cancelAfter(fn func(ctx context.Context) error) (error, time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := fn(ctx)
+	return err, time.Since(start)
+}
+
+func TestToolCallsCancel(t *testing.T) {
+	for _, chain := range []ChainType{CHAIN_ETH, CHAIN_TRON} {
+		tool := NewToolWithCfg(ChainScanCfg{Chain: chain, Endpoints: []Endpoint{{URL: hangingNode(t)}}, Pool: PoolCfg{HealthInterval: time.Hour}})
+		if tool == nil {
+			t.Fatalf("%s tool not created", chain.Name())
+		}
+		t.Cleanup(func() { tool.(interface{ Close() error }).Close() })
+		for name, call := range map[string]func(ctx context.Context) error{
+			"GetBlockNum": func(ctx context.Context) error { _, err := tool.GetBlockNum(ctx); return err },
+			"GetLog":      func(ctx context.Context) error { _, err := tool.GetLog(ctx, 100); return err },
+		} {
+			// 进行中的请求随 ctx 立即返回，不等节点或调用超时
+			err, elapsed := cancelAfter(call)
+			if !errors.Is(err, context.Canceled) || elapsed > time.Second {
+				t.Fatalf("%s %s: %v after %s", chain.Name(), name, err, elapsed)
+			}
+		}
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	// 分片卡在拉取中：取消后退出，不保存 checkpoint
+	d := newMemStore()
+	c := newFakeChain(CHAIN_ETH, 10)
+	c.gate = make(chan struct{})
+	s := NewScan(1, d, nil)
+	tl := newStoreTool(c, ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 10}, 1, d)
+	s.chain.Store(CHAIN_ETH, tl)
+	err, elapsed := cancelAfter(func(ctx context.Context) error {
+		s.processTool(ctx, tl)
+		s.wg.Wait()
+		return ctx.Err()
+	})
+	if err == nil || elapsed > time.Second {
+		t.Fatalf("shard returned after %s", elapsed)
+	}
+	if val, _, _ := d.Load(s.getSaveKey(tl, 0)); val != 9 {
+		t.Fatalf("checkpoint %d", val)
+	}
+
+	// 分片在重试退避中：取消后不等退避结束，也不记死信
+	c = newFakeChain(CHAIN_ETH, 10)
+	c.down.Store(true)
+	d = newMemStore()
+	s = NewScan(1, d, nil)
+	tl = newStoreTool(c, ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 10, Retry: RetryCfg{BaseDelay: time.Hour}}, 1, d)
+	s.chain.Store(CHAIN_ETH, tl)
+	_, elapsed = cancelAfter(func(ctx context.Context) error {
+		s.processTool(ctx, tl)
+		s.wg.Wait()
+		return nil
+	})
+	if elapsed > time.Second || len(c.fetched) != 1 || len(tl.dead) != 0 {
+		t.Fatalf("retry: %s, %d calls, dead %v", elapsed, len(c.fetched), tl.dead)
+	}
+}
@@ -0,0 +1,364 @@
+package bg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrFenced 写入时租约已被其他实例接手，fencing token 过期
+var ErrFenced = errors.New("lease lost: fencing token is stale")
+
+var errLeaseLost = errors.New("shard lease not held")
+
+const defaultLeaseTTL = 30 * time.Second
+
+// Fence 写入分片 checkpoint 时携带的租约；存储里该租约的 token 已变化则拒绝写入
+type Fence struct {
+	Lease string
+	Token int64
+}
+
+// LeaseStore 支持分片租约的存储，多个实例共用同一个存储时按租约分配分片
+type LeaseStore interface {
+	Store
+	// Acquire 租约空闲、已过期或已属于 owner 时获得并续期 ttl，被其他实例持有返回 ok=false
+	// 新获得（易主或过期后重新获得）时 token 加一，续期不变
+	Acquire(key, owner string, ttl time.Duration) (token int64, ok bool, err error)
+	// Release 属于 owner 时立即过期，token 保留
+	Release(key, owner string) error
+	// Seize 不论当前持有者都转给 owner 并续期 ttl，token 加一，原持有者之后的 SaveFenced 被拒
+	// 分片 0 的持有者回滚分叉时用它收回其他实例的分片，改写 checkpoint 期间别的实例既写不进也接不走
+	Seize(key, owner string, ttl time.Duration) (token int64, err error)
+	// SaveFenced 与 Save 相同，但 fence.Token 不是该租约当前的 token 时返回 ErrFenced
+	SaveFenced(fence Fence, key string, val int64) error
+	// RewindFenced 与 SaveFenced 一样校验 token，一次写入多个键并直接覆盖（值可以变小）
+	RewindFenced(fence Fence, kv map[string]int64) error
+	// CompareAndDelete 值仍是 val 时才删除，返回是否删除；清除共用的登记时不会删掉其他实例刚写入的新值
+	CompareAndDelete(key string, val int64) (bool, error)
+}
+
+// LeaseCfg 多实例分工参数
+type LeaseCfg struct {
+	Owner string        // 实例标识，空=主机名-进程号
+	TTL   time.Duration // 租约时长，0=30s 与 3 倍扫描间隔取大；需大于扫描间隔，实例间时钟偏差需远小于 TTL
+}
+
+// shardLease 本实例持有的分片租约
+type shardLease struct {
+	token int64
+	until time.Time // 本地时钟的到期时间，按发起续期前的时间算，偏保守
+}
+
+func defaultLeaseOwner() string {
+	host, _ := os.Hostname()
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+func (s *Scan) getLeaseKey(t *storeTool, idx int) string {
+	return fmt.Sprintf("%s:scan:shard:%d:lease", t.ChainType().Name(), idx)
+}
+
+func (s *Scan) getMemberPrefix(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:member:", t.ChainType().Name())
+}
+
+// EnableLeases 多个实例共用存储时按分片租约分工：各实例均分分片，实例退出或失联后其分片由其他实例接手
+// 快速模式的确认由持有分片 0 的实例执行，待确认的交易存在共用的存储里；需在 Process 之前调用，存储需实现 LeaseStore，快速模式还需实现 BlobStore
+// 各实例的分片数需与存储里的布局一致，不一致返回错误；改分片数先停掉其他实例，单实例不启用租约跑一轮完成迁移
+// 租约在每轮 Process 时续期，Process 的调用间隔需小于 TTL；ForceStart 与回滚一样由分片 0 的持有者收回全部分片后回退
+// 分叉检测的区块记录存在共用的存储里，存储需实现 BlobStore；回滚由分片 0 的持有者收回全部分片后执行，其他实例发现分叉时登记给它
+func (s *Scan) EnableLeases(cfg LeaseCfg) error {
+	if cfg.Owner == "" {
+		cfg.Owner = defaultLeaseOwner()
+	}
+	tools := make([]*storeTool, 0)
+	var err error
+	s.chain.Range(func(_, v any) bool {
+		t, ok := v.(*storeTool)
+		if !ok {
+			return true
+		}
+		if _, ok := t.disk.(LeaseStore); !ok {
+			err = fmt.Errorf("store %T does not support leases", t.disk)
+			return false
+		}
+		if _, ok := t.disk.(BlobStore); !ok && t.pending != nil {
+			err = fmt.Errorf("store %T cannot share pending transactions", t.disk)
+			return false
+		}
+		if _, ok := t.disk.(BlobStore); !ok && t.ring != nil {
+			err = fmt.Errorf("store %T cannot share reorg records, set ReorgDepth < 0", t.disk)
+			return false
+		}
+		// 改分片数的迁移只能单实例做，分片数与存储里的布局不同的实例不能加入
+		var prev int64
+		if prev, err = s.getKey(t, s.getShardsKey(t)); err != nil {
+			return false
+		}
+		if prev > 0 && prev != t.GoNum {
+			err = fmt.Errorf("chain %s: GoNum %d differs from stored layout %d, reshard with a single instance first", t.ChainType().Name(), t.GoNum, prev)
+			return false
+		}
+		tools = append(tools, t)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range tools {
+		t.mu.Lock()
+		t.leases = make([]shardLease, t.GoNum)
+		t.mu.Unlock()
+	}
+	s.lease = &cfg
+	return nil
+}
+
+func (s *Scan) leaseTTL(t *storeTool) time.Duration {
+	if s.lease.TTL > 0 {
+		return s.lease.TTL
+	}
+	return max(defaultLeaseTTL, 3*t.pollInterval())
+}
+
+// holds 本实例是否持有分片 idx，未启用租约时总是 true；调用方持有 t.mu
+func (s *Scan) holds(t *storeTool, idx int) bool {
+	return t.leases == nil || t.leases[idx].until.After(time.Now())
+}
+
+// fence 写分片 checkpoint 用的租约，未启用租约返回 nil；调用方持有 t.mu
+func (s *Scan) fence(t *storeTool, idx int) (*Fence, error) {
+	if t.leases == nil {
+		return nil, nil
+	}
+	l := t.leases[idx]
+	if !l.until.After(time.Now()) {
+		return nil, errLeaseLost
+	}
+	return &Fence{Lease: s.getLeaseKey(t, idx), Token: l.token}, nil
+}
+
+// lostLease 写入被 fencing 拒绝后放弃该分片，调用方持有 t.mu
+func (s *Scan) lostLease(t *storeTool, idx int, err error) {
+	if t.leases == nil || !errors.Is(err, ErrFenced) {
+		return
+	}
+	t.leases[idx] = shardLease{}
+	if s.zap_l != nil {
+		s.zap_l.Warn("scan.lease",
+			zap.String("event", "fenced"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int("shard", idx),
+		)
+	}
+}
+
+// leaseShare 登记本实例，按存活实例数算出每个实例应持有的分片数
+// 登记与统计要遍历存储，约每 TTL/3 做一次，其余轮次沿用上次的份额；统计失败时沿用上次的份额，从未统计成功过则只保留已持有的分片，不去抢空闲的
+func (s *Scan) leaseShare(t *storeTool, ttl time.Duration) int {
+	now := time.Now()
+	t.mu.Lock()
+	if t.share > 0 && now.Sub(t.memberAt) < ttl/3 {
+		defer t.mu.Unlock()
+		return t.share
+	}
+	t.mu.Unlock()
+	share, err := s.countShare(t, now, ttl)
+	if err != nil {
+		// 下一轮重试
+		s.leaseFailed(t, "member_failed", -1, err)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.share > 0 {
+			return t.share
+		}
+		held := 0
+		for i := range t.leases {
+			if s.holds(t, i) {
+				held++
+			}
+		}
+		return held
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.memberAt, t.share = now, share
+	return share
+}
+
+// countShare 写入本实例的登记并清理过期的登记
+func (s *Scan) countShare(t *storeTool, now time.Time, ttl time.Duration) (int, error) {
+	prefix := s.getMemberPrefix(t)
+	err := s.rewindBatch(t, map[string]int64{prefix + s.lease.Owner: now.Add(ttl).UnixMilli()})
+	var members map[string]int64
+	if err == nil {
+		members, err = t.disk.List(prefix)
+	}
+	if err != nil {
+		return 0, err
+	}
+	live := 0
+	stale := make([]string, 0)
+	for key, until := range members {
+		if until > now.UnixMilli() {
+			live++
+			continue
+		}
+		stale = append(stale, key)
+	}
+	if len(stale) > 0 {
+		if err := t.disk.Delete(stale...); err != nil {
+			s.leaseFailed(t, "member_failed", -1, err)
+		}
+	}
+	live = max(live, 1)
+	return (int(t.GoNum) + live - 1) / live, nil
+}
+
+// renewLeases 每轮扫描前续期已持有的分片；多于份额时释放编号大的分片给新实例，少于份额时接手空闲或过期的分片
+// 他人持有的分片从存储刷新 checkpoint 和死信副本，连续水位仍按全部分片计算，只由分片 0 的持有者持久化
+func (s *Scan) renewLeases(t *storeTool) {
+	ls := t.disk.(LeaseStore)
+	ttl := s.leaseTTL(t)
+	share := s.leaseShare(t, ttl)
+	now := time.Now()
+	t.mu.Lock()
+	held := make([]bool, t.GoNum)
+	n := 0
+	for i, l := range t.leases {
+		if l.until.After(now) {
+			held[i] = true
+			n++
+		}
+	}
+	// 回滚收回的分片在 checkpoint 全部回退之前不释放
+	unwinding := t.unwinding != nil
+	t.mu.Unlock()
+	// 新接手的分片以存储里的 checkpoint 和死信为准
+	acquired := make([]bool, len(held))
+
+	for i := len(held) - 1; i >= 0 && n > share && !unwinding; i-- {
+		if !held[i] {
+			continue
+		}
+		s.setLease(t, i, shardLease{})
+		if err := ls.Release(s.getLeaseKey(t, i), s.lease.Owner); err != nil {
+			s.leaseFailed(t, "release_failed", i, err)
+		}
+		held[i] = false
+		n--
+		s.leaseChanged(t, "released", i, 0)
+	}
+	for i := range held {
+		if !held[i] && n >= share {
+			continue
+		}
+		until := time.Now().Add(ttl)
+		token, ok, err := ls.Acquire(s.getLeaseKey(t, i), s.lease.Owner, ttl)
+		if err != nil {
+			// 续期失败的租约到期后自然失效
+			s.leaseFailed(t, "acquire_failed", i, err)
+			continue
+		}
+		if !ok {
+			if held[i] {
+				s.setLease(t, i, shardLease{})
+				n--
+				s.leaseChanged(t, "lost", i, 0)
+			}
+			continue
+		}
+		s.setLease(t, i, shardLease{token: token, until: until})
+		if !held[i] {
+			n++
+			acquired[i] = true
+			s.leaseChanged(t, "acquired", i, token)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.leases {
+		if s.holds(t, i) && !acquired[i] {
+			continue
+		}
+		last, err := s.get(t, i)
+		if err == nil {
+			err = s.refreshDead(t, i)
+		}
+		if err != nil {
+			s.leaseFailed(t, "refresh_failed", i, err)
+			continue
+		}
+		t.marks[i] = last
+	}
+	s.updateWatermark(t)
+}
+
+func (s *Scan) setLease(t *storeTool, idx int, l shardLease) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.leases[idx] = l
+}
+
+// releaseLeases 退出时释放持有的租约并注销，其他实例不必等到过期
+func (s *Scan) releaseLeases() {
+	if s.lease == nil {
+		return
+	}
+	s.chain.Range(func(_, v any) bool {
+		t, ok := v.(*storeTool)
+		if !ok || t.leases == nil {
+			return true
+		}
+		ls := t.disk.(LeaseStore)
+		for i := range t.leases {
+			t.mu.Lock()
+			held := s.holds(t, i)
+			t.leases[i] = shardLease{}
+			t.mu.Unlock()
+			if !held {
+				continue
+			}
+			if err := ls.Release(s.getLeaseKey(t, i), s.lease.Owner); err != nil {
+				s.leaseFailed(t, "release_failed", i, err)
+			}
+		}
+		t.mu.Lock()
+		t.share = 0
+		t.mu.Unlock()
+		if err := t.disk.Delete(s.getMemberPrefix(t) + s.lease.Owner); err != nil {
+			s.leaseFailed(t, "member_failed", -1, err)
+		}
+		return true
+	})
+}
+
+func (s *Scan) leaseChanged(t *storeTool, event string, idx int, token int64) {
+	if s.zap_l != nil {
+		s.zap_l.Info("scan.lease",
+			zap.String("event", event),
+			zap.String("chain", t.ChainType().Name()),
+			zap.String("owner", s.lease.Owner),
+			zap.Int("shard", idx),
+			zap.Int64("token", token),
+		)
+	}
+}
+
+func (s *Scan) leaseFailed(t *storeTool, event string, idx int, err error) {
+	if s.zap_l != nil {
+		s.zap_l.Error("scan.lease",
+			zap.String("event", event),
+			zap.String("chain", t.ChainType().Name()),
+			zap.String("owner", s.lease.Owner),
+			zap.Int("shard", idx),
+			zap.String("err", err.Error()),
+		)
+	}
+}
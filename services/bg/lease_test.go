@@ -0,0 +1,96 @@
+package bg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// listFailStore fail 为 true 时 List 失败
+type listFailStore struct {
+	*memStore
+	fail bool
+}
+
+func (l *listFailStore) List(prefix string) (map[string]int64, error) {
+	if l.fail {
+		return nil, errors.New("store unavailable")
+	}
+	return l.memStore.List(prefix)
+}
+
+func heldCount(s *Scan, t *storeTool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for i := range t.leases {
+		if s.holds(t, i) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLeaseShareOnCountFailure(t *testing.T) {
+	d := &listFailStore{memStore: newMemStore(), fail: true}
+	s := NewScan(4, nil, nil)
+	s.lease = &LeaseCfg{Owner: "a", TTL: time.Minute}
+	tl := newTestTool(d, toolOpts{marks: make([]int64, 4), leases: true})
+	// 从未统计成功：不去抢空闲的分片
+	s.renewLeases(tl)
+	if n := heldCount(s, tl); n != 0 {
+		t.Fatalf("took %d shards without a member count", n)
+	}
+	// 另一个实例在线，统计成功后各持一半
+	if err := d.Save(s.getMemberPrefix(tl)+"b", time.Now().Add(time.Hour).UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	d.fail = false
+	s.renewLeases(tl)
+	if n := heldCount(s, tl); n != 2 {
+		t.Fatalf("held %d with two members", n)
+	}
+	// 统计再失败时沿用上次的份额
+	d.fail = true
+	tl.memberAt = time.Time{}
+	s.renewLeases(tl)
+	if n := heldCount(s, tl); n != 2 || tl.share != 2 {
+		t.Fatalf("held %d share %d after a failed count", n, tl.share)
+	}
+}
+
+func TestEnableLeasesChecksLayout(t *testing.T) {
+	d := newMemStore()
+	s := NewScan(2, nil, nil)
+	tl := newTestTool(d, toolOpts{marks: []int64{100, 101}})
+	s.chain.Store(CHAIN_ETH, tl)
+	if err := d.SaveBatch(map[string]int64{s.getShardsKey(tl): 3, s.getSaveKey(tl, 0): 100, s.getSaveKey(tl, 1): 101, s.getSaveKey(tl, 2): 99}); err != nil {
+		t.Fatal(err)
+	}
+	// 其他实例按 3 个分片在跑，分片数不同的实例不能加入
+	if err := s.EnableLeases(LeaseCfg{Owner: "a"}); err == nil {
+		t.Fatal("joined with a different shard count")
+	}
+	if tl.leases != nil {
+		t.Fatal("leases enabled after a rejected join")
+	}
+	// 启用之后别的实例改了分片数：不迁移，存储里的布局原样保留
+	if err := d.Save(s.getShardsKey(tl), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableLeases(LeaseCfg{Owner: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Save(s.getShardsKey(tl), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.load(tl); !errors.Is(err, errReshardLeased) {
+		t.Fatalf("load: %v", err)
+	}
+	if last, _ := s.get(tl, 2); last != 99 {
+		t.Fatalf("shard 2 checkpoint %d", last)
+	}
+	if shards, _ := s.getKey(tl, s.getShardsKey(tl)); shards != 3 {
+		t.Fatalf("stored shards %d", shards)
+	}
+}
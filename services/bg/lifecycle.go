@@ -0,0 +1,179 @@
+package bg
+
+import (
+	"context"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// watchBlock 生命周期模式下已发 seen、尚未达到 ConfirmNum 的区块
+type watchBlock struct {
+	trans []*ContractTokenTran
+	next  int  // 下一个待发的里程碑下标
+	rev   int  // trans 每更新一次加一，主扫描据此判断撤回所依据的快照是否过期
+	busy  bool // watchTip 正在锁外投递该高度
+}
+
+// milestones 有效里程碑：升序去重，只保留 (0, ConfirmNum) 之间的确认数
+func (t *storeTool) milestones() []int64 {
+	out := make([]int64, 0, len(t.cfg.Milestones))
+	for _, m := range t.cfg.Milestones {
+		if m > 0 && m < t.cfg.ConfirmNum {
+			out = append(out, int64(m))
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// watchTip 扫描尚未达到确认数的新区块发 seen，已发过的区块确认数到达里程碑时重新拉取并发 confirming
+// 重新拉取时消失的交易发 retracted，新出现的发 seen
+// 启用租约时只跟踪本实例持有的分片，与确认时的 retractUnseen 在同一个实例；分片易主前发过 seen 又消失的交易不再撤回
+func (s *Scan) watchTip(ctx context.Context, t *storeTool, head int64) {
+	select {
+	case t.watching <- struct{}{}:
+	default:
+		return
+	}
+	defer func() {
+		<-t.watching
+	}()
+	ms := t.milestones()
+	t.mu.Lock()
+	nums := make([]int64, 0)
+	for h, w := range t.watch {
+		if !s.holds(t, int(h%t.GoNum)) {
+			// 分片已由其他实例接手
+			delete(t.watch, h)
+			continue
+		}
+		if w.next < len(ms) && head-h >= ms[w.next] {
+			nums = append(nums, h)
+		}
+	}
+	// 未发过 seen、主扫描也还没确认的新区块
+	for h := max(head-int64(t.cfg.ConfirmNum)+1, contiguous(t.marks, t.GoNum)+1); h <= head; h++ {
+		idx := h % t.GoNum
+		if _, ok := t.watch[h]; !ok && t.marks[idx] < h && s.holds(t, int(idx)) {
+			nums = append(nums, h)
+		}
+	}
+	t.mu.Unlock()
+	slices.Sort(nums)
+	blocks, err := s.getBlocks(ctx, t, nums)
+	for _, block := range blocks {
+		if !s.watchBlock(ctx, t, head, ms, block) {
+			return
+		}
+	}
+	if err != nil && s.zap_l != nil {
+		s.zap_l.Error("scan.lifecycle",
+			zap.String("event", "get_tip_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+// watchBlock 投递不持有 t.mu；投递期间标记 busy，主扫描此时确认该高度会放弃提交下次重扫，以免漏撤回这里新发的 seen
+func (s *Scan) watchBlock(ctx context.Context, t *storeTool, head int64, ms []int64, block *BlockLog) bool {
+	h := block.Num
+	t.mu.Lock()
+	if t.marks[h%t.GoNum] >= h {
+		// 主扫描已发 confirmed
+		delete(t.watch, h)
+		t.mu.Unlock()
+		return true
+	}
+	w, ok := t.watch[h]
+	if !ok {
+		w = &watchBlock{}
+		t.watch[h] = w
+	}
+	w.busy = true
+	prev, safe := w.trans, t.safe
+	t.mu.Unlock()
+
+	confs := head - h
+	old := make(map[string]bool, len(prev))
+	for _, tran := range prev {
+		old[tran.TxId] = true
+	}
+	cur := make(map[string]bool, len(block.Trans))
+	out := make([]*ContractTokenTran, 0, len(block.Trans))
+	for _, tran := range block.Trans {
+		cur[tran.TxId] = true
+		tran.Event = EventSeen
+		if old[tran.TxId] {
+			tran.Event = EventConfirming
+		}
+		tran.Confirmations = confs
+		tran.SafeHeight = safe
+		out = append(out, tran)
+	}
+	for _, tran := range prev {
+		if cur[tran.TxId] {
+			continue
+		}
+		r := tran.Retract()
+		r.Confirmations = confs
+		r.SafeHeight = safe
+		out = append(out, r)
+	}
+	delivered := s.deliver(ctx, out)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w.busy = false
+	if !delivered {
+		if !ok {
+			// 下一轮仍按新区块处理
+			delete(t.watch, h)
+		}
+		return false
+	}
+	if t.marks[h%t.GoNum] >= h {
+		// 投递期间被强制改了起始高度
+		delete(t.watch, h)
+		return true
+	}
+	// 首次看到时已越过的里程碑不再补发
+	for w.next < len(ms) && confs >= ms[w.next] {
+		w.next++
+	}
+	w.trans = block.Trans
+	w.rev++
+	return true
+}
+
+// unseen 主扫描确认高度 h 前取出之前发过 seen 但确认区块里已没有的交易的撤回事件，连同所依据的快照；调用方持有 t.mu
+func (s *Scan) unseen(t *storeTool, block *BlockLog) ([]*ContractTokenTran, *watchBlock, int) {
+	w, ok := t.watch[block.Num]
+	if !ok {
+		return nil, nil, 0
+	}
+	cur := make(map[string]bool, len(block.Trans))
+	for _, tran := range block.Trans {
+		cur[tran.TxId] = true
+	}
+	out := make([]*ContractTokenTran, 0)
+	for _, tran := range w.trans {
+		if cur[tran.TxId] {
+			continue
+		}
+		r := tran.Retract()
+		r.SafeHeight = t.safe
+		out = append(out, r)
+	}
+	return out, w, w.rev
+}
+
+// watchSettled 取快照之后 watchTip 没有再发过该高度，撤回没有遗漏；调用方持有 t.mu
+func (s *Scan) watchSettled(t *storeTool, h int64, w *watchBlock, rev int) bool {
+	cur, ok := t.watch[h]
+	if !ok {
+		return w == nil
+	}
+	return cur == w && cur.rev == rev && !cur.busy
+}
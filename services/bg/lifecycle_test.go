@@ -0,0 +1,87 @@
+package bg
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWatchBlockDeliversUnlocked(t *testing.T) {
+	ctx := context.Background()
+	s, tl, sink := newLockedScan(toolOpts{cfg: ChainScanCfg{Lifecycle: true, ConfirmNum: 10}})
+	ms := []int64{3}
+	block := func(ids ...string) *BlockLog {
+		b := &BlockLog{Num: 5}
+		for _, id := range ids {
+			b.Trans = append(b.Trans, &ContractTokenTran{Type: CHAIN_ETH, TxId: id, BlockNum: 5})
+		}
+		return b
+	}
+	watch := func(head int64, b *BlockLog) {
+		t.Helper()
+		var ok bool
+		within(t, 5*time.Second, func() error {
+			ok = s.watchBlock(ctx, tl, head, ms, b)
+			return nil
+		})
+		if !ok {
+			t.Fatalf("head %d not delivered", head)
+		}
+	}
+	watch(6, block("0xa", "0xb"))
+	// 到达里程碑重新拉取：0xb 已消失
+	watch(8, block("0xa"))
+	if w := tl.watch[5]; w.busy || w.rev != 2 || w.next != 1 || len(w.trans) != 1 {
+		t.Fatalf("watch %+v", w)
+	}
+	// 达到确认数由主扫描发 confirmed，之后不再跟踪
+	within(t, 5*time.Second, func() error {
+		if !s.commit(ctx, tl, 0, 0, block("0xa")) {
+			t.Error("commit failed")
+		}
+		return nil
+	})
+	watch(15, block("0xa"))
+	want := "[0xa:seen 0xb:seen 0xa:confirming 0xb:retracted 0xa:confirmed]"
+	if got := fmt.Sprint(sink.events()); got != want {
+		t.Fatalf("delivered %s, want %s", got, want)
+	}
+	if _, ok := tl.watch[5]; ok {
+		t.Fatal("confirmed block still watched")
+	}
+}
+
+func TestCommitRetractsUnseen(t *testing.T) {
+	ctx := context.Background()
+	s, tl, sink := newLockedScan(toolOpts{cfg: ChainScanCfg{Lifecycle: true, ConfirmNum: 10}})
+	seen := []*ContractTokenTran{
+		{Type: CHAIN_ETH, TxId: "0xa", BlockNum: 1, Event: EventSeen},
+		{Type: CHAIN_ETH, TxId: "0xb", BlockNum: 1, Event: EventSeen},
+	}
+	tl.watch[1] = &watchBlock{trans: seen, rev: 1}
+	block := func() *BlockLog {
+		return &BlockLog{Num: 1, Trans: []*ContractTokenTran{{Type: CHAIN_ETH, TxId: "0xa", BlockNum: 1}}}
+	}
+	// 确认投递期间 watchTip 又发了该高度：撤回依据的快照已过期，不提交
+	sink.during = func(t *storeTool) { t.watch[1].rev++ }
+	var ok bool
+	within(t, 5*time.Second, func() error {
+		ok = s.commit(ctx, tl, 0, 0, block())
+		return nil
+	})
+	if ok || tl.marks[0] != 0 {
+		t.Fatalf("committed over a stale watch: mark=%d", tl.marks[0])
+	}
+	sink.during = nil
+	if !s.commit(ctx, tl, 0, 0, block()) {
+		t.Fatal("commit failed")
+	}
+	// 被放弃的那次确认已经发出，重试时仍带撤回
+	if got := fmt.Sprint(sink.events()); got != "[0xa:confirmed 0xb:retracted 0xa:confirmed 0xb:retracted]" {
+		t.Fatalf("delivered %s", got)
+	}
+	if _, ok := tl.watch[1]; ok || tl.marks[0] != 1 {
+		t.Fatalf("watch %v mark %d", tl.watch, tl.marks[0])
+	}
+}
@@ -0,0 +1,70 @@
+package bg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NatsSinkCfg NATS JetStream 投递配置
+type NatsSinkCfg struct {
+	Prefix string // subject 前缀，空=yscan；subject 为 前缀.链.合约
+	Stream string // 非空时创建/更新该 stream 覆盖 前缀.>，空=由部署方预先建好
+}
+
+// NatsSink 每笔交易发布到按链和合约划分的 subject，等待全部 PubAck 才返回 nil
+// 消息带 Nats-Msg-Id，stream 的去重窗口内重扫的重复消息会被丢弃
+type NatsSink struct {
+	js  jetstream.JetStream
+	cfg NatsSinkCfg
+}
+
+func NewNatsSink(ctx context.Context, js jetstream.JetStream, cfg NatsSinkCfg) (*NatsSink, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultStreamPrefix
+	}
+	if cfg.Stream != "" {
+		_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     cfg.Stream,
+			Subjects: []string{cfg.Prefix + ".>"},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &NatsSink{js: js, cfg: cfg}, nil
+}
+
+func (n *NatsSink) subject(tran *ContractTokenTran) string {
+	return fmt.Sprintf("%s.%s.%s", n.cfg.Prefix, tran.Type.Name(), tranContract(tran))
+}
+
+func (n *NatsSink) Publish(ctx context.Context, batch []*ContractTokenTran) error {
+	bodies, err := marshalBatch(batch)
+	if err != nil {
+		return err
+	}
+	futures := make([]jetstream.PubAckFuture, 0, len(batch))
+	for i, tran := range batch {
+		msg := nats.NewMsg(n.subject(tran))
+		msg.Data = bodies[i]
+		msg.Header.Set("Yscan-Event", string(tran.Event))
+		f, err := n.js.PublishMsgAsync(msg, jetstream.WithMsgID(tranMsgID(tran)))
+		if err != nil {
+			return err
+		}
+		futures = append(futures, f)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
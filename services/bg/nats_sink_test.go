@@ -0,0 +1,132 @@
+package bg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newTestJetStream 进程内启动开启 JetStream 的 nats-server
+func newTestJetStream(t *testing.T) jetstream.JetStream {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats-server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func TestNatsSinkSubjects(t *testing.T) {
+	js := newTestJetStream(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sink, err := NewNatsSink(ctx, js, NatsSinkCfg{Stream: "YSCAN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := sinkBatch()
+	if err := sink.Publish(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := js.Stream(ctx, "YSCAN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subjects := stream.CachedInfo().Config.Subjects; len(subjects) != 1 || subjects[0] != "yscan.>" {
+		t.Fatalf("stream subjects %v", subjects)
+	}
+	// 按 前缀.链.合约 分 subject，与 Redis stream 同样的合约名
+	subjects := []string{
+		"yscan.ETH.0xdac17f958d2ee523a2206206994597c13d831ec7",
+		"yscan.ETH.ETH",
+		"yscan.Tron.TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t",
+	}
+	for i, want := range batch {
+		msg, err := stream.GetMsg(ctx, uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Subject != subjects[i] {
+			t.Fatalf("message %d subject %s, want %s", i, msg.Subject, subjects[i])
+		}
+		if msg.Header.Get(jetstream.MsgIDHeader) != tranMsgID(want) || msg.Header.Get("Yscan-Event") != string(want.Event) {
+			t.Fatalf("message %d headers %v", i, msg.Header)
+		}
+	}
+}
+
+func TestNatsSinkDedup(t *testing.T) {
+	js := newTestJetStream(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sink, err := NewNatsSink(ctx, js, NatsSinkCfg{Prefix: "scan", Stream: "SCAN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重扫重复投递同一批，Nats-Msg-Id 相同的被去重窗口丢弃
+	for i := 0; i < 2; i++ {
+		if err := sink.Publish(ctx, sinkBatch()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 同一笔交易的新事件是另一条消息
+	retract := sinkBatch()[0].Retract()
+	if err := sink.Publish(ctx, []*ContractTokenTran{retract}); err != nil {
+		t.Fatal(err)
+	}
+	// Tron 没有区块哈希：撤回后重新打包进另一个高度的 pending 不是重复消息
+	repack := sinkBatch()[2]
+	repack.BlockNum++
+	if err := sink.Publish(ctx, []*ContractTokenTran{repack}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := js.Stream(ctx, "SCAN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != uint64(len(sinkBatch())+2) {
+		t.Fatalf("stream has %d messages", info.State.Msgs)
+	}
+}
+
+func TestNatsSinkPublishError(t *testing.T) {
+	js := newTestJetStream(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 没有 stream 覆盖该前缀，拿不到 PubAck
+	sink, err := NewNatsSink(ctx, js, NatsSinkCfg{Prefix: "nostream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Publish(ctx, sinkBatch()); err == nil {
+		t.Fatal("expected error without a stream")
+	}
+}
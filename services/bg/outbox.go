@@ -0,0 +1,90 @@
+package bg
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRelayBatch    = 100
+	defaultRelayInterval = time.Second
+)
+
+// RelayCfg outbox 投递参数
+type RelayCfg struct {
+	BatchSize    int           // 一次投递的条数，0=100
+	PollInterval time.Duration // 没有新记录时的轮询间隔，0=1s
+	Retry        RetryCfg      // 投递失败的退避，一直重试
+}
+
+// OutboxRelay 把 SQLDisk outbox 里的记录按写入顺序投递到 Sink，投递成功才删除
+// 崩溃后会重发最后一批，下游按 TxId+Event 去重即可做到恰好一次；同一个库只运行一个
+type OutboxRelay struct {
+	disk  *SQLDisk
+	sink  Sink
+	cfg   RelayCfg
+	zap_l *zap.Logger
+}
+
+func NewOutboxRelay(disk *SQLDisk, sink Sink, cfg RelayCfg, log *zap.Logger) *OutboxRelay {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultRelayBatch
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultRelayInterval
+	}
+	return &OutboxRelay{disk: disk, sink: sink, cfg: cfg, zap_l: log}
+}
+
+// Run 阻塞投递直到 ctx 取消
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	failures := 0
+	for {
+		n, err := r.relayOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			failures++
+			if r.zap_l != nil {
+				r.zap_l.Error("outbox.relay",
+					zap.String("event", "relay_failed"),
+					zap.Int("attempt", failures),
+					zap.String("err", err.Error()),
+				)
+			}
+			if err := sleepCtx(ctx, r.cfg.Retry.backoff(failures)); err != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		if n == r.cfg.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.disk.notify:
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+// relayOnce 投递一批，返回条数
+func (r *OutboxRelay) relayOnce(ctx context.Context) (int, error) {
+	rows, err := r.disk.pending(ctx, r.cfg.BatchSize)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	batch := make([]*ContractTokenTran, 0, len(rows))
+	for _, row := range rows {
+		batch = append(batch, row.tran)
+	}
+	if err := r.sink.Publish(ctx, batch); err != nil {
+		return 0, err
+	}
+	return len(rows), r.disk.ack(ctx, rows)
+}
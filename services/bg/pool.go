@@ -0,0 +1,421 @@
+package bg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"golang.org/x/time/rate"
+)
+
+// Policy 多节点选择策略
+type Policy int
+
+const (
+	RoundRobin    Policy = iota // 轮询
+	LowestLatency               // 延迟最低优先
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultMaxLag         = 5
+	// 调用失败后该节点暂停使用的时间
+	failCooldown = 10 * time.Second
+	// 工具请求的占位地址，实际地址由 rpcPool 改写
+	poolBaseURL = "http://rpc-pool"
+)
+
+type endpoint struct {
+	url      *url.URL
+	base     http.RoundTripper
+	headers  map[string]string
+	user     string
+	password string
+	bearer   string
+	keys     *keyRing      // nil 表示不带 key
+	limiter  *rate.Limiter // nil 表示不限速
+	client   *resty.Client // 只连这个节点，用于健康检查
+
+	head      atomic.Int64
+	latency   atomic.Int64 // 指数平均，纳秒
+	downUntil atomic.Int64 // UnixNano，之前不参与选择
+	pauseTill atomic.Int64 // UnixNano，节点 429 要求的等待时间，之前不发请求
+}
+
+func newEndpoint(chain ChainType, ep Endpoint, base http.RoundTripper) (*endpoint, error) {
+	u, err := url.Parse(ep.URL)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyRing(chain, ep)
+	if err != nil {
+		return nil, err
+	}
+	e := &endpoint{
+		url:      u,
+		base:     base,
+		headers:  ep.Headers,
+		user:     ep.User,
+		password: ep.Password,
+		bearer:   ep.Bearer,
+		keys:     keys,
+		limiter:  newLimiter(ep.RateLimit, ep.burst()),
+	}
+	e.client = resty.NewWithClient(&http.Client{Transport: e}).SetBaseURL(poolBaseURL)
+	return e, nil
+}
+
+func (e *endpoint) down(now time.Time) bool {
+	return e.downUntil.Load() > now.UnixNano()
+}
+
+func (e *endpoint) ok(cost time.Duration) {
+	e.downUntil.Store(0)
+	old := e.latency.Load()
+	if old == 0 {
+		e.latency.Store(int64(cost))
+		return
+	}
+	e.latency.Store((old*7 + int64(cost)) / 8)
+}
+
+func (e *endpoint) fail() {
+	e.failFor(failCooldown)
+}
+
+func (e *endpoint) failFor(d time.Duration) {
+	until := time.Now().Add(d).UnixNano()
+	if until > e.downUntil.Load() {
+		e.downUntil.Store(until)
+	}
+}
+
+// target 把占位地址的请求改写到该节点，节点地址自带的路径作为前缀，并带上头和认证
+func (e *endpoint) target(req *http.Request) (*http.Request, error) {
+	out := req.Clone(req.Context())
+	u := *e.url
+	u.Path = strings.TrimSuffix(e.url.Path, "/") + req.URL.Path
+	u.RawPath = ""
+	if req.URL.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += req.URL.RawQuery
+	}
+	out.URL = &u
+	out.Host = ""
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	for k, v := range e.headers {
+		out.Header.Set(k, v)
+	}
+	if e.user != "" || e.password != "" {
+		out.SetBasicAuth(e.user, e.password)
+	}
+	if e.bearer != "" {
+		out.Header.Set("Authorization", "Bearer "+e.bearer)
+	}
+	return out, nil
+}
+
+// RoundTrip 按限速发到该节点；429 时按 Retry-After 暂停，配置了多个 key 时暂停当前 key 并换下一个 key 重发
+func (e *endpoint) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for tries := 1; ; tries++ {
+		if err := sleepCtx(ctx, time.Until(time.Unix(0, e.pauseTill.Load()))); err != nil {
+			return nil, err
+		}
+		var key *apiKey
+		if e.keys != nil {
+			k, next := e.keys.acquire(time.Now())
+			if k == nil && next.IsZero() {
+				return nil, errKeysExhausted
+			}
+			if k == nil {
+				// key 都在限流中，等最早的一个恢复
+				if err := sleepCtx(ctx, time.Until(next)); err != nil {
+					return nil, err
+				}
+				tries--
+				continue
+			}
+			key = k
+		}
+		if e.limiter != nil {
+			if err := e.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if key != nil && key.limiter != nil {
+			if err := key.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		out, err := e.target(req)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			out.Header.Set(e.keys.header, key.value)
+		}
+		resp, err := e.base.RoundTrip(out)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		wait := retryAfter(resp, time.Now())
+		if key == nil {
+			e.pauseTill.Store(time.Now().Add(wait).UnixNano())
+			return resp, nil
+		}
+		e.keys.exhaust(key, time.Now().Add(wait))
+		if tries >= len(e.keys.keys) || ctx.Err() != nil {
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// headProbe 查询节点当前高度，用于健康检查和落后判断
+type headProbe func(ctx context.Context, r *resty.Request) (int64, error)
+
+// PoolCfg 多节点的健康检查和选择参数
+type PoolCfg struct {
+	Policy         Policy
+	HealthInterval time.Duration // 0=默认30s
+	MaxLag         int64         // 落后最高节点超过该块数不参与选择，0=默认5
+}
+
+// rpcPool 一条链的多个节点，作为 http.RoundTripper 在节点间选择和故障切换
+type rpcPool struct {
+	endpoints []*endpoint
+	cfg       PoolCfg
+	probe     headProbe
+	next      atomic.Uint64
+	stop      chan struct{} // 关闭后停止后台健康检查
+	closeOnce sync.Once
+}
+
+func newPool(chain ChainType, eps []Endpoint, base http.RoundTripper, cfg PoolCfg) (*rpcPool, error) {
+	if cfg.HealthInterval <= 0 {
+		cfg.HealthInterval = defaultHealthInterval
+	}
+	if cfg.MaxLag <= 0 {
+		cfg.MaxLag = defaultMaxLag
+	}
+	p := &rpcPool{cfg: cfg}
+	for _, ep := range eps {
+		if !strings.Contains(ep.URL, "://") {
+			continue
+		}
+		e, err := newEndpoint(chain, ep, base)
+		if err != nil {
+			return nil, err
+		}
+		p.endpoints = append(p.endpoints, e)
+	}
+	if len(p.endpoints) == 0 {
+		return nil, fmt.Errorf("no valid rpc endpoint")
+	}
+	return p, nil
+}
+
+// candidates 可用节点：未在冷却、不落后；全部不可用时退化为全部节点
+func (p *rpcPool) candidates(exclude map[*endpoint]bool) []*endpoint {
+	now := time.Now()
+	best := int64(0)
+	for _, e := range p.endpoints {
+		best = max(best, e.head.Load())
+	}
+	out := make([]*endpoint, 0, len(p.endpoints))
+	rest := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if exclude[e] {
+			continue
+		}
+		rest = append(rest, e)
+		if e.down(now) {
+			continue
+		}
+		if head := e.head.Load(); head > 0 && best-head > p.cfg.MaxLag {
+			continue
+		}
+		out = append(out, e)
+	}
+	if len(out) == 0 {
+		return rest
+	}
+	return out
+}
+
+func (p *rpcPool) pick(exclude map[*endpoint]bool) *endpoint {
+	list := p.candidates(exclude)
+	if len(list) == 0 {
+		return nil
+	}
+	if p.cfg.Policy == LowestLatency {
+		out := list[0]
+		for _, e := range list[1:] {
+			if e.latency.Load() < out.latency.Load() {
+				out = e
+			}
+		}
+		return out
+	}
+	return list[p.next.Add(1)%uint64(len(list))]
+}
+
+// RoundTrip 选一个节点发送；网络错误、5xx、429、HTTP 200 但 JSON-RPC 报服务端错误时换下一个节点重试，所有节点都试过为止
+func (p *rpcPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*endpoint]bool, len(p.endpoints))
+	for {
+		e := p.pick(tried)
+		if e == nil {
+			return nil, fmt.Errorf("no rpc endpoint available")
+		}
+		tried[e] = true
+		start := time.Now()
+		resp, err := e.RoundTrip(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			failed, rerr := rpcFailed(resp)
+			if rerr == nil && !failed {
+				e.ok(time.Since(start))
+				return resp, nil
+			}
+			if rerr != nil {
+				resp, err = nil, rerr
+			}
+		}
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		switch {
+		case errors.Is(err, errKeysExhausted):
+			// key 配额用完是预算问题不是节点故障，不停用节点，换下一个节点发
+		case resp != nil && resp.StatusCode == http.StatusTooManyRequests:
+			e.failFor(retryAfter(resp, time.Now()))
+		default:
+			e.fail()
+		}
+		if len(tried) >= len(p.endpoints) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+}
+
+// rpcReply 只取 JSON-RPC 响应里判断成败的字段
+type rpcReply struct {
+	Jsonrpc string `json:"jsonrpc"`
+	Error   *Error `json:"error"`
+}
+
+// serverError 节点自身的问题（落后节点的 header not found、内部错误），换个节点可能成功；参数、方法不存在之类换节点也一样
+func serverError(e *Error) bool {
+	return e != nil && (e.Code == -32603 || e.Code <= -32000 && e.Code >= -32099)
+}
+
+// rpcFailed 读出 HTTP 200 的响应体，是 JSON-RPC 服务端错误时返回 true；响应体读回后原样放回
+// batch 只在每一项都是服务端错误时才算失败：追块时落后的节点常对最新的一两个高度返回 header not found，
+// 为此换掉节点会丢掉其余项的结果，几个节点都在链头附近时还会轮流被停用；失败的项由调用方重试
+// 不是 JSON-RPC 的响应（波场 HTTP API）不判断
+func rpcFailed(resp *http.Response) (bool, error) {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Contains(body, []byte(`"error"`)) {
+		return false, nil
+	}
+	var replies []rpcReply
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		if json.Unmarshal(body, &replies) != nil {
+			return false, nil
+		}
+	} else {
+		var one rpcReply
+		if json.Unmarshal(body, &one) != nil {
+			return false, nil
+		}
+		replies = append(replies, one)
+	}
+	for _, r := range replies {
+		if r.Jsonrpc == "" || !serverError(r.Error) {
+			return false, nil
+		}
+	}
+	return len(replies) > 0, nil
+}
+
+// watch 设置高度查询并启动后台健康检查：立即检查一次，之后每隔 HealthInterval 检查，冷却中的节点检查通过后恢复使用；Close 后停止
+func (p *rpcPool) watch(probe headProbe) {
+	p.probe = probe
+	p.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(p.cfg.HealthInterval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), p.cfg.HealthInterval)
+			p.check(ctx)
+			cancel()
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close 停止后台健康检查，可重复调用
+func (p *rpcPool) Close() error {
+	p.closeOnce.Do(func() {
+		if p.stop != nil {
+			close(p.stop)
+		}
+	})
+	return nil
+}
+
+// check 并发查询各节点高度和延迟
+func (p *rpcPool) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			head, err := p.probe(ctx, e.client.R().SetContext(ctx))
+			if errors.Is(err, errKeysExhausted) {
+				return
+			}
+			if err != nil {
+				e.fail()
+				return
+			}
+			e.head.Store(head)
+			e.ok(time.Since(start))
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,187 @@
+package bg
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const headerNotFound = `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`
+
+// newRPCNode 用 reply 应答每个请求的节点，hits 记请求数
+func newRPCNode(t *testing.T, hits *atomic.Int64, reply func(r *http.Request, body []byte) (int, string)) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits != nil {
+			hits.Add(1)
+		}
+		body, _ := io.ReadAll(r.Body)
+		code, out := reply(r, body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		io.WriteString(w, out)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fixedNode 总是返回同一个应答的节点
+func fixedNode(t *testing.T, hits *atomic.Int64, code int, out string) *httptest.Server {
+	return newRPCNode(t, hits, func(*http.Request, []byte) (int, string) { return code, out })
+}
+
+// poolPost 经节点池发一个请求，返回状态码和响应体
+func poolPost(t *testing.T, p *rpcPool, body string) (int, string) {
+	t.Helper()
+	resp, err := (&http.Client{Transport: p}).Post(poolBaseURL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(out)
+}
+
+// firstPool 轮询时先选第一个节点的节点池
+func firstPool(t *testing.T, cfg PoolCfg, urls ...string) *rpcPool {
+	t.Helper()
+	eps := make([]Endpoint, 0, len(urls))
+	for _, u := range urls {
+		eps = append(eps, Endpoint{URL: u})
+	}
+	p, err := newPool(CHAIN_ETH, eps, http.DefaultTransport, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.next.Store(uint64(len(urls) - 1))
+	return p
+}
+
+func TestPoolFailsOverOnRPCError(t *testing.T) {
+	const ok = `{"jsonrpc":"2.0","id":1,"result":"0x1"}`
+	const req = `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x1",true]}`
+	for _, tc := range []struct {
+		name     string
+		code     int
+		out      string
+		failover bool
+	}{
+		{"header not found", 200, headerNotFound, true},
+		{"internal error", 200, `{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"internal"}}`, true},
+		{"whole batch", 200, `[{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"internal"}},{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"header not found"}}]`, true},
+		// 落后节点只有链头的一项失败：其余结果照用，节点不停用，失败的项由调用方重试
+		{"batch item", 200, `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"header not found"}}]`, false},
+		{"server error status", 502, `bad gateway`, true},
+		// 请求本身的错误换节点也一样，原样返回
+		{"invalid params", 200, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid argument"}}`, false},
+		{"method not found", 200, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"no such method"}}`, false},
+		{"not json-rpc", 200, `{"Error":"class org.tron.core.exception"}`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var badHits, goodHits atomic.Int64
+			bad := fixedNode(t, &badHits, tc.code, tc.out)
+			good := fixedNode(t, &goodHits, 200, ok)
+			p := firstPool(t, PoolCfg{}, bad.URL, good.URL)
+			code, out := poolPost(t, p, req)
+			if badHits.Load() != 1 {
+				t.Fatalf("first node hits %d", badHits.Load())
+			}
+			if !tc.failover {
+				if code != tc.code || out != tc.out || goodHits.Load() != 0 || p.endpoints[0].down(time.Now()) {
+					t.Fatalf("got %d %s, second node hits %d", code, out, goodHits.Load())
+				}
+				return
+			}
+			if code != 200 || out != ok || goodHits.Load() != 1 {
+				t.Fatalf("got %d %s, second node hits %d", code, out, goodHits.Load())
+			}
+			if !p.endpoints[0].down(time.Now()) || p.endpoints[1].down(time.Now()) {
+				t.Fatal("failed node not cooled down")
+			}
+			// 冷却期间不再选它
+			poolPost(t, p, req)
+			if badHits.Load() != 1 || goodHits.Load() != 2 {
+				t.Fatalf("hits %d %d", badHits.Load(), goodHits.Load())
+			}
+		})
+	}
+}
+
+func TestPoolAllNodesFailing(t *testing.T) {
+	var hits atomic.Int64
+	a, b := fixedNode(t, &hits, 200, headerNotFound), fixedNode(t, &hits, 200, headerNotFound)
+	p := firstPool(t, PoolCfg{}, a.URL, b.URL)
+	// 都试过后把最后一个节点的错误交给调用方
+	code, out := poolPost(t, p, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	if code != 200 || out != headerNotFound || hits.Load() != 2 {
+		t.Fatalf("got %d %s after %d requests", code, out, hits.Load())
+	}
+}
+
+func TestPoolHealthCheckRecovers(t *testing.T) {
+	var healthy atomic.Bool
+	var probes atomic.Int64
+	head := func(h string) func(*http.Request, []byte) (int, string) {
+		return func(_ *http.Request, body []byte) (int, string) {
+			if strings.Contains(string(body), "eth_blockNumber") {
+				probes.Add(1)
+			}
+			if !healthy.Load() {
+				return 500, "down"
+			}
+			return 200, `{"jsonrpc":"2.0","id":1,"result":"` + h + `"}`
+		}
+	}
+	a := newRPCNode(t, nil, head("0x64"))
+	b := fixedNode(t, nil, 200, `{"jsonrpc":"2.0","id":1,"result":"0x5a"}`)
+	p := firstPool(t, PoolCfg{HealthInterval: 20 * time.Millisecond}, a.URL, b.URL)
+	p.watch(func(ctx context.Context, r *resty.Request) (int64, error) { return ethHead(r, 1) })
+	waitFor(t, "first node down", func() bool { return p.endpoints[0].down(time.Now()) })
+
+	// 节点恢复后不用等有请求打到它，定期检查就把它放回来；另一个节点落后 10 块，不再参与选择
+	healthy.Store(true)
+	waitFor(t, "first node recovered", func() bool {
+		return !p.endpoints[0].down(time.Now()) && p.endpoints[0].head.Load() == 100
+	})
+	if list := p.candidates(nil); len(list) != 1 || list[0] != p.endpoints[0] {
+		t.Fatalf("candidates %v", list)
+	}
+
+	p.Close()
+	p.Close()
+	time.Sleep(50 * time.Millisecond)
+	n := probes.Load()
+	time.Sleep(100 * time.Millisecond)
+	if probes.Load() != n {
+		t.Fatal("health check still running after Close")
+	}
+}
+
+func TestPoolAllThrottled(t *testing.T) {
+	a, b := throttledNode(t, 1, nil), throttledNode(t, 1, nil)
+	p := firstPool(t, PoolCfg{}, a, b)
+	// 两个节点都 429：都试过后把 429 交给调用方，节点按 Retry-After 冷却而不是默认的 10s
+	start := time.Now()
+	if code, _ := poolPost(t, p, `{}`); code != http.StatusTooManyRequests {
+		t.Fatalf("status %d", code)
+	}
+	for i, e := range p.endpoints {
+		until := time.Unix(0, e.downUntil.Load())
+		if !e.down(time.Now()) || until.After(start.Add(failCooldown/2)) {
+			t.Fatalf("endpoint %d down until %s", i, until)
+		}
+	}
+	// 全部冷却时仍然发，但等到节点要求的时间之后
+	if code, out := poolPost(t, p, `{}`); code != 200 || out != `{"ok":true}` {
+		t.Fatalf("after Retry-After: %d %s", code, out)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("sent after %s, before Retry-After", elapsed)
+	}
+}
@@ -0,0 +1,57 @@
+package bg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultStreamPrefix = "yscan"
+
+// RedisSinkCfg Redis Streams 投递配置
+type RedisSinkCfg struct {
+	Prefix string // stream 名前缀，空=yscan；stream 为 前缀:链:合约
+	MaxLen int64  // 每个 stream 近似保留条数，0=不裁剪
+}
+
+// RedisSink 每笔交易 XADD 到按链和合约划分的 stream，整批在一个 pipeline 里写入，全部成功才返回 nil
+// 每条消息字段：id=去重 ID，event=事件，data=交易 JSON
+type RedisSink struct {
+	client redis.UniversalClient
+	cfg    RedisSinkCfg
+}
+
+func NewRedisSink(client redis.UniversalClient, cfg RedisSinkCfg) *RedisSink {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultStreamPrefix
+	}
+	return &RedisSink{client: client, cfg: cfg}
+}
+
+func (r *RedisSink) stream(tran *ContractTokenTran) string {
+	return fmt.Sprintf("%s:%s:%s", r.cfg.Prefix, tran.Type.Name(), tranContract(tran))
+}
+
+func (r *RedisSink) Publish(ctx context.Context, batch []*ContractTokenTran) error {
+	bodies, err := marshalBatch(batch)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, tran := range batch {
+			p.XAdd(ctx, &redis.XAddArgs{
+				Stream: r.stream(tran),
+				MaxLen: r.cfg.MaxLen,
+				Approx: r.cfg.MaxLen > 0,
+				Values: map[string]any{
+					"id":    tranMsgID(tran),
+					"event": string(tran.Event),
+					"data":  bodies[i],
+				},
+			})
+		}
+		return nil
+	})
+	return err
+}
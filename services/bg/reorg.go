@@ -0,0 +1,577 @@
+package bg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 默认记住最近多少个高度的区块哈希
+const defaultReorgDepth = 128
+
+type blockRecord struct {
+	hash       string
+	parentHash string
+	trans      []*ContractTokenTran // 已投递的交易，分叉时据此发 retracted
+}
+
+// ringRecord blockRecord 持久化的格式
+type ringRecord struct {
+	Hash       string               `json:"hash"`
+	ParentHash string               `json:"parentHash"`
+	Trans      []*ContractTokenTran `json:"trans"`
+}
+
+// blockRing 最近 depth 个高度的区块记录，由 storeTool.mu 保护；存储实现 BlobStore 时每个高度一条持久化，重启后恢复
+// 启用租约时各实例的记录写在同一处，分叉检测以存储为准，内存里只是本实例投递过的部分
+type blockRing struct {
+	depth  int64
+	max    int64
+	blocks map[int64]*blockRecord
+}
+
+func newBlockRing(depth int64) *blockRing {
+	return &blockRing{
+		depth:  depth,
+		blocks: make(map[int64]*blockRecord),
+	}
+}
+
+// put 返回因超出深度被移除的高度
+func (r *blockRing) put(num int64, rec *blockRecord) []int64 {
+	r.blocks[num] = rec
+	if num <= r.max {
+		return nil
+	}
+	r.max = num
+	evicted := make([]int64, 0)
+	for h := range r.blocks {
+		if h <= r.max-r.depth {
+			delete(r.blocks, h)
+			evicted = append(evicted, h)
+		}
+	}
+	return evicted
+}
+
+// heights 从高到低
+func heights(records map[int64]*blockRecord) []int64 {
+	out := make([]int64, 0, len(records))
+	for h := range records {
+		out = append(out, h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] > out[j] })
+	return out
+}
+
+func (s *Scan) getRingPrefix(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:ring:", t.ChainType().Name())
+}
+
+// remember 已投递的区块记入 ring 并持久化，调用方持有 t.mu
+func (s *Scan) remember(t *storeTool, block *BlockLog) {
+	if t.ring == nil || block.Hash == "" {
+		return
+	}
+	evicted := t.ring.put(block.Num, &blockRecord{
+		hash:       block.Hash,
+		parentHash: block.ParentHash,
+		trans:      block.Trans,
+	})
+	bs, ok := t.disk.(BlobStore)
+	if !ok {
+		return
+	}
+	prefix := s.getRingPrefix(t)
+	raw, err := json.Marshal(ringRecord{Hash: block.Hash, ParentHash: block.ParentHash, Trans: block.Trans})
+	if err == nil {
+		err = bs.SaveBlob(prefix+strconv.FormatInt(block.Num, 10), raw)
+	}
+	if err == nil {
+		err = s.forgetRing(t, evicted)
+	}
+	if err != nil && s.zap_l != nil {
+		// 只影响重启后对该高度的分叉检测
+		s.zap_l.Error("scan.reorg",
+			zap.String("event", "ring_save_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int64("block", block.Num),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+// forgetRing 删除已移出 ring 的高度的持久化记录，调用方持有 t.mu
+func (s *Scan) forgetRing(t *storeTool, heights []int64) error {
+	bs, ok := t.disk.(BlobStore)
+	if !ok || len(heights) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(heights))
+	for _, h := range heights {
+		keys = append(keys, s.getRingPrefix(t)+strconv.FormatInt(h, 10))
+	}
+	return bs.DeleteBlobs(keys...)
+}
+
+// clearRing 强制改起始高度时清空 ring 及其持久化记录，否则重启后恢复的旧记录会把新扫的挤出去；调用方持有 t.mu
+func (s *Scan) clearRing(t *storeTool) error {
+	t.ring = newBlockRing(t.ring.depth)
+	bs, ok := t.disk.(BlobStore)
+	if !ok {
+		return nil
+	}
+	prefix := s.getRingPrefix(t)
+	blobs, err := bs.ListBlobs(prefix)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(blobs))
+	for key := range blobs {
+		keys = append(keys, key)
+	}
+	return bs.DeleteBlobs(keys...)
+}
+
+// loadRing 恢复重启前的区块记录，使重启前投递的区块分叉时仍能撤回；调用方持有 t.mu
+func (s *Scan) loadRing(t *storeTool) error {
+	if t.ring == nil {
+		return nil
+	}
+	if _, ok := t.disk.(BlobStore); !ok {
+		return nil
+	}
+	records, stale, err := s.listRing(t)
+	if err != nil {
+		return err
+	}
+	for h, rec := range records {
+		stale = append(stale, t.ring.put(h, rec)...)
+	}
+	// 深度调小后多出的记录
+	return s.forgetRing(t, stale)
+}
+
+// listRing 读出全部持久化的区块记录，另返回无法解析的高度
+func (s *Scan) listRing(t *storeTool) (map[int64]*blockRecord, []int64, error) {
+	prefix := s.getRingPrefix(t)
+	blobs, err := t.disk.(BlobStore).ListBlobs(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := make(map[int64]*blockRecord, len(blobs))
+	stale := make([]int64, 0)
+	for key, raw := range blobs {
+		h, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		rec, err := s.decodeRecord(t, raw)
+		if err != nil {
+			stale = append(stale, h)
+			continue
+		}
+		records[h] = rec
+	}
+	return records, stale, nil
+}
+
+func (s *Scan) decodeRecord(t *storeTool, raw []byte) (*blockRecord, error) {
+	rec := ringRecord{}
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return nil, err
+	}
+	// Type 不参与序列化
+	for _, tran := range rec.Trans {
+		tran.Type = t.ChainType()
+	}
+	return &blockRecord{hash: rec.Hash, parentHash: rec.ParentHash, trans: rec.Trans}, nil
+}
+
+// ringAt 取出指定高度的区块记录；启用租约时以共用存储为准，相邻高度多半是其他实例投递的
+func (s *Scan) ringAt(t *storeTool, heights ...int64) (map[int64]*blockRecord, error) {
+	out := make(map[int64]*blockRecord, len(heights))
+	t.mu.Lock()
+	shared := t.leases != nil
+	if !shared {
+		for _, h := range heights {
+			if rec, ok := t.ring.blocks[h]; ok {
+				out[h] = rec
+			}
+		}
+	}
+	t.mu.Unlock()
+	if !shared {
+		return out, nil
+	}
+	bs := t.disk.(BlobStore)
+	for _, h := range heights {
+		raw, found, err := bs.LoadBlob(s.getRingPrefix(t) + strconv.FormatInt(h, 10))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if rec, err := s.decodeRecord(t, raw); err == nil {
+			out[h] = rec
+		}
+	}
+	return out, nil
+}
+
+// ringAll 全部区块记录，启用租约时以共用存储为准
+func (s *Scan) ringAll(t *storeTool) (map[int64]*blockRecord, error) {
+	t.mu.Lock()
+	if t.leases == nil {
+		defer t.mu.Unlock()
+		out := make(map[int64]*blockRecord, len(t.ring.blocks))
+		for h, rec := range t.ring.blocks {
+			out[h] = rec
+		}
+		return out, nil
+	}
+	t.mu.Unlock()
+	records, _, err := s.listRing(t)
+	return records, err
+}
+
+func (s *Scan) getReorgKey(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:reorg", t.ChainType().Name())
+}
+
+// checkReorg 用相邻高度的 parentHash 校验新区块，发现分叉则回滚并返回 true，返回 true 时该区块不提交
+// 调用方不持有 t.mu；启用租约时回滚要改写所有分片，只由分片 0 的持有者执行，其他实例登记发现分叉的高度后等它处理
+func (s *Scan) checkReorg(ctx context.Context, t *storeTool, rt ReorgTool, epoch int64, bl *BlockLog) bool {
+	near, err := s.ringAt(t, bl.Num-1, bl.Num, bl.Num+1)
+	if err != nil {
+		s.ringFailed(t, bl.Num, err)
+		return true
+	}
+	mismatch := false
+	if prev, ok := near[bl.Num-1]; ok && prev.hash != bl.ParentHash {
+		mismatch = true
+	}
+	if next, ok := near[bl.Num+1]; ok && next.parentHash != bl.Hash {
+		mismatch = true
+	}
+	if cur, ok := near[bl.Num]; ok && cur.hash != bl.Hash {
+		mismatch = true
+	}
+	if !mismatch {
+		return false
+	}
+	t.mu.Lock()
+	follower := t.leases != nil && !s.holds(t, 0)
+	t.mu.Unlock()
+	if follower {
+		s.requestReorg(t, bl.Num)
+		return true
+	}
+	s.resolveReorg(ctx, t, rt, epoch, bl.Num)
+	return true
+}
+
+// requestReorg 登记发现分叉的高度，分片 0 的持有者下一轮处理；在此之前该区块一直不提交
+func (s *Scan) requestReorg(t *storeTool, num int64) {
+	err := s.rewindKey(t, s.getReorgKey(t), num)
+	if s.zap_l == nil {
+		return
+	}
+	if err != nil {
+		s.zap_l.Error("scan.reorg",
+			zap.String("event", "reorg_request_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int64("block", num),
+			zap.String("err", err.Error()),
+		)
+		return
+	}
+	s.zap_l.Warn("scan.reorg",
+		zap.String("event", "reorg_requested"),
+		zap.String("chain", t.ChainType().Name()),
+		zap.Int64("block", num),
+	)
+}
+
+// takeReorg 分片 0 的持有者处理其他实例登记的分叉，回滚完成或核实没有分叉后清除登记
+func (s *Scan) takeReorg(ctx context.Context, t *storeTool) {
+	t.mu.Lock()
+	leader := t.ring != nil && t.leases != nil && s.holds(t, 0)
+	epoch := t.epoch
+	t.mu.Unlock()
+	if !leader {
+		return
+	}
+	key := s.getReorgKey(t)
+	num, err := s.getKey(t, key)
+	if err != nil {
+		s.ringFailed(t, -1, err)
+		return
+	}
+	if num <= 0 || !s.resolveReorg(ctx, t, t.ScanTool.(ReorgTool), epoch, num) {
+		return
+	}
+	// 处理期间其他实例登记了新的高度则保留，下一轮再处理
+	if _, err := t.disk.(LeaseStore).CompareAndDelete(key, num); err != nil {
+		s.ringFailed(t, num, err)
+	}
+}
+
+// resolveReorg 对比区块记录与主链哈希找出分叉点并回滚，num 为发现不一致的高度；查询或回滚失败返回 false，下次重来
+// 主链哈希在锁外逐个查询，期间已有其他分片回滚（epoch 变化）则不再回滚
+func (s *Scan) resolveReorg(ctx context.Context, t *storeTool, rt ReorgTool, epoch, num int64) bool {
+	// 上次回滚没做完时先补完，否则会把已撤回的记录再撤回一次
+	t.mu.Lock()
+	done := s.finishRollback(t)
+	t.mu.Unlock()
+	if !done {
+		return false
+	}
+	records, err := s.ringAll(t)
+	if err != nil {
+		s.ringFailed(t, num, err)
+		return false
+	}
+	chainName := t.ChainType().Name()
+	// 从高往低对比主链哈希；低于发现不一致的高度的第一个一致的高度就是分叉点
+	fork := int64(-1)
+	lowest := int64(-1)
+	// 分叉点之上仍在主链上的高度：分片乱序提交时常见，不撤回，重扫时按同样的消息 ID 去重
+	keep := make(map[int64]bool)
+	for _, h := range heights(records) {
+		callCtx, cancel := s.callCtx(ctx, t)
+		canonical, err := rt.GetBlockHash(callCtx, h)
+		cancel()
+		if err != nil {
+			if s.zap_l != nil {
+				s.zap_l.Error("scan.reorg",
+					zap.String("event", "get_hash_failed"),
+					zap.String("chain", chainName),
+					zap.Int64("block", h),
+					zap.String("err", err.Error()),
+				)
+			}
+			return false
+		}
+		if canonical != records[h].hash {
+			lowest = h
+			continue
+		}
+		if h < num {
+			fork = h
+			break
+		}
+		keep[h] = true
+	}
+	if lowest < 0 {
+		// 记录全部在主链上，说明本次拿到的区块本身已过期，下次重扫
+		return true
+	}
+	if fork < 0 {
+		fork = lowest - 1
+		if s.zap_l != nil {
+			t.mu.Lock()
+			depth := t.ring.depth
+			t.mu.Unlock()
+			s.zap_l.Warn("scan.reorg",
+				zap.String("event", "reorg_too_deep"),
+				zap.String("chain", chainName),
+				zap.Int64("depth", depth),
+				zap.Int64("fork", fork),
+			)
+		}
+	}
+	return s.rollback(ctx, t, epoch, fork, keep)
+}
+
+// rollback 撤回 fork 之上已投递的交易，并把各分片 checkpoint 回退到 fork；keep 中的高度已确认仍在主链上，保留不撤回
+// 启用租约时先收回其他实例的分片，原持有者在途的写入被 fencing 拒绝，之后再读共用的区块记录，不会漏掉刚提交的高度；回退完成后多出的分片在续期时按份额释放
+// 调用方不持有 t.mu：加锁收集撤回事件并让进行中的分片作废，锁外投递，再加锁确认期间没有 ForceStart 后回退；同一条链同时只有一个回滚
+// epoch 已变化（期间已回滚过）返回 true；撤回投递失败时 checkpoint 保持原状返回 false，撤回之后的步骤失败也返回 false，由 finishRollback 之后补完
+func (s *Scan) rollback(ctx context.Context, t *storeTool, epoch, fork int64, keep map[int64]bool) bool {
+	if !t.reorging.TryLock() {
+		return false
+	}
+	defer t.reorging.Unlock()
+	chainName := t.ChainType().Name()
+	t.mu.Lock()
+	if t.epoch != epoch {
+		t.mu.Unlock()
+		return true
+	}
+	records := t.ring.blocks
+	if t.leases != nil {
+		if !s.seizeShards(t) {
+			t.mu.Unlock()
+			return false
+		}
+		var err error
+		if records, _, err = s.listRing(t); err != nil {
+			t.mu.Unlock()
+			s.ringFailed(t, fork, err)
+			return false
+		}
+	}
+	// dropped 记下收集时内存里的记录，投递期间被重新提交的高度不删
+	dropped := make(map[int64]*blockRecord)
+	retracted := make([]*ContractTokenTran, 0)
+	for _, h := range heights(records) {
+		if h <= fork {
+			break
+		}
+		if keep[h] {
+			continue
+		}
+		dropped[h] = t.ring.blocks[h]
+		for _, tran := range records[h].trans {
+			r := tran.Retract()
+			r.SafeHeight = min(t.safe, fork)
+			retracted = append(retracted, r)
+		}
+	}
+	// 进行中的分片作废本轮结果，投递期间不再按旧链提交
+	t.epoch++
+	epoch = t.epoch
+	t.mu.Unlock()
+	// 先投递撤回事件，失败则 checkpoint 保持原状，下次检测到时重来
+	if !s.deliver(ctx, retracted) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.epoch != epoch {
+		// 投递期间 ForceStart 已回退全部分片并清空 ring
+		return true
+	}
+	forget := make([]int64, 0, len(dropped))
+	for h, rec := range dropped {
+		if t.ring.blocks[h] != rec {
+			continue
+		}
+		delete(t.ring.blocks, h)
+		forget = append(forget, h)
+	}
+	t.ring.max = fork
+	for h := range t.ring.blocks {
+		if h > fork {
+			t.ring.max = max(t.ring.max, h)
+		}
+	}
+	// 投递期间新一轮提交的结果同样作废；撤回已发出，之后删除记录、回退 checkpoint 失败时记下，全部完成前分片不再扫描
+	t.epoch++
+	t.unwinding = &unwindState{fork: fork, forget: forget}
+	done := s.finishRollback(t)
+	if s.zap_l != nil {
+		s.zap_l.Warn("scan.reorg",
+			zap.String("event", "rollback"),
+			zap.String("chain", chainName),
+			zap.Int64("fork", fork),
+			zap.Int("retracted", len(retracted)),
+			zap.Bool("done", done),
+		)
+	}
+	return done
+}
+
+// unwindState 撤回已投递但尚未完成的回滚
+type unwindState struct {
+	fork   int64
+	forget []int64 // 还没删掉的持久化区块记录，留着的话启用租约时会被重新读出再撤回一次
+}
+
+// finishRollback 完成未完成的回滚：删除撤回过的区块记录，截掉改分片数前旧布局的进度，把高于分叉点的分片 checkpoint 回退；全部完成返回 true，调用方持有 t.mu
+func (s *Scan) finishRollback(t *storeTool) bool {
+	u := t.unwinding
+	if u == nil {
+		return true
+	}
+	chainName := t.ChainType().Name()
+	if err := s.forgetRing(t, u.forget); err != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.reorg",
+				zap.String("event", "ring_save_failed"),
+				zap.String("chain", chainName),
+				zap.Int64("fork", u.fork),
+				zap.String("err", err.Error()),
+			)
+		}
+		return false
+	}
+	u.forget = nil
+	if err := s.clipLegacy(t, u.fork); err != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.reorg",
+				zap.String("event", "legacy_save_failed"),
+				zap.String("chain", chainName),
+				zap.Int64("fork", u.fork),
+				zap.String("err", err.Error()),
+			)
+		}
+		return false
+	}
+	for i := 0; i < int(t.GoNum); i++ {
+		if t.marks[i] <= u.fork {
+			continue
+		}
+		if err := s.rewind(t, i, u.fork); err != nil {
+			if s.zap_l != nil {
+				s.zap_l.Error("scan.reorg",
+					zap.String("event", "rewind_save_failed"),
+					zap.String("chain", chainName),
+					zap.Int("shard", i),
+					zap.Int64("checkpoint", u.fork),
+					zap.String("err", err.Error()),
+				)
+			}
+			return false
+		}
+	}
+	t.unwinding = nil
+	return true
+}
+
+// seizeShards 收回其他实例持有的分片并以存储里的 checkpoint 和死信为准；调用方持有 t.mu
+func (s *Scan) seizeShards(t *storeTool) bool {
+	ls := t.disk.(LeaseStore)
+	ttl := s.leaseTTL(t)
+	for i := range t.leases {
+		if s.holds(t, i) {
+			continue
+		}
+		until := time.Now().Add(ttl)
+		token, err := ls.Seize(s.getLeaseKey(t, i), s.lease.Owner, ttl)
+		var last int64
+		if err == nil {
+			last, err = s.get(t, i)
+		}
+		if err == nil {
+			err = s.refreshDead(t, i)
+		}
+		if err != nil {
+			s.leaseFailed(t, "seize_failed", i, err)
+			return false
+		}
+		t.leases[i] = shardLease{token: token, until: until}
+		t.marks[i] = last
+		s.leaseChanged(t, "seized", i, token)
+	}
+	return true
+}
+
+func (s *Scan) ringFailed(t *storeTool, h int64, err error) {
+	if s.zap_l != nil {
+		s.zap_l.Error("scan.reorg",
+			zap.String("event", "ring_load_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int64("block", h),
+			zap.String("err", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,363 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// chainStub 按 canonical 返回主链哈希；onHash 非 nil 时每次查询主链哈希前调用
+type chainStub struct {
+	stubTool
+	canonical map[int64]string
+	onHash    func(n int64)
+}
+
+func (c *chainStub) GetBlockLog(_ context.Context, n int64) (*BlockLog, error) {
+	return &BlockLog{Num: n, Hash: c.canonical[n], ParentHash: c.canonical[n-1],
+		Trans: []*ContractTokenTran{{Type: CHAIN_ETH, TxId: fmt.Sprintf("tx%d", n), BlockNum: n, BlockHash: c.canonical[n]}}}, nil
+}
+
+func (c *chainStub) GetBlockHash(_ context.Context, n int64) (string, error) {
+	if c.onHash != nil {
+		c.onHash(n)
+	}
+	return c.canonical[n], nil
+}
+
+func ringTran(h int64, hash string) *blockRecord {
+	return &blockRecord{hash: hash, trans: []*ContractTokenTran{{Type: CHAIN_ETH, TxId: fmt.Sprintf("tx%d", h), BlockNum: h, BlockHash: hash, Event: EventConfirmed}}}
+}
+
+func TestReorgKeepsCanonicalRecords(t *testing.T) {
+	s := NewScan(2, nil, nil)
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}, canonical: map[int64]string{
+		101: "a101", 102: "a102", 103: "b103", 104: "b104", 105: "b105",
+	}}
+	tl := newTestTool(newMemStore(), toolOpts{tool: c, marks: []int64{105, 103}})
+	// 分片乱序提交：103 是旧链上的，105 是分叉后主链上的
+	for h, hash := range map[int64]string{101: "a101", 102: "a102", 103: "a103", 105: "b105"} {
+		tl.ring.put(h, ringTran(h, hash))
+	}
+	bl := &BlockLog{Num: 104, Hash: "b104", ParentHash: "b103"}
+	if !s.checkReorg(context.Background(), tl, c, tl.epoch, bl) {
+		t.Fatal("reorg not detected")
+	}
+	batch := <-s.Result()
+	if len(batch) != 1 || batch[0].TxId != "tx103" || batch[0].Event != EventRetracted {
+		t.Fatalf("retracted %+v", batch)
+	}
+	if _, ok := tl.ring.blocks[105]; !ok {
+		t.Fatal("canonical record 105 dropped from the ring")
+	}
+	if _, ok := tl.ring.blocks[103]; ok {
+		t.Fatal("stale record 103 kept")
+	}
+	if tl.marks[0] != 102 || tl.marks[1] != 102 || tl.epoch == 0 {
+		t.Fatalf("marks %v epoch %d", tl.marks, tl.epoch)
+	}
+}
+
+func TestRollbackDeliversUnlocked(t *testing.T) {
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}, canonical: map[int64]string{
+		101: "a101", 102: "a102", 103: "b103", 104: "b104",
+	}}
+	s, tl, sink := newLockedScan(toolOpts{tool: c, marks: []int64{103, 102}})
+	for h, hash := range map[int64]string{101: "a101", 102: "a102", 103: "a103"} {
+		tl.ring.put(h, ringTran(h, hash))
+	}
+	// 投递撤回期间另一个分片提交了主链上的 103，回滚不能把它从 ring 删掉
+	replaced := ringTran(103, "b103")
+	sink.during = func(tl *storeTool) { tl.ring.blocks[103] = replaced }
+	bl := &BlockLog{Num: 104, Hash: "b104", ParentHash: "b103"}
+	within(t, 5*time.Second, func() error {
+		if !s.checkReorg(context.Background(), tl, c, tl.epoch, bl) {
+			t.Error("reorg not detected")
+		}
+		return nil
+	})
+	if got := fmt.Sprint(sink.events()); got != "[tx103:retracted]" {
+		t.Fatalf("retracted %s", got)
+	}
+	if tl.ring.blocks[103] != replaced {
+		t.Fatal("record committed during delivery dropped")
+	}
+	if tl.marks[0] != 102 || tl.marks[1] != 102 {
+		t.Fatalf("marks %v", tl.marks)
+	}
+}
+
+// flakyStore 前 failDelete 次 DeleteBlobs、前 failSave[key] 次写 key 失败
+type flakyStore struct {
+	*memStore
+	failDelete int
+	failSave   map[string]int
+}
+
+func (f *flakyStore) Save(key string, val int64) error {
+	if f.failSave[key] > 0 {
+		f.failSave[key]--
+		return errors.New("store unavailable")
+	}
+	return f.memStore.Save(key, val)
+}
+
+func (f *flakyStore) DeleteBlobs(keys ...string) error {
+	if f.failDelete > 0 {
+		f.failDelete--
+		return errors.New("store unavailable")
+	}
+	return f.memStore.DeleteBlobs(keys...)
+}
+
+func TestRollbackFinishesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	s := NewScan(2, nil, nil)
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}, canonical: map[int64]string{
+		101: "a101", 102: "a102", 103: "b103", 104: "b104",
+	}}
+	d := &flakyStore{memStore: newMemStore(), failSave: map[string]int{}}
+	tl := newTestTool(d, toolOpts{tool: c, marks: []int64{104, 103}})
+	for h, hash := range map[int64]string{101: "a101", 102: "a102", 103: "a103"} {
+		s.remember(tl, &BlockLog{Num: h, Hash: hash, Trans: ringTran(h, hash).trans})
+	}
+	sink := &recordSink{}
+	s.SetSink(sink)
+	d.failDelete, d.failSave[s.getSaveKey(tl, 1)] = 1, 1
+	bl := &BlockLog{Num: 104, Hash: "b104", ParentHash: "b103"}
+	if !s.checkReorg(ctx, tl, c, tl.epoch, bl) {
+		t.Fatal("reorg not detected")
+	}
+	if tl.unwinding == nil {
+		t.Fatal("failed rollback reported as done")
+	}
+	// 删除记录失败：checkpoint 还没动，分片不扫描
+	if tl.marks[0] != 104 || tl.marks[1] != 103 {
+		t.Fatalf("marks %v", tl.marks)
+	}
+	// 分片 1 回退失败：仍未完成
+	if s.resolveReorg(ctx, tl, c, tl.epoch, bl.Num) {
+		t.Fatal("rollback finished with shard 1 not rewound")
+	}
+	if !s.resolveReorg(ctx, tl, c, tl.epoch, bl.Num) || tl.unwinding != nil {
+		t.Fatal("rollback not finished")
+	}
+	if tl.marks[0] != 102 || tl.marks[1] != 102 {
+		t.Fatalf("marks %v", tl.marks)
+	}
+	if blobs, _ := d.ListBlobs(s.getRingPrefix(tl)); len(blobs) != 2 {
+		t.Fatalf("ring blobs %d", len(blobs))
+	}
+	// 撤回只发一次
+	if got := fmt.Sprint(sink.events()); got != "[tx103:retracted]" {
+		t.Fatalf("delivered %s", got)
+	}
+}
+
+func TestForceStartForgetsRing(t *testing.T) {
+	s := NewScan(1, nil, nil)
+	d := newMemStore()
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}}
+	tl := newTestTool(d, toolOpts{tool: c, cfg: ChainScanCfg{StartBlock: 100, ForceStart: true}, marks: []int64{500}})
+	for h := int64(498); h <= 500; h++ {
+		s.remember(tl, &BlockLog{Num: h, Hash: fmt.Sprintf("a%d", h), Trans: ringTran(h, "").trans})
+	}
+	if !s.resolveStart(context.Background(), tl, 1000) {
+		t.Fatal("resolve start failed")
+	}
+	if blobs, _ := d.ListBlobs(s.getRingPrefix(tl)); len(blobs) != 0 {
+		t.Fatalf("ring blobs left after ForceStart: %d", len(blobs))
+	}
+	// 重启后不会恢复旧的高位记录，新扫的记录不被挤出
+	restarted := newTestTool(d, toolOpts{tool: c})
+	if err := s.loadRing(restarted); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.ring.blocks) != 0 {
+		t.Fatalf("restored %d stale records", len(restarted.ring.blocks))
+	}
+}
+
+// leasedTool 共用存储 d 的一个实例，按 o 建链（默认 2 个分片），持有 held 中的分片
+func leasedTool(t *testing.T, s *Scan, d *memStore, o toolOpts, owner string, held ...int) *storeTool {
+	s.lease = &LeaseCfg{Owner: owner, TTL: time.Minute}
+	if o.marks == nil {
+		o.marks = make([]int64, 2)
+	}
+	o.leases = true
+	tl := newTestTool(d, o)
+	for _, i := range held {
+		token, ok, err := d.Acquire(s.getLeaseKey(tl, i), owner, time.Minute)
+		if err != nil || !ok {
+			t.Fatalf("%s acquire %d: %v %v", owner, i, ok, err)
+		}
+		tl.leases[i] = shardLease{token: token, until: time.Now().Add(time.Minute)}
+	}
+	return tl
+}
+
+func TestLeasedReorg(t *testing.T) {
+	ctx := context.Background()
+	d := newMemStore()
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}, canonical: map[int64]string{1: "h1", 2: "h2", 3: "h3", 4: "h4"}}
+	a, b := NewScan(2, nil, nil), NewScan(2, nil, nil)
+	sinkA, sinkB := &recordSink{}, &recordSink{}
+	a.SetSink(sinkA)
+	b.SetSink(sinkB)
+	// a 持有分片 0（偶数高度），是执行回滚的实例；b 持有分片 1
+	ta := leasedTool(t, a, d, toolOpts{tool: c}, "a", 0)
+	tb := leasedTool(t, b, d, toolOpts{tool: c}, "b", 1)
+	blk := func(h int64, hash, parent string) *BlockLog {
+		return &BlockLog{Num: h, Hash: hash, ParentHash: parent,
+			Trans: []*ContractTokenTran{{Type: CHAIN_ETH, TxId: fmt.Sprintf("tx%d", h), BlockNum: h, BlockHash: hash}}}
+	}
+	steps := []struct {
+		s   *Scan
+		tl  *storeTool
+		idx int
+		bl  *BlockLog
+	}{
+		{b, tb, 1, blk(1, "h1", "")},
+		{a, ta, 0, blk(2, "h2", "h1")},
+		{b, tb, 1, blk(3, "h3", "h2")},
+		{a, ta, 0, blk(4, "h4", "h3")},
+	}
+	for _, st := range steps {
+		if !st.s.commit(ctx, st.tl, st.idx, st.tl.epoch, st.bl) {
+			t.Fatalf("commit %d failed", st.bl.Num)
+		}
+	}
+	// 3、4 被替换；b 只有自己投递的 1、3，靠共用的记录发现 4 对不上
+	c.canonical[3], c.canonical[4], c.canonical[5] = "x3", "x4", "x5"
+	if b.commit(ctx, tb, 1, tb.epoch, blk(5, "x5", "x4")) {
+		t.Fatal("b committed on top of a stale parent")
+	}
+	if num, _, _ := d.Load(b.getReorgKey(tb)); num != 5 {
+		t.Fatalf("reorg request %d", num)
+	}
+	if tb.marks[1] != 3 {
+		t.Fatalf("b rolled back by itself: %v", tb.marks)
+	}
+	// a 收回分片 1 后撤回两个实例投递的 3、4，并回退全部分片
+	a.takeReorg(ctx, ta)
+	if events := sinkA.events(); fmt.Sprint(events[len(events)-2:]) != "[tx4:retracted tx3:retracted]" {
+		t.Fatalf("a delivered %v", events)
+	}
+	if _, found, _ := d.Load(a.getReorgKey(ta)); found {
+		t.Fatal("reorg request not cleared")
+	}
+	for i := 0; i < 2; i++ {
+		if val, _, _ := d.Load(a.getSaveKey(ta, i)); val != 2 {
+			t.Fatalf("shard %d checkpoint %d", i, val)
+		}
+	}
+	if !a.holds(ta, 1) {
+		t.Fatal("a did not seize shard 1")
+	}
+	if blobs, _ := d.ListBlobs(a.getRingPrefix(ta)); len(blobs) != 2 {
+		t.Fatalf("ring blobs %d", len(blobs))
+	}
+	// b 在途的提交带着旧 token，被拒后放弃分片
+	if b.commit(ctx, tb, 1, tb.epoch, blk(5, "x5", "x4")) {
+		t.Fatal("b committed with a seized lease")
+	}
+	if val, _, _ := d.Load(b.getSaveKey(tb, 1)); val != 2 || b.holds(tb, 1) {
+		t.Fatalf("shard 1 checkpoint %d, b holds %v", val, b.holds(tb, 1))
+	}
+}
+
+// checkCompareAndDelete 值变了不删，没变才删
+func checkCompareAndDelete(t *testing.T, d LeaseStore) {
+	t.Helper()
+	const key = "ETH:scan:reorg"
+	if err := d.Save(key, 5); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.CompareAndDelete(key, 4); err != nil || ok {
+		t.Fatalf("deleted a changed value: %v %v", ok, err)
+	}
+	if val, found, _ := d.Load(key); !found || val != 5 {
+		t.Fatalf("after refused delete: %d %v", val, found)
+	}
+	if ok, err := d.CompareAndDelete(key, 5); err != nil || !ok {
+		t.Fatalf("compare and delete: %v %v", ok, err)
+	}
+	if _, found, _ := d.Load(key); found {
+		t.Fatal("not deleted")
+	}
+	if ok, err := d.CompareAndDelete(key, 5); err != nil || ok {
+		t.Fatalf("deleted a missing key: %v %v", ok, err)
+	}
+}
+
+func TestTakeReorgKeepsNewerRequest(t *testing.T) {
+	ctx := context.Background()
+	d := newMemStore()
+	checkCompareAndDelete(t, d)
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}, canonical: map[int64]string{1: "h1", 2: "h2"}}
+	s := NewScan(2, nil, nil)
+	tl := leasedTool(t, s, d, toolOpts{tool: c}, "a", 0, 1)
+	for h := int64(1); h <= 2; h++ {
+		if !s.commit(ctx, tl, int(h%2), tl.epoch, &BlockLog{Num: h, Hash: c.canonical[h], ParentHash: c.canonical[h-1]}) {
+			t.Fatalf("commit %d failed", h)
+		}
+	}
+	key := s.getReorgKey(tl)
+	if err := d.Save(key, 2); err != nil {
+		t.Fatal(err)
+	}
+	// 核实登记的 2 没有分叉期间，另一个实例登记了 3
+	c.onHash = func(int64) {
+		_ = d.Save(key, 3)
+	}
+	s.takeReorg(ctx, tl)
+	if num, found, _ := d.Load(key); !found || num != 3 {
+		t.Fatalf("newer request lost: %d %v", num, found)
+	}
+	c.onHash = nil
+	s.takeReorg(ctx, tl)
+	if _, found, _ := d.Load(key); found {
+		t.Fatal("request not cleared")
+	}
+}
+
+func TestRollbackClipsLegacy(t *testing.T) {
+	ctx := context.Background()
+	s := NewScan(2, nil, nil)
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}, canonical: map[int64]string{
+		101: "a101", 102: "a102", 103: "b103", 104: "b104",
+	}}
+	d := newMemStore()
+	tl := newTestTool(d, toolOpts{tool: c, marks: []int64{102, 101}})
+	for h, hash := range map[int64]string{101: "a101", 102: "a102", 103: "a103"} {
+		tl.ring.put(h, ringTran(h, hash))
+	}
+	// 改分片数前 3 个分片的旧布局已处理到 105
+	tl.legacy = []*shardLayout{{goNum: 3, marks: []int64{105, 103, 104}}}
+	if err := s.saveLegacy(tl); err != nil {
+		t.Fatal(err)
+	}
+	bl := &BlockLog{Num: 104, Hash: "b104", ParentHash: "b103"}
+	if !s.checkReorg(ctx, tl, c, tl.epoch, bl) || tl.unwinding != nil {
+		t.Fatal("rollback not finished")
+	}
+	// 分叉点之上的新块不能再被旧布局跳过
+	for h := int64(103); h <= 105; h++ {
+		if s.legacyDone(tl, h) {
+			t.Fatalf("block %d still skipped by the legacy layout", h)
+		}
+	}
+	if !s.legacyDone(tl, 102) {
+		t.Fatal("block 102 below the fork no longer skipped")
+	}
+	// 重启后读回的同样是截过的进度
+	tl.legacy = nil
+	if err := s.loadLegacy(tl); err != nil {
+		t.Fatal(err)
+	}
+	if len(tl.legacy) != 1 || fmt.Sprint(tl.legacy[0].marks) != "[102 102 102]" {
+		t.Fatalf("stored legacy %+v", tl.legacy)
+	}
+}
@@ -0,0 +1,218 @@
+package bg
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// shardLayout 改分片数之前的布局；marks[j] 之前且 % goNum == j 的高度已处理过
+type shardLayout struct {
+	goNum int64
+	marks []int64
+}
+
+// done 该布局下高度 h 是否已处理
+func (l *shardLayout) done(h int64) bool {
+	last := l.marks[h%l.goNum]
+	return last != 0 && h <= last
+}
+
+func (l *shardLayout) max() int64 {
+	out := int64(0)
+	for _, last := range l.marks {
+		out = max(out, last)
+	}
+	return out
+}
+
+func (s *Scan) getShardsKey(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:shards", t.ChainType().Name())
+}
+
+func (s *Scan) getLegacyCountKey(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:legacy:count", t.ChainType().Name())
+}
+
+func (s *Scan) getLegacyShardsKey(t *storeTool, i int) string {
+	return fmt.Sprintf("%s:scan:legacy:%d:shards", t.ChainType().Name(), i)
+}
+
+func (s *Scan) getLegacyMarkKey(t *storeTool, i int, idx int) string {
+	return fmt.Sprintf("%s:scan:legacy:%d:shard:%d:checkpoint", t.ChainType().Name(), i, idx)
+}
+
+func (s *Scan) loadLegacy(t *storeTool) error {
+	count, err := s.getKey(t, s.getLegacyCountKey(t))
+	if err != nil {
+		return err
+	}
+	legacy := make([]*shardLayout, 0, count)
+	for i := 0; i < int(count); i++ {
+		goNum, err := s.getKey(t, s.getLegacyShardsKey(t, i))
+		if err != nil {
+			return err
+		}
+		if goNum <= 0 {
+			continue
+		}
+		l := &shardLayout{goNum: goNum, marks: make([]int64, goNum)}
+		for j := range l.marks {
+			if l.marks[j], err = s.getKey(t, s.getLegacyMarkKey(t, i, j)); err != nil {
+				return err
+			}
+		}
+		legacy = append(legacy, l)
+	}
+	t.legacy = legacy
+	return nil
+}
+
+func (s *Scan) saveLegacy(t *storeTool) error {
+	kv := map[string]int64{s.getLegacyCountKey(t): int64(len(t.legacy))}
+	for i, l := range t.legacy {
+		kv[s.getLegacyShardsKey(t, i)] = l.goNum
+		for j, last := range l.marks {
+			kv[s.getLegacyMarkKey(t, i, j)] = last
+		}
+	}
+	return s.rewindBatch(t, kv)
+}
+
+// errReshardLeased 启用租约后发现其他实例改过分片数，迁移只能单实例做
+var errReshardLeased = errors.New("shard count changed while leases are enabled")
+
+// reshard 分片数与上次运行不同时迁移 checkpoint：
+// 新布局所有分片从旧的连续水位开始，水位之上旧布局已处理过的高度记为 legacy 跳过，保证每个高度只处理一次
+// 顺序为 legacy -> 新 checkpoint -> 分片数，中途崩溃重启会再迁移一次，只会少跳不会漏扫
+func (s *Scan) reshard(t *storeTool) error {
+	if err := s.loadLegacy(t); err != nil {
+		return err
+	}
+	prev, err := s.getKey(t, s.getShardsKey(t))
+	if err != nil {
+		return err
+	}
+	if prev == t.GoNum {
+		return nil
+	}
+	if s.lease != nil && prev > 0 {
+		return fmt.Errorf("%w: stored %d, GoNum %d", errReshardLeased, prev, t.GoNum)
+	}
+	if prev > 0 {
+		old := &shardLayout{goNum: prev, marks: make([]int64, prev)}
+		for j := range old.marks {
+			if old.marks[j], err = s.get(t, j); err != nil {
+				return err
+			}
+		}
+		// 只看已初始化的旧分片，全部未初始化说明还没扫过
+		safe := int64(0)
+		for j, last := range old.marks {
+			if last == 0 {
+				continue
+			}
+			done := shardStart(last, prev, j) - 1
+			if safe == 0 || done < safe {
+				safe = done
+			}
+		}
+		if safe > 0 {
+			if old.max() > safe {
+				t.legacy = append(t.legacy, old)
+				if err := s.saveLegacy(t); err != nil {
+					return err
+				}
+			}
+			kv := make(map[string]int64, t.GoNum)
+			for j := 0; j < int(t.GoNum); j++ {
+				kv[s.getSaveKey(t, j)] = safe
+			}
+			if err := s.rewindBatch(t, kv); err != nil {
+				return err
+			}
+		}
+		// 死信按新的分片数重新分配
+		if t.dead, err = s.readShardDead(t, prev); err != nil {
+			return err
+		}
+		if err := s.moveDead(t, prev); err != nil {
+			return err
+		}
+		// 多出来的旧分片删除，避免以后改回来时误用
+		stale := make([]string, 0, max(prev-t.GoNum, 0))
+		for j := int(t.GoNum); j < int(prev); j++ {
+			stale = append(stale, s.getSaveKey(t, j))
+		}
+		if len(stale) > 0 {
+			if err := t.disk.Delete(stale...); err != nil {
+				return err
+			}
+		}
+		if s.zap_l != nil {
+			s.zap_l.Warn("scan.reshard",
+				zap.String("event", "migrate"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.Int64("from", prev),
+				zap.Int64("to", t.GoNum),
+				zap.Int64("safe", safe),
+				zap.Int("legacy", len(t.legacy)),
+			)
+		}
+	}
+	return s.rewindKey(t, s.getShardsKey(t), t.GoNum)
+}
+
+// legacyDone 高度 h 是否已被旧布局处理过，调用方持有 t.mu
+func (s *Scan) legacyDone(t *storeTool, h int64) bool {
+	for _, l := range t.legacy {
+		if l.done(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// clipLegacy 回滚到 fork 时旧布局在 fork 之上的进度一并作废，否则重扫时会把分叉后的新块当作已处理跳过
+// 每次都整体写回，写失败时由调用方保留回滚状态下次重试；调用方持有 t.mu
+func (s *Scan) clipLegacy(t *storeTool, fork int64) error {
+	if len(t.legacy) == 0 {
+		return nil
+	}
+	keep := make([]*shardLayout, 0, len(t.legacy))
+	for _, l := range t.legacy {
+		for j := range l.marks {
+			l.marks[j] = min(l.marks[j], fork)
+		}
+		if l.max() > 0 {
+			keep = append(keep, l)
+		}
+	}
+	t.legacy = keep
+	return s.saveLegacy(t)
+}
+
+// pruneLegacy 水位越过旧布局的最高进度后丢弃该布局，调用方持有 t.mu
+func (s *Scan) pruneLegacy(t *storeTool) {
+	if len(t.legacy) == 0 {
+		return
+	}
+	keep := make([]*shardLayout, 0, len(t.legacy))
+	for _, l := range t.legacy {
+		if l.max() > t.safe {
+			keep = append(keep, l)
+		}
+	}
+	if len(keep) == len(t.legacy) {
+		return
+	}
+	t.legacy = keep
+	if err := s.saveLegacy(t); err != nil && s.zap_l != nil {
+		s.zap_l.Error("scan.reshard",
+			zap.String("event", "prune_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.String("err", err.Error()),
+		)
+	}
+}
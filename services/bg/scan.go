@@ -1,66 +1,275 @@
 package bg
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// Disk 旧的存储接口，Get 无法区分不存在和读取失败；用 AdaptDisk 转成 Store
 type Disk interface {
 	Save(key string, val int64) error
 	Get(key string) int64
 }
 
+// RewindDisk 值只增不减的存储：Save、SaveBatch 不会让值变小，有意回退（分叉回滚、改分片数等）时走 Rewind、RewindBatch
+type RewindDisk interface {
+	Store
+	Rewind(key string, val int64) error
+	RewindBatch(kv map[string]int64) error
+}
+
 type ChainScanCfg struct {
 	Chain        ChainType
 	ConfirmNum   int
 	ContractList []Contract
-	Rpc          []string
+	Rpc          []string      // 旧写法：节点地址，波场的非地址项作为 API key；配置了 Endpoints 时忽略
+	Endpoints    []Endpoint    // 节点配置：地址、请求头、认证、API key 轮换
+	ReorgDepth   int           // 分叉检测记住的区块数，0=默认128，<0 关闭；仅 ETH/BSC 生效，存储实现 BlobStore 时重启后仍有效；EnableLeases 时存储需实现 BlobStore
+	UseLogs      bool          // ETH/BSC 代币转账改用 eth_getLogs，可抓到 transferFrom/合约内部转账
+	CallTimeout  time.Duration // 单次链上调用超时，0=默认10s
+	GoNum        int           // 该链并发分片数，0=使用 NewScan 的 gonum
+	PollInterval time.Duration // 两轮扫描的间隔，0=按出块时间
+	MaxBlocks    int           // 每轮最多推进到 水位+MaxBlocks，0=不限制；追块时避免一轮跑太久
+	BatchSize    int           // 每个分片一次批量拉取的高度数，0=ETH/BSC 默认10，其他链1
+	Pool         PoolCfg       // Rpc 多个节点时的选择策略和健康检查
+	Retry        RetryCfg      // 单个高度拉取失败的重试和死信策略
+	StartBlock   int64         // 没有 checkpoint 时的起始高度，0=从当前高度开始
+	StartTime    time.Time     // 没有 StartBlock 时按出块时间换算起始高度
+	ForceStart   bool          // 启动时用起始高度覆盖已有 checkpoint，同一个起始高度只覆盖一次
+	TronFast     bool          // 波场扫未固化区块，交易先发 pending，固化后再发 confirmed/retracted
+	Lifecycle    bool          // 出块即发 seen，确认数到达 Milestones 时发 confirming，达到 ConfirmNum 发 confirmed
+	Milestones   []int         // 发 confirming 的确认数，需小于 ConfirmNum
 }
 
+const defaultCallTimeout = 10 * time.Second
+const defaultBatchSize = 10
+
 type storeTool struct {
 	Working []chan struct{} // 每个分片一个信号量，防重入
 	GoNum   int64
 	ScanTool
-	cfg   ChainScanCfg
-	disk  Disk
-	cache sync.Map
+	cfg  ChainScanCfg
+	disk Store
+
+	mu        sync.Mutex   // 串行化 投递+保存 checkpoint，与分叉回滚互斥
+	loaded    bool         // 已从存储恢复进度，读取失败时为 false，之后重试
+	epoch     int64        // 每次回滚 +1，旧 epoch 的分片结果作废
+	ring      *blockRing   // nil 表示不做分叉检测
+	reorging  sync.Mutex   // 回滚防重入，投递撤回事件时不持有 mu
+	unwinding *unwindState // 撤回已投递但 checkpoint 还没回退完的回滚，nil 表示没有
+	marks     []int64      // 各分片 checkpoint 的内存副本
+	safe      int64        // 连续水位：<= safe 的高度已全部处理
+
+	legacy    []*shardLayout // 改分片数前的布局，水位之上已处理过的高度跳过
+	dead      []int64        // 重试用完被跳过的高度
+	reviveTry int            // 死信自动重试连续失败的次数
+	reviveAt  time.Time      // 下次自动重试死信的时间
+	reviving  chan struct{}  // 死信自动重试防重入
+
+	start     int64       // 换算后的起始高度，0=从当前高度开始
+	startDone atomic.Bool // 起始高度已确定
+	forced    bool        // ForceStart 已覆盖或无需覆盖
+
+	pending    map[int64][]*ContractTokenTran // 快速模式已发 pending 待确认的高度，nil 表示未启用
+	solid      int64                          // 快速模式已确认到的高度
+	confirming chan struct{}                  // 确认任务防重入
+
+	watch    map[int64]*watchBlock // 生命周期模式下已发 seen 未确认的高度，nil 表示未启用
+	watching chan struct{}         // 新区块扫描防重入
+
+	leases   []shardLease // 启用租约时本实例持有的分片，nil 表示未启用
+	memberAt time.Time    // 上次登记实例、统计份额的时间
+	share    int          // 上次统计出的份额
 }
 
-// NewScan gonum=并发分片数
-func NewScan(gonum int64, disk Disk, log *zap.Logger, cfgs ...ChainScanCfg) *Scan {
+// NewScan gonum=默认并发分片数，ChainScanCfg.GoNum 可单独覆盖；disk 为 nil 时进度只存内存
+// 进度在首轮 Process（或 Backfill、RetryDead）时才从存储恢复并按需迁移分片数，此前 SafeHeight、DeadBlocks 为空
+func NewScan(gonum int64, disk Store, log *zap.Logger, cfgs ...ChainScanCfg) *Scan {
 	if gonum <= 0 {
 		gonum = 1
 	}
+	if disk == nil {
+		disk = newMemStore()
+	}
 	s := &Scan{
-		popChan: make(chan []*ContractTokenTran, 2000),
-		zap_l:   log,
+		result: NewChanSink(2000),
+		zap_l:  log,
+		stop:   make(chan struct{}),
+	}
+	// SQLDisk 之类的事务存储同时作为投递目标，交易都先进库
+	if _, ok := disk.(TxDisk); ok {
+		if sink, ok := disk.(Sink); ok {
+			s.sink = sink
+		}
 	}
 	for _, cfg := range cfgs {
-		t := &storeTool{
-			ScanTool: NewTool(cfg.Chain, cfg.Rpc, cfg.ContractList...),
-			cfg:      cfg,
-			GoNum:    gonum,
-			disk:     disk,
-			Working:  make([]chan struct{}, gonum),
+		tool := NewToolWithCfg(cfg)
+		if tool == nil {
+			if log != nil {
+				log.Error("scan.new",
+					zap.String("event", "invalid_chain_cfg"),
+					zap.String("chain", cfg.Chain.Name()),
+					zap.Strings("rpc", cfg.Rpc),
+				)
+			}
+			continue
 		}
-		for i := range t.Working {
-			t.Working[i] = make(chan struct{}, 1)
+		goNum := gonum
+		if cfg.GoNum > 0 {
+			goNum = int64(cfg.GoNum)
 		}
+		t := newStoreTool(tool, cfg, goNum, disk)
 		s.chain.Store(cfg.Chain, t)
 	}
 	return s
 }
 
+// newStoreTool 按链配置准备分片、确认和分叉检测的状态，进度在首轮扫描时才从 disk 恢复
+func newStoreTool(tool ScanTool, cfg ChainScanCfg, goNum int64, disk Store) *storeTool {
+	t := &storeTool{
+		ScanTool: tool,
+		cfg:      cfg,
+		GoNum:    goNum,
+		disk:     disk,
+		Working:  make([]chan struct{}, goNum),
+		marks:    make([]int64, goNum),
+		reviving: make(chan struct{}, 1),
+	}
+	for i := range t.Working {
+		t.Working[i] = make(chan struct{}, 1)
+	}
+	if cfg.Lifecycle && cfg.ConfirmNum > 0 {
+		t.watch = make(map[int64]*watchBlock)
+		t.watching = make(chan struct{}, 1)
+	}
+	if _, ok := t.ScanTool.(ConfirmTool); ok && cfg.TronFast {
+		t.pending = make(map[int64][]*ContractTokenTran)
+		t.confirming = make(chan struct{}, 1)
+	}
+	if _, ok := t.ScanTool.(ReorgTool); ok && cfg.ReorgDepth >= 0 {
+		depth := int64(cfg.ReorgDepth)
+		if depth == 0 {
+			depth = defaultReorgDepth
+		}
+		t.ring = newBlockRing(depth)
+	}
+	return t
+}
+
 type Scan struct {
-	chain   sync.Map
-	zap_l   *zap.Logger
-	popChan chan []*ContractTokenTran
+	chain  sync.Map
+	zap_l  *zap.Logger
+	result *ChanSink // 默认投递目标，即 Result()
+	sink   Sink
+	lease  *LeaseCfg // nil 表示单实例，不使用租约
+
+	wg        sync.WaitGroup // 进行中的分片
+	runMu     sync.Mutex
+	stopped   bool
+	stop      chan struct{} // 关闭后分片处理完当前区块即退出
+	closeOnce sync.Once
 }
 
-func (s *Scan) Result() <-chan []*ContractTokenTran { return s.popChan }
+func (s *Scan) Result() <-chan []*ContractTokenTran { return s.result.C() }
+
+// SetSink 替换投递目标，需在 Process 之前调用；替换后 Result() 不再有数据，Close 时一并关闭
+// 存储是 SQLDisk 之类的 TxDisk 时，替换后已确认交易也改走新的 Sink，checkpoint 不再与交易同一事务保存
+// 传入 *ChanSink 时替换的是 Result() 本身，可用来调整其缓冲区容量，如 SetSink(NewChanSink(0))；原 channel 随即关闭
+func (s *Scan) SetSink(sink Sink) {
+	if c, ok := sink.(*ChanSink); ok {
+		old := s.result
+		s.result, s.sink = c, nil
+		if old != c {
+			old.Close()
+		}
+		return
+	}
+	s.sink = sink
+}
+
+func (s *Scan) publisher() Sink {
+	if s.sink != nil {
+		return s.sink
+	}
+	return s.result
+}
+
+// txDisk 投递目标就是存储本身时返回 TxDisk，交易与 checkpoint 同一事务写入；否则所有事件都走 publisher
+func (s *Scan) txDisk(t *storeTool) (TxDisk, bool) {
+	td, ok := t.disk.(TxDisk)
+	if !ok {
+		return nil, false
+	}
+	if sink, ok := td.(Sink); !ok || s.sink != sink {
+		return nil, false
+	}
+	return td, true
+}
+
+// acquire 登记一个分片任务，Close 之后返回 false
+func (s *Scan) acquire() bool {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// tracked 把分片之外的调用（死信重试、回补）与分片任务一样登记后执行，Close 等它结束后才关闭 Result
+// Close 之后不执行，返回 errScanClosed
+func (s *Scan) tracked(fn func() error) error {
+	if !s.acquire() {
+		return errScanClosed
+	}
+	defer s.wg.Done()
+	return fn()
+}
+
+// Close 不再接受新的 Process，等待进行中的分片结束后关闭 Result，并停止各链节点池的健康检查
+// ctx 先到期返回 ctx.Err() 且不关闭，调用方中断分片后可再次 Close
+func (s *Scan) Close(ctx context.Context) error {
+	s.runMu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+	s.runMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var err error
+	s.closeOnce.Do(func() {
+		s.releaseLeases()
+		s.chain.Range(func(_, v any) bool {
+			if t, ok := v.(*storeTool); ok {
+				if c, ok := t.ScanTool.(io.Closer); ok {
+					c.Close()
+				}
+			}
+			return true
+		})
+		if c, ok := s.sink.(io.Closer); ok {
+			err = c.Close()
+		}
+		s.result.Close()
+	})
+	return err
+}
 
 func (s *Scan) AddContract(chainType ChainType, contracts ...Contract) {
 	tool, ok := s.chain.Load(chainType)
@@ -72,56 +281,240 @@ func (s *Scan) AddContract(chainType ChainType, contracts ...Contract) {
 	}
 }
 
-func (s *Scan) Process() {
+// callCtx 给单次链上调用加超时
+func (s *Scan) callCtx(ctx context.Context, t *storeTool) (context.Context, context.CancelFunc) {
+	timeout := t.cfg.CallTimeout
+	if timeout <= 0 {
+		timeout = defaultCallTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// pollInterval 该链两轮扫描的间隔
+func (t *storeTool) pollInterval() time.Duration {
+	if t.cfg.PollInterval > 0 {
+		return t.cfg.PollInterval
+	}
+	return t.ChainType().BlockTime()
+}
+
+// Process 触发一轮扫描，ctx 取消后所有分片在当前调用返回后退出
+func (s *Scan) Process(ctx context.Context) {
 	s.chain.Range(func(_, v any) bool {
 		t, ok := v.(*storeTool)
 		if !ok {
 			return true
 		}
-		nowBlockNum, err := t.GetBlockNum()
-		if err != nil {
-			if s.zap_l != nil {
-				s.zap_l.Error("scan.process",
-					zap.String("event", "get_head_failed"),
-					zap.String("chain", t.ChainType().Name()),
-					zap.String("err", err.Error()),
-				)
-			}
-			return true
-		}
-		for i := 0; i < int(t.GoNum); i++ {
-			idx := i
-			go s.process(t, idx, nowBlockNum)
+		return s.processTool(ctx, t)
+	})
+}
+
+// processTool 触发单条链的一轮扫描，Close 之后返回 false
+func (s *Scan) processTool(ctx context.Context, t *storeTool) bool {
+	if err := s.load(t); err != nil {
+		s.loadFailed(t, "scan.process", err)
+		return true
+	}
+	if s.lease != nil {
+		s.renewLeases(t)
+		s.takeReorg(ctx, t)
+	}
+	callCtx, cancel := s.callCtx(ctx, t)
+	nowBlockNum, err := t.GetBlockNum(callCtx)
+	cancel()
+	if err != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.process",
+				zap.String("event", "get_head_failed"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.String("err", err.Error()),
+			)
 		}
 		return true
-	})
+	}
+	if !s.resolveStart(ctx, t, nowBlockNum) {
+		return true
+	}
+	// 限制本轮推进范围，超出部分下一轮继续
+	if t.cfg.MaxBlocks > 0 {
+		t.mu.Lock()
+		done := contiguous(t.marks, t.GoNum)
+		t.mu.Unlock()
+		if done > 0 {
+			nowBlockNum = min(nowBlockNum, done+int64(t.cfg.ConfirmNum)+int64(t.cfg.MaxBlocks))
+		}
+	}
+	for i := 0; i < int(t.GoNum); i++ {
+		if !s.acquire() {
+			return false
+		}
+		idx := i
+		go func() {
+			defer s.wg.Done()
+			s.process(ctx, t, idx, nowBlockNum)
+		}()
+	}
+	// 新区块各实例只跟踪自己的分片，快速模式的确认只由持有分片 0 的实例执行
+	t.mu.Lock()
+	leader := s.holds(t, 0)
+	t.mu.Unlock()
+	if t.watch != nil {
+		if !s.acquire() {
+			return false
+		}
+		go func() {
+			defer s.wg.Done()
+			s.watchTip(ctx, t, nowBlockNum)
+		}()
+	}
+	if t.pending != nil && leader {
+		if !s.acquire() {
+			return false
+		}
+		go func() {
+			defer s.wg.Done()
+			s.confirm(ctx, t)
+		}()
+	}
+	t.mu.Lock()
+	hasDead := len(t.dead) > 0
+	t.mu.Unlock()
+	if hasDead {
+		if !s.acquire() {
+			return false
+		}
+		go func() {
+			defer s.wg.Done()
+			s.reviveDead(ctx, t)
+		}()
+	}
+	return true
 }
 
 func (s *Scan) getSaveKey(t *storeTool, idx int) string {
 	return fmt.Sprintf("%s:scan:shard:%d:checkpoint", t.ChainType().Name(), idx)
 }
 
-func (s *Scan) get(t *storeTool, idx int) int64 {
-	key := s.getSaveKey(t, idx)
-	if t.disk == nil {
-		if v, ok := t.cache.Load(key); ok && v != nil {
-			return v.(int64)
+// load 从存储恢复分片进度、死信、分叉检测记录和确认进度；读取失败返回错误，下次调用重试
+func (s *Scan) load(t *storeTool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.loaded {
+		return nil
+	}
+	if err := s.reshard(t); err != nil {
+		return err
+	}
+	for i := range t.marks {
+		last, err := s.get(t, i)
+		if err != nil {
+			return err
+		}
+		t.marks[i] = last
+	}
+	if err := s.loadDead(t); err != nil {
+		return err
+	}
+	t.safe = s.watermark(t)
+	if err := s.loadRing(t); err != nil {
+		return err
+	}
+	if t.pending != nil {
+		if err := s.initSolid(t); err != nil {
+			return err
 		}
-		return 0
 	}
-	return t.disk.Get(key)
+	t.loaded = true
+	return nil
+}
+
+func (s *Scan) loadFailed(t *storeTool, tag string, err error) {
+	if s.zap_l != nil {
+		s.zap_l.Error(tag,
+			zap.String("event", "load_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+func (s *Scan) get(t *storeTool, idx int) (int64, error) {
+	return s.getKey(t, s.getSaveKey(t, idx))
 }
 
+// getKey 不存在返回 0；旧版本清零的键同样是 0，都按没有进度处理
+func (s *Scan) getKey(t *storeTool, key string) (int64, error) {
+	val, _, err := t.disk.Load(key)
+	return val, err
+}
+
+// save 保存分片 checkpoint 并同步连续水位，调用方持有 t.mu；启用租约时带 fencing token 写入
 func (s *Scan) save(t *storeTool, idx int, val int64) error {
-	key := s.getSaveKey(t, idx)
-	if t.disk == nil {
-		t.cache.Store(key, val)
-		return nil
+	fence, err := s.fence(t, idx)
+	if err != nil {
+		return err
+	}
+	if fence == nil {
+		return s.saveMark(t, idx, val, s.saveKey)
+	}
+	ls := t.disk.(LeaseStore)
+	return s.saveMark(t, idx, val, func(_ *storeTool, key string, val int64) error {
+		return ls.SaveFenced(*fence, key, val)
+	})
+}
+
+// rewind 回退分片 checkpoint，调用方持有 t.mu
+func (s *Scan) rewind(t *storeTool, idx int, val int64) error {
+	return s.saveMark(t, idx, val, s.rewindKey)
+}
+
+// rewindShard 与 rewind 相同，启用租约时像 save 一样带该分片的 fencing token，被拒后放弃该分片；调用方持有 t.mu
+func (s *Scan) rewindShard(t *storeTool, idx int, val int64) error {
+	fence, err := s.fence(t, idx)
+	if err != nil {
+		return err
+	}
+	if fence == nil {
+		return s.rewind(t, idx, val)
+	}
+	ls := t.disk.(LeaseStore)
+	err = s.saveMark(t, idx, val, func(_ *storeTool, key string, val int64) error {
+		return ls.RewindFenced(*fence, map[string]int64{key: val})
+	})
+	s.lostLease(t, idx, err)
+	return err
+}
+
+func (s *Scan) saveMark(t *storeTool, idx int, val int64, write func(*storeTool, string, int64) error) error {
+	if err := write(t, s.getSaveKey(t, idx), val); err != nil {
+		return err
 	}
+	t.marks[idx] = val
+	s.updateWatermark(t)
+	return nil
+}
+
+func (s *Scan) saveKey(t *storeTool, key string, val int64) error {
 	return t.disk.Save(key, val)
 }
 
-func (s *Scan) process(t *storeTool, idx int, nowBlockNum int64) {
+// rewindKey 值可能变小的写入，单调存储上走 Rewind
+func (s *Scan) rewindKey(t *storeTool, key string, val int64) error {
+	if rd, ok := t.disk.(RewindDisk); ok {
+		return rd.Rewind(key, val)
+	}
+	return s.saveKey(t, key, val)
+}
+
+// rewindBatch 值可能变小的批量写入，单调存储上走 RewindBatch
+func (s *Scan) rewindBatch(t *storeTool, kv map[string]int64) error {
+	if rd, ok := t.disk.(RewindDisk); ok {
+		return rd.RewindBatch(kv)
+	}
+	return t.disk.SaveBatch(kv)
+}
+
+func (s *Scan) process(ctx context.Context, t *storeTool, idx int, nowBlockNum int64) {
 	chainName := t.ChainType().Name()
 
 	select {
@@ -137,15 +530,41 @@ func (s *Scan) process(t *storeTool, idx int, nowBlockNum int64) {
 		<-t.Working[idx]
 	}()
 
-	// 读取 checkpoint（已处理的最后高度）
-	last := s.get(t, idx)
+	t.mu.Lock()
+	// 回滚没做完时先补完，之前分片不能按回退前的 checkpoint 继续
+	if !s.holds(t, idx) || !s.finishRollback(t) {
+		t.mu.Unlock()
+		return
+	}
+	epoch := t.epoch
+	// 读取 checkpoint（已处理的最后高度）；读取失败不能当作没有进度，否则会从当前高度重新开始漏扫
+	last, err := s.get(t, idx)
+	if err != nil {
+		t.mu.Unlock()
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.process",
+				zap.String("event", "load_failed"),
+				zap.String("chain", chainName),
+				zap.Int("shard", idx),
+				zap.String("err", err.Error()),
+			)
+		}
+		return
+	}
 	if last == 0 {
 		init := nowBlockNum - int64(t.cfg.ConfirmNum) - 1
+		if t.start > 0 {
+			init = t.start - 1
+		}
 		if init < 0 {
 			init = 0
 		}
 		last = init
+		if t.pending != nil && (t.solid == 0 || init < t.solid) {
+			s.setSolid(t, init)
+		}
 		if err := s.save(t, idx, last); err != nil {
+			t.mu.Unlock()
 			if s.zap_l != nil {
 				s.zap_l.Error("scan.process",
 					zap.String("event", "init_save_failed"),
@@ -158,61 +577,253 @@ func (s *Scan) process(t *storeTool, idx int, nowBlockNum int64) {
 			return
 		}
 	}
+	t.mu.Unlock()
 
-	// 对齐到该分片的起始高度：最小的 h >= last+1 且 h % GoNum == idx
-	start := last + 1
-	rem := start % t.GoNum // int64
-	want := int64(idx)
-	if rem != want {
-		delta := (want - rem + t.GoNum) % t.GoNum
-		start += delta
-	}
+	start := shardStart(last, t.GoNum, idx)
 	startTs := time.Now()
-	// 主循环：每次跨 GoNum 个高度
-	for h := start; ; h += t.GoNum {
+	batch := t.batchSize()
+	// 主循环：每次跨 GoNum 个高度，一批最多 batch 个
+scan:
+	for h := start; ; {
+		heights := make([]int64, 0, batch)
 		// 确认数检查；不足确认先停，等待下次触发
-		if lag := nowBlockNum - h; lag < int64(t.cfg.ConfirmNum) {
+		for ; len(heights) < batch && nowBlockNum-h >= int64(t.cfg.ConfirmNum); h += t.GoNum {
+			heights = append(heights, h)
+		}
+		if len(heights) == 0 {
 			return
 		}
-		// scanBlock = h
-		results, err := t.GetLog(h)
-		if err != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		default:
+		}
+		// 改分片数前已处理过的高度只推进 checkpoint，不再拉取
+		t.mu.Lock()
+		if !s.holds(t, idx) {
+			t.mu.Unlock()
+			return
+		}
+		fetch := make([]int64, 0, len(heights))
+		for _, height := range heights {
+			if !s.legacyDone(t, height) {
+				fetch = append(fetch, height)
+			}
+		}
+		t.mu.Unlock()
+		blocks, err := s.getBlocks(ctx, t, fetch)
+		byNum := make(map[int64]*BlockLog, len(blocks))
+		for _, block := range blocks {
+			byNum[block.Num] = block
+		}
+		fetched := 0
+		for _, height := range heights {
+			block, ok := byNum[height]
+			if !ok && fetched < len(fetch) && fetch[fetched] == height {
+				// 该高度拉取失败，单独退避重试，仍失败则记入死信跳过；批内之后的高度重新拉取
+				if err == nil {
+					err = fmt.Errorf("block %d missing in batch", height)
+				}
+				block = s.retryBlock(ctx, t, idx, height, err, func(h int64) error { return s.addDead(t, h) })
+				if block == nil || !s.commit(ctx, t, idx, epoch, block) {
+					return
+				}
+				h = height + t.GoNum
+				continue scan
+			}
+			if !ok {
+				block = &BlockLog{Num: height}
+			} else {
+				fetched++
+			}
 			if s.zap_l != nil {
-				s.zap_l.Error("scan.process",
-					zap.String("event", "getlog_failed"),
-					zap.String("chain", chainName),
-					zap.Int("shard", idx),
-					zap.Int64("block", h),
-					zap.String("err", err.Error()),
+				s.zap_l.Info("scan.process",
+					zap.String("event", "dispatch"),
+					zap.Int64("scan", height),
+					zap.Int("current_shard", idx),
+					zap.Int64("elapsed_ms", time.Since(startTs).Milliseconds()),
 				)
 			}
-			return
+			if !s.commit(ctx, t, idx, epoch, block) {
+				return
+			}
 		}
-		if s.zap_l != nil {
-			s.zap_l.Info("scan.process",
-				zap.String("event", "dispatch"),
-				zap.Int64("scan", h),
-				zap.Int("current_shard", idx),
-				zap.Int64("elapsed_ms", time.Since(startTs).Milliseconds()),
-			)
+	}
+}
+
+// batchSize 一次拉取的高度数，支持批量的链默认 defaultBatchSize
+func (t *storeTool) batchSize() int {
+	if t.cfg.BatchSize > 0 {
+		return t.cfg.BatchSize
+	}
+	if _, ok := t.ScanTool.(BatchTool); ok {
+		return defaultBatchSize
+	}
+	return 1
+}
+
+// getBlocks 按顺序拉取多个高度，出错时返回之前已成功的部分
+func (s *Scan) getBlocks(ctx context.Context, t *storeTool, nums []int64) ([]*BlockLog, error) {
+	if len(nums) == 0 {
+		return nil, nil
+	}
+	if bt, ok := t.ScanTool.(BatchTool); ok {
+		ctx, cancel := s.callCtx(ctx, t)
+		defer cancel()
+		return bt.GetBlockLogs(ctx, nums)
+	}
+	out := make([]*BlockLog, 0, len(nums))
+	for _, h := range nums {
+		block, err := s.getBlock(ctx, t, h)
+		if err != nil {
+			return out, err
 		}
-		// 发送（at-least-once 语义）
-		if len(results) > 0 {
-			s.popChan <- results
+		out = append(out, block)
+	}
+	return out, nil
+}
+
+func (s *Scan) getBlock(ctx context.Context, t *storeTool, h int64) (*BlockLog, error) {
+	ctx, cancel := s.callCtx(ctx, t)
+	defer cancel()
+	if rt, ok := t.ScanTool.(ReorgTool); ok && t.ring != nil {
+		return rt.GetBlockLog(ctx, h)
+	}
+	results, err := t.GetLog(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockLog{Num: h, Trans: results}, nil
+}
+
+// deliver 投递一批交易并等待 Sink 确认，失败返回 false，调用方不保存 checkpoint
+func (s *Scan) deliver(ctx context.Context, trans []*ContractTokenTran) bool {
+	if len(trans) == 0 {
+		return true
+	}
+	if err := s.publisher().Publish(ctx, trans); err != nil {
+		if s.zap_l != nil && ctx.Err() == nil {
+			s.zap_l.Error("scan.deliver",
+				zap.String("event", "publish_failed"),
+				zap.String("chain", trans[0].Type.Name()),
+				zap.Int("count", len(trans)),
+				zap.String("err", err.Error()),
+			)
 		}
+		return false
+	}
+	return true
+}
 
-		// 保存 checkpoint（已完成 h）
-		if err := s.save(t, idx, h); err != nil {
+// commit 投递并保存 checkpoint；发生回滚或保存失败返回 false，分片本轮结束
+// 分叉检测的 RPC 和投递不持有 t.mu，之后重新加锁确认期间没有回滚再保存 checkpoint、记入 ring
+func (s *Scan) commit(ctx context.Context, t *storeTool, idx int, epoch int64, block *BlockLog) bool {
+	return s.commitWith(ctx, t, idx, epoch, block, nil)
+}
+
+// commitWith settle 非 nil 时在锁内代替保存 checkpoint，重试死信时用它移出死信；此时已确认交易总是走 publisher
+func (s *Scan) commitWith(ctx context.Context, t *storeTool, idx int, epoch int64, block *BlockLog, settle func() error) bool {
+	t.mu.Lock()
+	// 租约已失效的分片由接手的实例继续，本实例不再投递
+	_, err := s.fence(t, idx)
+	ok := t.epoch == epoch && err == nil
+	safe := t.safe
+	// 生命周期模式：之前发过 seen 但确认区块里已没有的交易，与确认一起在锁外投递撤回
+	var (
+		unseen []*ContractTokenTran
+		watch  *watchBlock
+		rev    int
+	)
+	if t.watch != nil {
+		unseen, watch, rev = s.unseen(t, block)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if t.ring != nil && block.Hash != "" {
+		if s.checkReorg(ctx, t, t.ScanTool.(ReorgTool), epoch, block) {
+			return false
+		}
+	}
+	h := block.Num
+	for _, tran := range block.Trans {
+		if tran.Event == "" {
+			tran.Event = EventConfirmed
+		}
+		tran.SafeHeight = safe
+	}
+	// TxDisk 与交易同一事务写入 checkpoint，否则先投递成功再保存（at-least-once）
+	td, tx := s.txDisk(t)
+	tx = tx && settle == nil
+	// 已取消则不保存 checkpoint，下次重扫
+	if !tx && !s.deliver(ctx, block.Trans) {
+		return false
+	}
+	if len(unseen) > 0 && !s.deliver(ctx, unseen) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.epoch != epoch {
+		// 投递期间发生了回滚，不保存 checkpoint，该高度重扫；已投递的区块仍记入 ring，重扫时已不在主链会被撤回
+		if !tx {
+			s.remember(t, block)
+		}
+		return false
+	}
+	fence, err := s.fence(t, idx)
+	if err != nil {
+		return false
+	}
+	if t.watch != nil {
+		if !s.watchSettled(t, h, watch, rev) {
+			// 投递期间 watchTip 又发了该高度，下次重扫时重新撤回
+			return false
+		}
+		delete(t.watch, h)
+	}
+	// 已固化的高度确认任务不会再处理，不记待确认
+	if t.pending != nil && h > t.solid {
+		// 先于 checkpoint 保存，失败则重扫
+		if err := s.savePending(t, h, block.Trans); err != nil {
 			if s.zap_l != nil {
 				s.zap_l.Error("scan.process",
-					zap.String("event", "save_failed"),
-					zap.String("chain", chainName),
+					zap.String("event", "pending_save_failed"),
+					zap.String("chain", t.ChainType().Name()),
 					zap.Int("shard", idx),
 					zap.Int64("block", h),
 					zap.String("err", err.Error()),
 				)
 			}
-			return
+			return false
+		}
+	}
+	switch {
+	case settle != nil:
+		err = settle()
+	case tx:
+		err = s.saveMark(t, idx, h, func(_ *storeTool, key string, val int64) error {
+			return td.SaveWithTrans(ctx, fence, key, val, block.Trans)
+		})
+	default:
+		err = s.save(t, idx, h)
+	}
+	if err != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.process",
+				zap.String("event", "save_failed"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.Int("shard", idx),
+				zap.Int64("block", h),
+				zap.String("err", err.Error()),
+			)
 		}
+		s.lostLease(t, idx, err)
+		return false
 	}
+	s.remember(t, block)
+	return true
 }
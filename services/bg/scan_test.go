@@ -0,0 +1,231 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubTool 只提供链类型，用到的其他方法由嵌入它的桩实现
+type stubTool struct {
+	ScanTool
+	chain ChainType
+}
+
+func (s stubTool) ChainType() ChainType { return s.chain }
+
+// toolOpts newTestTool 的选项，零值为单分片的 CHAIN_ETH stubTool
+type toolOpts struct {
+	tool   ScanTool     // nil 时为 stubTool
+	cfg    ChainScanCfg // Chain 为空时取 tool 的链类型
+	marks  []int64      // 各分片进度，长度即分片数；nil 时单分片
+	leases bool         // 按分片准备租约槽位，租约由测试自己获取
+}
+
+// newTestTool 经 newStoreTool 建链实例，Working、watch、ring 等与线上一样初始化
+func newTestTool(disk Store, o toolOpts) *storeTool {
+	if o.tool == nil {
+		o.tool = stubTool{chain: CHAIN_ETH}
+	}
+	if o.cfg.Chain == UNKNOW {
+		o.cfg.Chain = o.tool.ChainType()
+	}
+	if o.marks == nil {
+		o.marks = make([]int64, 1)
+	}
+	t := newStoreTool(o.tool, o.cfg, int64(len(o.marks)), disk)
+	copy(t.marks, o.marks)
+	if o.leases {
+		t.leases = make([]shardLease, t.GoNum)
+	}
+	return t
+}
+
+// fakeChain 链桩：当前高度为 head，每个高度一笔交易 tx<n>
+// gate 非 nil 时 GetLog 等它关闭或 ctx 结束；entered 非 nil 时收到进入 GetLog 的高度；down 为 true 时 GetLog 失败
+type fakeChain struct {
+	stubTool
+	head    atomic.Int64
+	heads   atomic.Int64 // GetBlockNum 调用次数
+	down    atomic.Bool
+	gate    chan struct{}
+	entered chan int64
+
+	mu      sync.Mutex
+	fetched []int64
+}
+
+func newFakeChain(chain ChainType, head int64) *fakeChain {
+	c := &fakeChain{stubTool: stubTool{chain: chain}}
+	c.head.Store(head)
+	return c
+}
+
+func (c *fakeChain) GetBlockNum(context.Context) (int64, error) {
+	c.heads.Add(1)
+	return c.head.Load(), nil
+}
+
+func (c *fakeChain) GetLog(ctx context.Context, n int64) ([]*ContractTokenTran, error) {
+	c.mu.Lock()
+	c.fetched = append(c.fetched, n)
+	c.mu.Unlock()
+	if c.entered != nil {
+		select {
+		case c.entered <- n:
+		default:
+		}
+	}
+	if c.gate != nil {
+		select {
+		case <-c.gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return []*ContractTokenTran{{Type: c.chain, TxId: fmt.Sprintf("tx%d", n), BlockNum: n}}, nil
+}
+
+// batchChain 支持批量拉取的 fakeChain，记下每批的高度
+type batchChain struct {
+	*fakeChain
+	batches [][]int64
+}
+
+func (b *batchChain) GetBlockLogs(ctx context.Context, nums []int64) ([]*BlockLog, error) {
+	b.mu.Lock()
+	b.batches = append(b.batches, append([]int64(nil), nums...))
+	b.mu.Unlock()
+	out := make([]*BlockLog, 0, len(nums))
+	for _, n := range nums {
+		trans, err := b.fakeChain.GetLog(ctx, n)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, &BlockLog{Num: n, Trans: trans})
+	}
+	return out, nil
+}
+
+// txIds 按收到的顺序列出交易
+func txIds(batches ...[]*ContractTokenTran) []string {
+	out := make([]string, 0)
+	for _, batch := range batches {
+		for _, tran := range batch {
+			out = append(out, tran.TxId)
+		}
+	}
+	return out
+}
+
+func TestChainSettings(t *testing.T) {
+	d := newMemStore()
+	plain := newFakeChain(CHAIN_TRON, 10)
+	batch := &batchChain{fakeChain: newFakeChain(CHAIN_ETH, 10)}
+	for _, tc := range []struct {
+		name  string
+		tool  ScanTool
+		cfg   ChainScanCfg
+		poll  time.Duration
+		batch int
+	}{
+		{"tron defaults", plain, ChainScanCfg{Chain: CHAIN_TRON}, 3 * time.Second, 1},
+		{"eth defaults", batch, ChainScanCfg{Chain: CHAIN_ETH}, 12 * time.Second, defaultBatchSize},
+		{"overridden", batch, ChainScanCfg{Chain: CHAIN_ETH, PollInterval: time.Second, BatchSize: 3}, time.Second, 3},
+		// 不支持批量的链配置了 BatchSize 也按它分批，只是逐个拉取
+		{"plain with batch size", plain, ChainScanCfg{Chain: CHAIN_TRON, BatchSize: 4}, 3 * time.Second, 4},
+	} {
+		tl := newStoreTool(tc.tool, tc.cfg, 1, d)
+		if got := tl.pollInterval(); got != tc.poll {
+			t.Fatalf("%s: poll interval %s, want %s", tc.name, got, tc.poll)
+		}
+		if got := tl.batchSize(); got != tc.batch {
+			t.Fatalf("%s: batch size %d, want %d", tc.name, got, tc.batch)
+		}
+	}
+
+	// 每条链的 GoNum 单独覆盖 NewScan 的默认值
+	pool := PoolCfg{HealthInterval: time.Hour}
+	s := NewScan(3, d, nil,
+		ChainScanCfg{Chain: CHAIN_ETH, Endpoints: []Endpoint{{URL: "http://127.0.0.1:1"}}, Pool: pool},
+		ChainScanCfg{Chain: CHAIN_BSC, Endpoints: []Endpoint{{URL: "http://127.0.0.1:1"}}, Pool: pool, GoNum: 5},
+	)
+	defer s.Close(context.Background())
+	for chain, want := range map[ChainType]int64{CHAIN_ETH: 3, CHAIN_BSC: 5} {
+		v, ok := s.chain.Load(chain)
+		if !ok {
+			t.Fatalf("%s not created", chain.Name())
+		}
+		if tl := v.(*storeTool); tl.GoNum != want || len(tl.Working) != int(want) || len(tl.marks) != int(want) {
+			t.Fatalf("%s: GoNum %d, want %d", chain.Name(), tl.GoNum, want)
+		}
+	}
+}
+
+func TestBatchFetch(t *testing.T) {
+	for _, tc := range []struct {
+		size, want int
+	}{
+		{0, defaultBatchSize},
+		{4, 4},
+	} {
+		c := &batchChain{fakeChain: newFakeChain(CHAIN_ETH, 50)}
+		s := NewScan(2, nil, nil)
+		tl := newStoreTool(c, ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 1, BatchSize: tc.size}, 2, newMemStore())
+		s.chain.Store(CHAIN_ETH, tl)
+		go func() {
+			for range s.Result() {
+			}
+		}()
+		s.processTool(context.Background(), tl)
+		s.wg.Wait()
+		seen := make(map[int64]bool)
+		longest := 0
+		for _, b := range c.batches {
+			longest = max(longest, len(b))
+			if len(b) > tc.want {
+				t.Fatalf("batch size %d: batch %v", tc.size, b)
+			}
+			for i, h := range b {
+				// 同一批只有本分片的高度，跨 GoNum 递增
+				if seen[h] || (i > 0 && h != b[i-1]+2) {
+					t.Fatalf("batch size %d: batch %v", tc.size, b)
+				}
+				seen[h] = true
+			}
+		}
+		if len(seen) != 50 || longest != tc.want {
+			t.Fatalf("batch size %d: fetched %d heights, longest batch %d", tc.size, len(seen), longest)
+		}
+		if got := s.SafeHeight(CHAIN_ETH); got != 50 {
+			t.Fatalf("batch size %d: safe height %d", tc.size, got)
+		}
+		s.Close(context.Background())
+	}
+}
+
+func TestPollIntervalPerChain(t *testing.T) {
+	d := newMemStore()
+	fast, slow := newFakeChain(CHAIN_BSC, 10), newFakeChain(CHAIN_ETH, 10)
+	w := newTestWork(d,
+		newStoreTool(fast, ChainScanCfg{Chain: CHAIN_BSC, PollInterval: 10 * time.Millisecond}, 1, d),
+		newStoreTool(slow, ChainScanCfg{Chain: CHAIN_ETH, PollInterval: time.Hour}, 1, d),
+	)
+	drain(w)
+	w.Run()
+	// 各链按自己的间隔调度，慢链不拖住快链
+	waitFor(t, "fast chain polled", func() bool { return fast.heads.Load() >= 5 })
+	if n := slow.heads.Load(); n != 1 {
+		t.Fatalf("slow chain polled %d times", n)
+	}
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
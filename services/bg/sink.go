@@ -0,0 +1,53 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Sink 交易的投递目标；Publish 返回 nil 之后才保存 checkpoint，返回错误则该高度下次重扫
+// 同一批次可能因重扫重复投递，下游按 TxId+Event 去重
+type Sink interface {
+	Publish(ctx context.Context, batch []*ContractTokenTran) error
+}
+
+var errPublish = errors.New("publish failed")
+
+// deliverErr deliver 失败时的错误：已取消返回 ctx 的错误，否则是 Sink 投递失败
+func deliverErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errPublish
+}
+
+// ChanSink 投递到 channel，即 Result() 的默认实现
+// Publish 在批次放入 channel 后即返回，缓冲区里未被消费的批次在进程退出时会丢失；要求不丢时容量设为 0
+type ChanSink struct {
+	ch   chan []*ContractTokenTran
+	once sync.Once
+}
+
+func NewChanSink(size int) *ChanSink {
+	return &ChanSink{ch: make(chan []*ContractTokenTran, size)}
+}
+
+func (c *ChanSink) Publish(ctx context.Context, batch []*ContractTokenTran) error {
+	select {
+	case c.ch <- batch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// C 消费端读取的 channel，Close 后关闭
+func (c *ChanSink) C() <-chan []*ContractTokenTran { return c.ch }
+
+func (c *ChanSink) Close() error {
+	c.once.Do(func() {
+		close(c.ch)
+	})
+	return nil
+}
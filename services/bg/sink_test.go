@@ -0,0 +1,158 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAckedSinkRedelivers(t *testing.T) {
+	d := newMemStore()
+	c := newFakeChain(CHAIN_ETH, 10)
+	cfg := ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 8}
+	sink := &recordSink{fail: 1}
+	s := NewScan(1, d, nil)
+	s.SetSink(sink)
+	tl := newStoreTool(c, cfg, 1, d)
+	s.chain.Store(CHAIN_ETH, tl)
+	round := func() {
+		s.processTool(context.Background(), tl)
+		s.wg.Wait()
+	}
+	// 投递失败：checkpoint 停在失败高度之前，分片本轮不再往后扫
+	round()
+	if val, _, _ := d.Load(s.getSaveKey(tl, 0)); val != 7 || len(sink.received()) != 0 {
+		t.Fatalf("checkpoint %d after failed publish, delivered %v", val, sink.received())
+	}
+	if got := fmt.Sprint(c.fetched); got != "[8]" {
+		t.Fatalf("fetched %s", got)
+	}
+	// 下一轮从同一高度重新投递
+	round()
+	if got := fmt.Sprint(sink.received()); got != "[tx8 tx9 tx10]" {
+		t.Fatalf("delivered %s", got)
+	}
+	if val, _, _ := d.Load(s.getSaveKey(tl, 0)); val != 10 {
+		t.Fatalf("checkpoint %d", val)
+	}
+	s.Close(context.Background())
+}
+
+func TestChanSinkUnbuffered(t *testing.T) {
+	d := newMemStore()
+	c := newFakeChain(CHAIN_ETH, 10)
+	s := NewScan(1, d, nil)
+	s.SetSink(NewChanSink(0))
+	tl := newStoreTool(c, ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 10}, 1, d)
+	s.chain.Store(CHAIN_ETH, tl)
+	// 容量为 0 时没人读就一直等，被取消的投递不算送达，checkpoint 不动
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	s.processTool(ctx, tl)
+	s.wg.Wait()
+	cancel()
+	if val, _, _ := d.Load(s.getSaveKey(tl, 0)); val != 9 {
+		t.Fatalf("checkpoint %d after unread publish", val)
+	}
+	got := make(chan []string, 1)
+	go func() {
+		batch := <-s.Result()
+		got <- txIds(batch)
+	}()
+	s.processTool(context.Background(), tl)
+	s.wg.Wait()
+	if txs := recvWithin(t, "redelivery", got); fmt.Sprint(txs) != "[tx10]" {
+		t.Fatalf("delivered %v", txs)
+	}
+	if val, _, _ := d.Load(s.getSaveKey(tl, 0)); val != 10 {
+		t.Fatalf("checkpoint %d", val)
+	}
+	s.Close(context.Background())
+}
+
+// recordSink 按到达顺序记下交易，fail 次数内返回错误
+// tl 非 nil 时投递要拿 tl.mu：调用方持锁投递会卡住，由 within 判定失败；during 在锁内执行，模拟投递期间其他任务改了状态
+type recordSink struct {
+	tl     *storeTool
+	during func(*storeTool)
+
+	mu   sync.Mutex
+	fail int
+	got  []*ContractTokenTran
+}
+
+func (r *recordSink) Publish(_ context.Context, batch []*ContractTokenTran) error {
+	if r.tl != nil {
+		r.tl.mu.Lock()
+		defer r.tl.mu.Unlock()
+		if r.during != nil {
+			r.during(r.tl)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail > 0 {
+		r.fail--
+		return errors.New("sink down")
+	}
+	for _, tran := range batch {
+		cp := *tran
+		r.got = append(r.got, &cp)
+	}
+	return nil
+}
+
+// received 按投递顺序列出 TxId
+func (r *recordSink) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]string, 0, len(r.got))
+	for _, tran := range r.got {
+		out = append(out, tran.TxId)
+	}
+	return out
+}
+
+// events 按投递顺序列出 TxId:Event
+func (r *recordSink) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]string, 0, len(r.got))
+	for _, tran := range r.got {
+		out = append(out, fmt.Sprintf("%s:%s", tran.TxId, tran.Event))
+	}
+	return out
+}
+
+func (r *recordSink) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.got = nil
+}
+
+// newLockedScan 按 o 建单实例的链和投递到持锁 recordSink 的 Scan，检查各条投递路径不持有 t.mu
+func newLockedScan(o toolOpts) (*Scan, *storeTool, *recordSink) {
+	s := NewScan(1, nil, nil)
+	tl := newTestTool(newMemStore(), o)
+	sink := &recordSink{tl: tl}
+	s.SetSink(sink)
+	return s, tl, sink
+}
+
+func rollbackDuring(t *storeTool) { t.epoch++ }
+
+// within 在 d 内跑完 fn，否则判定卡死
+func within(t *testing.T, d time.Duration, fn func() error) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatal("blocked delivering under t.mu")
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+package bg
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+func (s *Scan) getStartAppliedKey(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:start:applied", t.ChainType().Name())
+}
+
+// resolveStart 首轮扫描前确定起始高度，ForceStart 时覆盖已有 checkpoint；换算或覆盖失败返回 false，下一轮再试
+func (s *Scan) resolveStart(ctx context.Context, t *storeTool, head int64) bool {
+	if !t.startDone.Load() {
+		start := t.cfg.StartBlock
+		if start <= 0 && !t.cfg.StartTime.IsZero() {
+			var err error
+			if start, err = s.blockAtTime(ctx, t, head); err != nil {
+				if s.zap_l != nil {
+					s.zap_l.Error("scan.start",
+						zap.String("event", "resolve_failed"),
+						zap.String("chain", t.ChainType().Name()),
+						zap.Time("start_time", t.cfg.StartTime),
+						zap.String("err", err.Error()),
+					)
+				}
+				return false
+			}
+		}
+		t.mu.Lock()
+		t.start = start
+		t.mu.Unlock()
+		t.startDone.Store(true)
+		if start > 0 && s.zap_l != nil {
+			s.zap_l.Info("scan.start",
+				zap.String("event", "start_block"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.Int64("start", start),
+				zap.Bool("force", t.cfg.ForceStart),
+			)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return s.forceStart(t)
+}
+
+// forceStart 把全部分片回退到起始高度之前，旧布局和最近区块记录一并作废；调用方持有 t.mu
+// 同一个起始高度只覆盖一次（记录在 start:applied），忘了关 ForceStart 重启也不会重扫
+// 启用租约时只由分片 0 的持有者执行：先收回全部分片，回退时与 commit 一样带各分片的 fencing token；
+// 其他实例照常扫描自己的分片，每轮检查是否已覆盖，分片被收回后按存储里的 checkpoint 继续
+func (s *Scan) forceStart(t *storeTool) bool {
+	start := t.start
+	if t.forced || start <= 0 || !t.cfg.ForceStart {
+		return true
+	}
+	applied, err := s.getKey(t, s.getStartAppliedKey(t))
+	if err != nil {
+		s.startFailed(t, err)
+		return false
+	}
+	if applied == start {
+		// 由其他实例覆盖时，内存里的旧布局随之作废
+		t.legacy = nil
+		t.forced = true
+		return true
+	}
+	if t.leases != nil {
+		if !s.holds(t, 0) {
+			return true
+		}
+		if !s.seizeShards(t) {
+			return false
+		}
+	}
+	t.legacy = nil
+	if err := s.saveLegacy(t); err != nil {
+		s.startFailed(t, err)
+		return false
+	}
+	if t.ring != nil {
+		if err := s.clearRing(t); err != nil {
+			s.startFailed(t, err)
+			return false
+		}
+	}
+	t.epoch++
+	t.unwinding = nil
+	if t.pending != nil {
+		if err := s.clearPending(t); err != nil {
+			s.startFailed(t, err)
+			return false
+		}
+		s.setSolid(t, start-1)
+	}
+	for i := 0; i < int(t.GoNum); i++ {
+		if err := s.rewindShard(t, i, start-1); err != nil {
+			s.startFailed(t, err)
+			return false
+		}
+	}
+	if err := s.rewindKey(t, s.getStartAppliedKey(t), start); err != nil {
+		s.startFailed(t, err)
+		return false
+	}
+	t.forced = true
+	if s.zap_l != nil {
+		s.zap_l.Info("scan.start",
+			zap.String("event", "force_applied"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.Int64("start", start),
+		)
+	}
+	return true
+}
+
+func (s *Scan) startFailed(t *storeTool, err error) {
+	if s.zap_l != nil {
+		s.zap_l.Error("scan.start",
+			zap.String("event", "force_save_failed"),
+			zap.String("chain", t.ChainType().Name()),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+// blockAtTime 二分查找出块时间不早于 StartTime 的第一个高度
+func (s *Scan) blockAtTime(ctx context.Context, t *storeTool, head int64) (int64, error) {
+	tt, ok := t.ScanTool.(TimeTool)
+	if !ok {
+		return 0, fmt.Errorf("chain %s does not support start time", t.ChainType().Name())
+	}
+	lo, hi := int64(1), head
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		callCtx, cancel := s.callCtx(ctx, t)
+		ts, err := tt.GetBlockTime(callCtx, mid)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		if ts.Before(t.cfg.StartTime) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
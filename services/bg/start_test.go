@@ -0,0 +1,175 @@
+package bg
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runRound 新建 Scan 跑一轮，返回本轮拉取的高度；模拟一次重启
+func runRound(t *testing.T, d Store, c *fakeChain, cfg ChainScanCfg) []int64 {
+	t.Helper()
+	c.mu.Lock()
+	c.fetched = nil
+	c.mu.Unlock()
+	s := NewScan(2, d, nil)
+	tl := newStoreTool(c, cfg, 2, d)
+	s.chain.Store(cfg.Chain, tl)
+	go func() {
+		for range s.Result() {
+		}
+	}()
+	s.processTool(context.Background(), tl)
+	s.wg.Wait()
+	s.Close(context.Background())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := slices.Clone(c.fetched)
+	slices.Sort(out)
+	return out
+}
+
+// span 高度区间 [from, to] 是否恰好都拉取了一次
+func span(got []int64, from, to int64) bool {
+	if int64(len(got)) != to-from+1 {
+		return false
+	}
+	for i, h := range got {
+		if h != from+int64(i) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestForceStartAppliedOnce(t *testing.T) {
+	d := newMemStore()
+	c := newFakeChain(CHAIN_ETH, 100)
+	cfg := ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 50, ForceStart: true}
+	if got := runRound(t, d, c, cfg); !span(got, 50, 100) {
+		t.Fatalf("first run fetched %v", got)
+	}
+	if val, _, _ := d.Load("ETH:scan:start:applied"); val != 50 {
+		t.Fatalf("start applied %d", val)
+	}
+	// 忘了关 ForceStart 重启：同一个起始高度不再覆盖，从 checkpoint 继续
+	c.head.Store(110)
+	if got := runRound(t, d, c, cfg); !span(got, 101, 110) {
+		t.Fatalf("restart fetched %v", got)
+	}
+	// 没有 ForceStart 时起始高度只用于没有 checkpoint 的情况
+	c.head.Store(115)
+	if got := runRound(t, d, c, ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 20}); !span(got, 111, 115) {
+		t.Fatalf("start without force fetched %v", got)
+	}
+	// 换了起始高度再覆盖一次
+	cfg.StartBlock = 80
+	if got := runRound(t, d, c, cfg); !span(got, 80, 115) {
+		t.Fatalf("new start fetched %v", got)
+	}
+	if val, _, _ := d.Load("ETH:scan:start:applied"); val != 80 {
+		t.Fatalf("start applied %d", val)
+	}
+	if got := runRound(t, d, c, cfg); len(got) != 0 {
+		t.Fatalf("second restart fetched %v", got)
+	}
+}
+
+// timeChain 第 n 块出块时间为 genesis+3n 秒，fail 非零时前 fail 次查询出错
+type timeChain struct {
+	*fakeChain
+	genesis time.Time
+	fail    atomic.Int64
+	lookups atomic.Int64
+}
+
+func (c *timeChain) GetBlockTime(_ context.Context, n int64) (time.Time, error) {
+	c.lookups.Add(1)
+	if c.fail.Add(-1) >= 0 {
+		return time.Time{}, errors.New("node down")
+	}
+	return c.genesis.Add(time.Duration(n) * 3 * time.Second), nil
+}
+
+func TestStartTime(t *testing.T) {
+	d := newMemStore()
+	c := &timeChain{fakeChain: newFakeChain(CHAIN_ETH, 100), genesis: time.Unix(1_700_000_000, 0)}
+	c.fail.Store(1)
+	// 第 30 块之后 1 秒：第一个不早于它的是第 31 块
+	cfg := ChainScanCfg{Chain: CHAIN_ETH, StartTime: c.genesis.Add(90*time.Second + time.Second)}
+	s := NewScan(1, d, nil)
+	tl := newStoreTool(c, cfg, 1, d)
+	s.chain.Store(CHAIN_ETH, tl)
+	go func() {
+		for range s.Result() {
+		}
+	}()
+	// 换算失败不能按当前高度开始，本轮不扫也不写 checkpoint
+	s.processTool(context.Background(), tl)
+	s.wg.Wait()
+	if val, found, _ := d.Load(s.getSaveKey(tl, 0)); found || len(c.fetched) != 0 {
+		t.Fatalf("scanned after failed lookup: checkpoint %d, fetched %v", val, c.fetched)
+	}
+	s.processTool(context.Background(), tl)
+	s.wg.Wait()
+	if got := slices.Sorted(slices.Values(c.fetched)); !span(got, 31, 100) {
+		t.Fatalf("fetched %v", got)
+	}
+	// 只在首轮换算一次
+	n := c.lookups.Load()
+	c.head.Store(105)
+	s.processTool(context.Background(), tl)
+	s.wg.Wait()
+	if c.lookups.Load() != n || s.SafeHeight(CHAIN_ETH) != 105 {
+		t.Fatalf("lookups %d -> %d, safe height %d", n, c.lookups.Load(), s.SafeHeight(CHAIN_ETH))
+	}
+	s.Close(context.Background())
+}
+
+func TestLeasedForceStart(t *testing.T) {
+	ctx := context.Background()
+	d := newMemStore()
+	c := &chainStub{stubTool: stubTool{chain: CHAIN_ETH}}
+	o := toolOpts{tool: c, cfg: ChainScanCfg{Chain: CHAIN_ETH, StartBlock: 50, ForceStart: true}, marks: []int64{200, 201}}
+	a, b := NewScan(2, nil, nil), NewScan(2, nil, nil)
+	ta := leasedTool(t, a, d, o, "a", 0)
+	tb := leasedTool(t, b, d, o, "b", 1)
+	if err := d.SaveBatch(map[string]int64{a.getSaveKey(ta, 0): 200, a.getSaveKey(ta, 1): 201}); err != nil {
+		t.Fatal(err)
+	}
+	// b 不持有分片 0：不覆盖，照常扫描自己的分片
+	if !b.resolveStart(ctx, tb, 300) {
+		t.Fatal("b resolve start failed")
+	}
+	if val, _, _ := d.Load(b.getSaveKey(tb, 1)); val != 201 || tb.forced {
+		t.Fatalf("b rewound shard 1 to %d", val)
+	}
+	// a 收回分片 1 后带各分片的 token 回退
+	if !a.resolveStart(ctx, ta, 300) {
+		t.Fatal("a resolve start failed")
+	}
+	for i := range 2 {
+		if val, _, _ := d.Load(a.getSaveKey(ta, i)); val != 49 {
+			t.Fatalf("shard %d checkpoint %d", i, val)
+		}
+	}
+	if n := heldCount(a, ta); n != 2 {
+		t.Fatalf("a holds %d shards", n)
+	}
+	// b 之后写分片 1 被拒，看到已覆盖后不再检查
+	tb.mu.Lock()
+	err := b.save(tb, 1, 202)
+	tb.mu.Unlock()
+	if !errors.Is(err, ErrFenced) {
+		t.Fatalf("b saved a seized shard: %v", err)
+	}
+	if !b.resolveStart(ctx, tb, 300) || !tb.forced {
+		t.Fatal("b did not see the applied start")
+	}
+	if val, _, _ := d.Load(b.getSaveKey(tb, 1)); val != 49 {
+		t.Fatalf("shard 1 checkpoint %d", val)
+	}
+}
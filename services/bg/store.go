@@ -0,0 +1,259 @@
+package bg
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotSupported 存储不支持该操作，如 AdaptDisk 包装的旧 Disk 无法按前缀列出
+var ErrNotSupported = errors.New("not supported by store")
+
+// Store 扫描进度的存储；读取区分不存在和读取失败，读取失败时 Scan 跳过本轮而不是当作没有进度
+// 旧的 Disk 实现用 AdaptDisk 包装
+type Store interface {
+	// Load 不存在时 found=false；err 非 nil 时 val、found 无意义
+	Load(key string) (val int64, found bool, err error)
+	Save(key string, val int64) error
+	// SaveBatch 原子写入多个键；单调存储（RewindDisk）上与 Save 一样不允许变小，有意回退走 RewindBatch
+	SaveBatch(kv map[string]int64) error
+	// List 返回以 prefix 开头的所有键值
+	List(prefix string) (map[string]int64, error)
+	Delete(keys ...string) error
+}
+
+// BlobStore 能保存任意字节的存储，与 Store 的整数键各自独立；Scan 用它持久化分叉检测的最近区块，
+// 重启前投递的区块在重启后分叉时仍能撤回；启用租约时快速模式待确认的交易也存在这里。内置的存储都实现了，AdaptDisk 包装的旧 Disk 没有
+type BlobStore interface {
+	SaveBlob(key string, val []byte) error
+	LoadBlob(key string) (val []byte, found bool, err error)
+	// ListBlobs 返回以 prefix 开头的所有键值
+	ListBlobs(prefix string) (map[string][]byte, error)
+	DeleteBlobs(keys ...string) error
+}
+
+// AdaptDisk 把旧的 Disk 包装成 Store：值为 0 视为不存在，读取不会报错，SaveBatch 逐个写入不保证原子，
+// Delete 写 0，List 返回 ErrNotSupported；Disk 有 Rewind 方法时 SaveBatch、Delete 走 Rewind
+func AdaptDisk(disk Disk) Store {
+	if store, ok := disk.(Store); ok {
+		return store
+	}
+	return &diskStore{disk: disk}
+}
+
+type diskStore struct {
+	disk Disk
+}
+
+func (d *diskStore) Load(key string) (int64, bool, error) {
+	val := d.disk.Get(key)
+	return val, val != 0, nil
+}
+
+func (d *diskStore) Save(key string, val int64) error {
+	return d.disk.Save(key, val)
+}
+
+func (d *diskStore) Rewind(key string, val int64) error {
+	if rd, ok := d.disk.(interface{ Rewind(string, int64) error }); ok {
+		return rd.Rewind(key, val)
+	}
+	return d.disk.Save(key, val)
+}
+
+func (d *diskStore) SaveBatch(kv map[string]int64) error {
+	return d.RewindBatch(kv)
+}
+
+func (d *diskStore) RewindBatch(kv map[string]int64) error {
+	for key, val := range kv {
+		if err := d.Rewind(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *diskStore) List(string) (map[string]int64, error) {
+	return nil, ErrNotSupported
+}
+
+func (d *diskStore) Delete(keys ...string) error {
+	for _, key := range keys {
+		if err := d.Rewind(key, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memStore 没有配置存储时的内存实现，进程退出即丢失；租约只在同一进程的多个 Scan 之间有效
+type memStore struct {
+	mu     sync.Mutex
+	m      map[string]int64
+	blobs  map[string][]byte
+	leases map[string]memLease
+}
+
+type memLease struct {
+	owner  string
+	token  int64
+	expire time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{m: make(map[string]int64), blobs: make(map[string][]byte), leases: make(map[string]memLease)}
+}
+
+func (d *memStore) Load(key string) (int64, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	val, ok := d.m[key]
+	return val, ok, nil
+}
+
+func (d *memStore) Save(key string, val int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.m[key] = val
+	return nil
+}
+
+func (d *memStore) SaveBatch(kv map[string]int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, val := range kv {
+		d.m[key] = val
+	}
+	return nil
+}
+
+func (d *memStore) List(prefix string) (map[string]int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]int64)
+	for key, val := range d.m {
+		if strings.HasPrefix(key, prefix) {
+			out[key] = val
+		}
+	}
+	return out, nil
+}
+
+func (d *memStore) Delete(keys ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		delete(d.m, key)
+	}
+	return nil
+}
+
+func (d *memStore) SaveBlob(key string, val []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.blobs[key] = slices.Clone(val)
+	return nil
+}
+
+func (d *memStore) LoadBlob(key string) ([]byte, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	val, ok := d.blobs[key]
+	return slices.Clone(val), ok, nil
+}
+
+func (d *memStore) ListBlobs(prefix string) (map[string][]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string][]byte)
+	for key, val := range d.blobs {
+		if strings.HasPrefix(key, prefix) {
+			out[key] = slices.Clone(val)
+		}
+	}
+	return out, nil
+}
+
+func (d *memStore) DeleteBlobs(keys ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		delete(d.blobs, key)
+	}
+	return nil
+}
+
+func (d *memStore) Acquire(key, owner string, ttl time.Duration) (int64, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	l := d.leases[key]
+	live := l.expire.After(now)
+	if l.owner != owner && live {
+		return l.token, false, nil
+	}
+	if l.owner != owner || !live {
+		l.token++
+	}
+	l.owner = owner
+	l.expire = now.Add(ttl)
+	d.leases[key] = l
+	return l.token, true, nil
+}
+
+func (d *memStore) Seize(key, owner string, ttl time.Duration) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l := d.leases[key]
+	l.token++
+	l.owner = owner
+	l.expire = time.Now().Add(ttl)
+	d.leases[key] = l
+	return l.token, nil
+}
+
+func (d *memStore) Release(key, owner string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if l, ok := d.leases[key]; ok && l.owner == owner {
+		l.expire = time.Time{}
+		d.leases[key] = l
+	}
+	return nil
+}
+
+func (d *memStore) RewindFenced(fence Fence, kv map[string]int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.leases[fence.Lease].token != fence.Token {
+		return fmt.Errorf("%w: %s", ErrFenced, fence.Lease)
+	}
+	for key, val := range kv {
+		d.m[key] = val
+	}
+	return nil
+}
+
+func (d *memStore) CompareAndDelete(key string, val int64) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cur, ok := d.m[key]; !ok || cur != val {
+		return false, nil
+	}
+	delete(d.m, key)
+	return true, nil
+}
+
+func (d *memStore) SaveFenced(fence Fence, key string, val int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.leases[fence.Lease].token != fence.Token {
+		return fmt.Errorf("%w: %s", ErrFenced, fence.Lease)
+	}
+	d.m[key] = val
+	return nil
+}
@@ -0,0 +1,131 @@
+package bg
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// legacyDisk 旧接口的 Disk，只有 Save、Get
+type legacyDisk struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func newLegacyDisk() *legacyDisk { return &legacyDisk{m: make(map[string]int64)} }
+
+func (d *legacyDisk) Save(key string, val int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.m[key] = val
+	return nil
+}
+
+func (d *legacyDisk) Get(key string) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m[key]
+}
+
+// monotonicDisk 只增不减的旧 Disk，回退走 Rewind
+type monotonicDisk struct {
+	legacyDisk
+	rewinds []string
+}
+
+func (d *monotonicDisk) Save(key string, val int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.m[key] = max(d.m[key], val)
+	return nil
+}
+
+func (d *monotonicDisk) Rewind(key string, val int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.m[key] = val
+	d.rewinds = append(d.rewinds, fmt.Sprintf("%s=%d", key, val))
+	return nil
+}
+
+func TestAdaptDisk(t *testing.T) {
+	legacy := newLegacyDisk()
+	d := AdaptDisk(legacy)
+	// 值为 0 与不存在无法区分，都当作不存在，读取不报错
+	if _, found, err := d.Load("ETH:scan:shards"); found || err != nil {
+		t.Fatalf("missing key: found=%v err=%v", found, err)
+	}
+	if err := d.Save("ETH:scan:shards", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := d.Load("ETH:scan:shards"); found {
+		t.Fatal("zero value reported as found")
+	}
+	if err := d.SaveBatch(map[string]int64{"ETH:scan:shards": 2, "ETH:scan:shard:0:checkpoint": 100}); err != nil {
+		t.Fatal(err)
+	}
+	if val, found, err := d.Load("ETH:scan:shard:0:checkpoint"); val != 100 || !found || err != nil {
+		t.Fatalf("load %d %v %v", val, found, err)
+	}
+	if _, err := d.List("ETH:"); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("list: %v", err)
+	}
+	// 删除就是写 0
+	if err := d.Delete("ETH:scan:shards"); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := legacy.m["ETH:scan:shards"]; !ok || val != 0 {
+		t.Fatalf("deleted key %d %v", val, ok)
+	}
+	if _, ok := d.(BlobStore); ok {
+		t.Fatal("adapted disk claims blob support")
+	}
+
+	// 已经是 Store 的原样返回
+	bolt, _ := newTestBoltDisk(t)
+	if AdaptDisk(bolt) != Store(bolt) {
+		t.Fatal("store wrapped again")
+	}
+}
+
+func TestAdaptDiskRewind(t *testing.T) {
+	disk := &monotonicDisk{legacyDisk: *newLegacyDisk()}
+	d := AdaptDisk(disk)
+	if err := d.Save("ETH:scan:shard:0:checkpoint", 100); err != nil {
+		t.Fatal(err)
+	}
+	// Disk 有 Rewind 时批量写入和删除都走它，值可以变小
+	if err := d.SaveBatch(map[string]int64{"ETH:scan:shard:0:checkpoint": 90}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("ETH:scan:shards"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(disk.rewinds); got != "[ETH:scan:shard:0:checkpoint=90 ETH:scan:shards=0]" {
+		t.Fatalf("rewinds %s", got)
+	}
+	if val := disk.Get("ETH:scan:shard:0:checkpoint"); val != 90 {
+		t.Fatalf("checkpoint %d", val)
+	}
+	// 普通 Save 仍按 Disk 自己的规则，不会变小
+	if err := d.Save("ETH:scan:shard:0:checkpoint", 80); err != nil {
+		t.Fatal(err)
+	}
+	if val := disk.Get("ETH:scan:shard:0:checkpoint"); val != 90 {
+		t.Fatalf("checkpoint after save %d", val)
+	}
+
+	// Scan 有意回退时经 Rewind 写入
+	s := NewScan(1, d, nil)
+	tl := newTestTool(d, toolOpts{})
+	tl.mu.Lock()
+	err := s.rewind(tl, 0, 50)
+	tl.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := disk.Get(s.getSaveKey(tl, 0)); val != 50 {
+		t.Fatalf("checkpoint after scan rewind %d", val)
+	}
+}
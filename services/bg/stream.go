@@ -0,0 +1,46 @@
+package bg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// tranContract 交易按合约分流用的名字：第一笔转账的合约，本币转账为币种符号
+func tranContract(tran *ContractTokenTran) string {
+	if len(tran.Transfers) == 0 || tran.Transfers[0].Contract == "" {
+		return tran.Type.Coin()
+	}
+	c := tran.Transfers[0].Contract
+	if strings.HasPrefix(c, "0x") {
+		return strings.ToLower(c)
+	}
+	return c
+}
+
+// tranMsgID 消息去重 ID；同一笔交易不同事件、不同确认进度、分叉后所在的不同区块各自一条
+// 没有区块哈希的链（Tron）用高度区分：被撤回后重新打包进另一个区块的 pending 不会被当成重复
+func tranMsgID(tran *ContractTokenTran) string {
+	id := fmt.Sprintf("%s:%s:%s", tran.Type.Name(), tran.TxId, tran.Event)
+	if tran.BlockHash != "" {
+		id = fmt.Sprintf("%s:%s", id, tran.BlockHash)
+	} else {
+		id = fmt.Sprintf("%s:%d", id, tran.BlockNum)
+	}
+	if tran.Event == EventConfirming || tran.Event == EventSeen {
+		id = fmt.Sprintf("%s:%d", id, tran.Confirmations)
+	}
+	return id
+}
+
+func marshalBatch(batch []*ContractTokenTran) ([][]byte, error) {
+	out := make([][]byte, 0, len(batch))
+	for _, tran := range batch {
+		body, err := json.Marshal(tran)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, body)
+	}
+	return out, nil
+}
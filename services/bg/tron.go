@@ -1,11 +1,13 @@
 package bg
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"math/big"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/suiguo/yscan/services/utils"
 
@@ -110,6 +112,7 @@ const (
 
 const (
 	OutOfEnergy = "OUT_OF_ENERGY"
+	Revert      = "REVERT"
 	Success     = "SUCCESS"
 )
 
@@ -145,6 +148,25 @@ type Receipt struct {
 const getNowBlock = "/walletsolidity/getblock"
 const getLastBlock = "/walletsolidity/getblock"
 
+// 快速模式使用全节点未固化区块
+const getFastNowBlock = "/wallet/getnowblock"
+const getFastTranByNum = "/wallet/gettransactioninfobyblocknum"
+const getFastTrxTranByNum = "/wallet/getblockbynum"
+
+// tronPath 一组查询接口
+type tronPath struct {
+	now   string
+	info  string
+	block string
+}
+
+func tronPaths(fast bool) tronPath {
+	if fast {
+		return tronPath{now: getFastNowBlock, info: getFastTranByNum, block: getFastTrxTranByNum}
+	}
+	return tronPath{now: getLastBlock, info: getTranByNum, block: getTrxTranByNum}
+}
+
 const getTranByNum = "/walletsolidity/gettransactioninfobyblocknum"
 const getTrxTranByNum = "/walletsolidity/getblockbynum"
 
@@ -198,15 +220,30 @@ func normT(s string) string {
 type tronTool struct {
 	httpclient *resty.Client
 	monitorMap sync.Map // map[string]*Contract
+	fast       bool     // 扫未固化区块，交易先以 pending 发出
+	pool       *rpcPool
+}
+
+// Close 停止节点池的后台健康检查
+func (t *tronTool) Close() error {
+	return t.pool.Close()
 }
 
-func (t *tronTool) R() *resty.Request {
-	return t.httpclient.R()
+func (t *tronTool) R(ctx context.Context) *resty.Request {
+	return t.httpclient.R().SetContext(ctx)
 }
 
-func (t *tronTool) GetBlockNum() (int64, error) {
+func (t *tronTool) GetBlockNum(ctx context.Context) (int64, error) {
+	return tronHead(t.R(ctx), t.fast)
+}
+
+func tronHead(r *resty.Request, fast bool) (int64, error) {
+	path := getNowBlock
+	if fast {
+		path = getFastNowBlock
+	}
 	block := &TronBlockInfo{}
-	_, err := t.R().SetResult(block).Post(getNowBlock)
+	_, err := r.SetResult(block).Post(path)
 	if err != nil {
 		return 0, err
 	}
@@ -216,9 +253,21 @@ func (t *tronTool) GetBlockNum() (int64, error) {
 	return 0, fmt.Errorf("block numer is zero")
 }
 
-func (t *tronTool) getLastBlockNum() (int64, error) {
+func (t *tronTool) GetBlockTime(ctx context.Context, blockNum int64) (time.Time, error) {
+	data := &SolidityData{}
+	_, err := t.R(ctx).SetResult(data).SetBody(map[string]any{"num": blockNum}).Post(getTrxTranByNum)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if data.BlockHeader.RawData.Timestamp == 0 {
+		return time.Time{}, fmt.Errorf("block %d not found", blockNum)
+	}
+	return time.UnixMilli(data.BlockHeader.RawData.Timestamp), nil
+}
+
+func (t *tronTool) getLastBlockNum(ctx context.Context, fast bool) (int64, error) {
 	block := &TronBlockInfo{}
-	_, err := t.R().SetResult(block).Post(getLastBlock)
+	_, err := t.R(ctx).SetResult(block).Post(tronPaths(fast).now)
 	if err != nil {
 		return 0, err
 	}
@@ -227,18 +276,41 @@ func (t *tronTool) getLastBlockNum() (int64, error) {
 	}
 	return 0, fmt.Errorf("block numer is zero")
 }
-func (t *tronTool) GetLog(blockNum int64) ([]*ContractTokenTran, error) {
-	lastBlockNum, err := t.getLastBlockNum()
+func (t *tronTool) GetLog(ctx context.Context, blockNum int64) ([]*ContractTokenTran, error) {
+	out, err := t.getLog(ctx, blockNum, t.fast)
+	if err != nil {
+		return nil, err
+	}
+	if t.fast {
+		for _, tran := range out {
+			tran.Event = EventPending
+		}
+	}
+	return out, nil
+}
+
+// SolidHeight 固化节点当前高度
+func (t *tronTool) SolidHeight(ctx context.Context) (int64, error) {
+	return t.getLastBlockNum(ctx, false)
+}
+
+// GetSolidLog 按固化区块查询，用于确认快速模式发出的 pending
+func (t *tronTool) GetSolidLog(ctx context.Context, blockNum int64) ([]*ContractTokenTran, error) {
+	return t.getLog(ctx, blockNum, false)
+}
+
+func (t *tronTool) getLog(ctx context.Context, blockNum int64, fast bool) ([]*ContractTokenTran, error) {
+	lastBlockNum, err := t.getLastBlockNum(ctx, fast)
 	if err != nil {
 		return nil, err
 	}
 	// 这里返回 trx 转账 和 txMeta
-	trx, txMeta, err := t.TrxTransfer(blockNum, lastBlockNum)
+	trx, txMeta, err := t.trxTransfer(ctx, fast, blockNum, lastBlockNum)
 	if err != nil {
 		return nil, err
 	}
 	// 传入 txMeta 做过滤
-	out, err := t.Trc20Transfer(blockNum, lastBlockNum, trx, txMeta)
+	out, err := t.trc20Transfer(ctx, fast, blockNum, lastBlockNum, trx, txMeta)
 	if err != nil {
 		return nil, err
 	}
@@ -247,10 +319,14 @@ func (t *tronTool) GetLog(blockNum int64) ([]*ContractTokenTran, error) {
 
 // 之前是 (map[string]*ContractTokenTran, error)
 // 现在加一个返回：txMeta map
-func (t *tronTool) TrxTransfer(blockNum int64, lastBlock int64) (map[string]*ContractTokenTran, map[string]*TxMeta, error) {
+func (t *tronTool) TrxTransfer(ctx context.Context, blockNum int64, lastBlock int64) (map[string]*ContractTokenTran, map[string]*TxMeta, error) {
+	return t.trxTransfer(ctx, t.fast, blockNum, lastBlock)
+}
+
+func (t *tronTool) trxTransfer(ctx context.Context, fast bool, blockNum int64, lastBlock int64) (map[string]*ContractTokenTran, map[string]*TxMeta, error) {
 	param := map[string]any{"num": blockNum, "visible": true}
 	data := &SolidityData{}
-	_, err := t.R().SetResult(data).SetBody(param).Post(getTrxTranByNum)
+	_, err := t.R(ctx).SetResult(data).SetBody(param).Post(tronPaths(fast).block)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -312,10 +388,14 @@ func (t *tronTool) TrxTransfer(blockNum int64, lastBlock int64) (map[string]*Con
 
 // 之前是 (blockNum, lastBlock, trx map)
 // 现在加一个入参 txMeta
-func (t *tronTool) Trc20Transfer(blockNum int64, lastBlock int64, trx map[string]*ContractTokenTran, txMeta map[string]*TxMeta) ([]*ContractTokenTran, error) {
+func (t *tronTool) Trc20Transfer(ctx context.Context, blockNum int64, lastBlock int64, trx map[string]*ContractTokenTran, txMeta map[string]*TxMeta) ([]*ContractTokenTran, error) {
+	return t.trc20Transfer(ctx, t.fast, blockNum, lastBlock, trx, txMeta)
+}
+
+func (t *tronTool) trc20Transfer(ctx context.Context, fast bool, blockNum int64, lastBlock int64, trx map[string]*ContractTokenTran, txMeta map[string]*TxMeta) ([]*ContractTokenTran, error) {
 	param := map[string]any{"num": blockNum, "visible": true}
 	showData := make([]Element, 0)
-	_, err := t.R().SetResult(&showData).SetBody(param).Post(getTranByNum)
+	_, err := t.R(ctx).SetResult(&showData).SetBody(param).Post(tronPaths(fast).info)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,92 @@
+package bg
+
+import (
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+func (s *Scan) getWatermarkKey(t *storeTool) string {
+	return fmt.Sprintf("%s:scan:watermark", t.ChainType().Name())
+}
+
+// shardStart 分片 idx 在 checkpoint 之后的下一个高度：最小的 h >= last+1 且 h % goNum == idx
+func shardStart(last int64, goNum int64, idx int) int64 {
+	start := last + 1
+	rem := start % goNum
+	want := int64(idx)
+	if rem != want {
+		start += (want - rem + goNum) % goNum
+	}
+	return start
+}
+
+// contiguous 各分片下一个待处理高度的最小值减一；有分片尚未初始化返回 0
+func contiguous(marks []int64, goNum int64) int64 {
+	out := int64(-1)
+	for idx, last := range marks {
+		if last == 0 {
+			return 0
+		}
+		done := shardStart(last, goNum, idx) - 1
+		if out < 0 || done < out {
+			out = done
+		}
+	}
+	if out < 0 {
+		return 0
+	}
+	return out
+}
+
+// watermark 对外的连续水位：分片进度的连续高度，有死信时不超过最低的死信高度减一，RetryDead 成功后再推进；调用方持有 t.mu
+func (s *Scan) watermark(t *storeTool) int64 {
+	safe := contiguous(t.marks, t.GoNum)
+	if len(t.dead) > 0 {
+		safe = min(safe, slices.Min(t.dead)-1)
+	}
+	return max(safe, 0)
+}
+
+// updateWatermark 水位变化时持久化，调用方持有 t.mu
+// 启用租约时各实例只在续期时刷新他人分片的进度，只由分片 0 的持有者写入，其他实例只更新内存里的副本，不会按各自的视图来回改写
+func (s *Scan) updateWatermark(t *storeTool) {
+	safe := s.watermark(t)
+	if safe == t.safe {
+		return
+	}
+	if !s.holds(t, 0) {
+		t.safe = safe
+		s.pruneLegacy(t)
+		return
+	}
+	write := s.saveKey
+	if safe < t.safe {
+		write = s.rewindKey
+	}
+	if err := write(t, s.getWatermarkKey(t), safe); err != nil {
+		if s.zap_l != nil {
+			s.zap_l.Error("scan.watermark",
+				zap.String("event", "save_failed"),
+				zap.String("chain", t.ChainType().Name()),
+				zap.Int64("safe", safe),
+				zap.String("err", err.Error()),
+			)
+		}
+		return
+	}
+	t.safe = safe
+	s.pruneLegacy(t)
+}
+
+// SafeHeight 该链已连续处理完的最高区块，下游可据此对账到该高度；死信高度未补齐前不会越过它
+func (s *Scan) SafeHeight(chain ChainType) int64 {
+	t := s.tool(chain)
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.safe
+}
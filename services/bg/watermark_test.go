@@ -0,0 +1,80 @@
+package bg
+
+import (
+	"context"
+	"testing"
+)
+
+func TestContiguous(t *testing.T) {
+	for _, tc := range []struct {
+		marks []int64
+		want  int64
+	}{
+		{[]int64{15}, 15},
+		{[]int64{9, 9, 9}, 9},
+		// 分片 1 落后：它的下一个高度 10 之前都处理完了
+		{[]int64{12, 7, 11}, 9},
+		{[]int64{30, 10, 29}, 12},
+		// 有分片还没初始化
+		{[]int64{0, 5, 6}, 0},
+	} {
+		if got := contiguous(tc.marks, int64(len(tc.marks))); got != tc.want {
+			t.Fatalf("contiguous(%v) = %d, want %d", tc.marks, got, tc.want)
+		}
+	}
+}
+
+func TestWatermarkUnevenShards(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	d := NewRedisDisk(client, "yscan")
+	s := NewScan(3, d, nil)
+	tl := newStoreTool(newFakeChain(CHAIN_ETH, 100), ChainScanCfg{Chain: CHAIN_ETH}, 3, d)
+	s.chain.Store(CHAIN_ETH, tl)
+	for i := 0; i < 3; i++ {
+		if err := s.save(tl, i, 9); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step := func(what string, want int64) {
+		t.Helper()
+		if got := s.SafeHeight(CHAIN_ETH); got != want {
+			t.Fatalf("%s: safe height %d, want %d", what, got, want)
+		}
+		if got := d.Get(s.getWatermarkKey(tl)); got != want {
+			t.Fatalf("%s: stored watermark %d, want %d", what, got, want)
+		}
+	}
+	step("initialized", 9)
+	// 分片 0、2 跑在前面，分片 1 没动：水位停在 9
+	for _, h := range []int64{11, 12, 14} {
+		if !s.commit(ctx, tl, int(h%3), tl.epoch, &BlockLog{Num: h}) {
+			t.Fatalf("commit %d", h)
+		}
+	}
+	step("shard 1 behind", 9)
+	if !s.commit(ctx, tl, 1, tl.epoch, &BlockLog{Num: 10}) {
+		t.Fatal("commit 10")
+	}
+	step("shard 1 caught up", 12)
+	// 13 重试用完跳过：分片 1 的 checkpoint 越过它，水位停在它之前
+	if err := s.addDead(tl, 13); err != nil {
+		t.Fatal(err)
+	}
+	if !s.commit(ctx, tl, 1, tl.epoch, &BlockLog{Num: 13}) {
+		t.Fatal("commit 13")
+	}
+	step("dead letter", 12)
+	if err := s.retryDead(ctx, tl, 13); err != nil {
+		t.Fatal(err)
+	}
+	step("dead letter revived", 14)
+	// 回滚让水位变小：单调存储上走 Rewind
+	tl.mu.Lock()
+	err := s.rewind(tl, 0, 9)
+	tl.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	step("rolled back", 11)
+}
@@ -0,0 +1,599 @@
+package bg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	WebhookSignatureHeader = "X-Yscan-Signature" // sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+	WebhookTimestampHeader = "X-Yscan-Timestamp" // Unix 秒
+	WebhookEventHeader     = "X-Yscan-Event"
+	WebhookIDHeader        = "X-Yscan-Id" // 消息去重 ID，同一条消息重发时不变，接收方按它去重
+
+	webhookSentMax = 10000 // 同步模式每个地址最多记住的已送达 ID，超过时清空，退化为可能重发
+
+	defaultWebhookTimeout = 10 * time.Second
+	webhookCompactSize    = 4 << 20 // 已投递部分超过该大小时压缩队列文件
+)
+
+// webhookStatusError 回调地址返回的非 2xx 状态
+type webhookStatusError struct {
+	code int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("status %d", e.code)
+}
+
+// retryable 4xx 中只有 408、429 值得重试，其余是请求本身被拒，重发也不会成功
+func retryable(err error) bool {
+	var se *webhookStatusError
+	if !errors.As(err, &se) || se.code < 400 || se.code >= 500 {
+		return true
+	}
+	return se.code == http.StatusRequestTimeout || se.code == http.StatusTooManyRequests
+}
+
+// WebhookTarget 一个回调地址
+type WebhookTarget struct {
+	URL     string
+	Secret  string            // HMAC 密钥，空=不签名
+	Headers map[string]string // 额外请求头
+}
+
+// WebhookCfg 回调投递配置
+type WebhookCfg struct {
+	Targets  []WebhookTarget
+	Timeout  time.Duration // 单次请求超时，0=默认10s
+	Retry    RetryCfg      // 重试退避；同步模式用完次数返回错误，队列模式一直重试；4xx（408、429 除外）不重试
+	QueueDir string        // 非空时每个地址一个持久化队列：Publish 写盘即返回，后台按顺序投递，重启后继续；4xx 被拒的记录移到同名 .dead 文件
+	DeadDir  string        // 同步模式（QueueDir 为空）必填：4xx 被拒的记录追加到该目录下每个地址一个的 .dead 文件后跳过，不卡住后面的投递
+}
+
+// WebhookSignature 回调签名，接收方用同样的方式校验
+func WebhookSignature(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSink 把每笔交易 POST 到各回调地址，同一地址严格按投递顺序发送
+// 对每个地址是至少一次：进程重启、队列写盘失败等情况下同一条消息可能重发，接收方按 X-Yscan-Id 去重
+type WebhookSink struct {
+	cfg    WebhookCfg
+	client *resty.Client
+	hooks  []*webhook
+	zap_l  *zap.Logger
+	stop   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+type webhook struct {
+	target WebhookTarget
+	mu     sync.Mutex          // 同步模式下保证同一地址的顺序
+	queue  *webhookQueue       // nil=同步模式
+	dead   string              // 同步模式的死信文件
+	sent   map[string]struct{} // 同步模式下所在批次还没整体成功、已送达该地址的消息 ID，由 mu 保护
+}
+
+func NewWebhookSink(cfg WebhookCfg, log *zap.Logger) (*WebhookSink, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, errors.New("webhook: no target")
+	}
+	if cfg.QueueDir == "" {
+		if cfg.DeadDir == "" {
+			return nil, errors.New("webhook: sync mode needs DeadDir for rejected records")
+		}
+		if err := os.MkdirAll(cfg.DeadDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultWebhookTimeout
+	}
+	w := &WebhookSink{
+		cfg:    cfg,
+		client: resty.New().SetTimeout(cfg.Timeout),
+		zap_l:  log,
+		stop:   make(chan struct{}),
+	}
+	for _, target := range cfg.Targets {
+		h := &webhook{target: target, sent: make(map[string]struct{})}
+		sum := sha1.Sum([]byte(target.URL))
+		if cfg.QueueDir == "" {
+			h.dead = filepath.Join(cfg.DeadDir, hex.EncodeToString(sum[:8])+".dead")
+		} else {
+			q, err := openWebhookQueue(filepath.Join(cfg.QueueDir, hex.EncodeToString(sum[:8])+".queue"))
+			if err != nil {
+				w.Close()
+				return nil, err
+			}
+			h.queue = q
+		}
+		w.hooks = append(w.hooks, h)
+	}
+	for _, h := range w.hooks {
+		if h.queue == nil {
+			continue
+		}
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.drain(h)
+		}()
+	}
+	return w, nil
+}
+
+// Publish 同步模式下全部地址发送成功才返回 nil；队列模式写入各地址队列即返回
+// 同步模式某个地址失败时其他地址照常发送，已送达的记在各地址上，Scan 重投同一批时只补发没送达的地址
+func (w *WebhookSink) Publish(ctx context.Context, batch []*ContractTokenTran) error {
+	bodies, err := marshalBatch(batch)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(batch))
+	for _, tran := range batch {
+		ids = append(ids, tranMsgID(tran))
+	}
+	if w.cfg.QueueDir != "" {
+		lines := make([][]byte, 0, len(bodies))
+		for i, body := range bodies {
+			lines = append(lines, queueRecord(ids[i], body))
+		}
+		for _, h := range w.hooks {
+			if err := h.queue.push(lines); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var errs error
+	for _, h := range w.hooks {
+		errs = errors.Join(errs, w.sendAll(ctx, h, batch, ids, bodies))
+	}
+	if errs != nil {
+		return errs
+	}
+	// 整批成功后不会再重投，不用再记
+	for _, h := range w.hooks {
+		h.mu.Lock()
+		for _, id := range ids {
+			delete(h.sent, id)
+		}
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// markSent 记下已送达该地址的消息；调用方持有 h.mu
+func (h *webhook) markSent(id string) {
+	if len(h.sent) >= webhookSentMax {
+		clear(h.sent)
+	}
+	h.sent[id] = struct{}{}
+}
+
+func (w *WebhookSink) sendAll(ctx context.Context, h *webhook, batch []*ContractTokenTran, ids []string, bodies [][]byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, body := range bodies {
+		if _, ok := h.sent[ids[i]]; ok {
+			continue
+		}
+		var err error
+		for attempt := 1; ; attempt++ {
+			if err = w.send(ctx, h, batch[i].Event, ids[i], body); err == nil || !retryable(err) {
+				break
+			}
+			if n := w.cfg.Retry.attempts(); n > 0 && attempt >= n {
+				return fmt.Errorf("webhook %s: %w", h.target.URL, err)
+			}
+			w.logFailed(h, attempt, err)
+			if err := sleepCtx(ctx, w.cfg.Retry.backoff(attempt)); err != nil {
+				return err
+			}
+		}
+		if err == nil {
+			h.markSent(ids[i])
+			continue
+		}
+		// 被接收方拒绝，重发也不会成功：与队列模式一样移到死信文件，继续投递后面的
+		if e := appendDead(h.dead, body); e != nil {
+			return fmt.Errorf("webhook %s: %w (dead letter: %v)", h.target.URL, err, e)
+		}
+		if w.zap_l != nil {
+			w.zap_l.Error("webhook.send",
+				zap.String("event", "dead_letter"),
+				zap.String("url", h.target.URL),
+				zap.String("err", err.Error()),
+			)
+		}
+		h.markSent(ids[i])
+	}
+	return nil
+}
+
+func (w *WebhookSink) send(ctx context.Context, h *webhook, event TranEvent, id string, body []byte) error {
+	ts := time.Now().Unix()
+	req := w.client.R().SetContext(ctx).
+		SetHeaders(h.target.Headers).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(WebhookTimestampHeader, strconv.FormatInt(ts, 10)).
+		SetHeader(WebhookEventHeader, string(event)).
+		SetBody(body)
+	if id != "" {
+		req.SetHeader(WebhookIDHeader, id)
+	}
+	if h.target.Secret != "" {
+		req.SetHeader(WebhookSignatureHeader, WebhookSignature(h.target.Secret, ts, body))
+	}
+	resp, err := req.Post(h.target.URL)
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return &webhookStatusError{code: resp.StatusCode()}
+	}
+	return nil
+}
+
+// drain 队列模式下按顺序投递，失败一直按退避重试，不可重试的移到死信文件；Close 后退出，未投递的留在队列里
+func (w *WebhookSink) drain(h *webhook) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		line, err := h.queue.peek()
+		if err != nil {
+			if s := w.zap_l; s != nil {
+				s.Error("webhook.queue",
+					zap.String("event", "read_failed"),
+					zap.String("url", h.target.URL),
+					zap.String("err", err.Error()),
+				)
+			}
+			if sleepCtx(ctx, failCooldown) != nil {
+				return
+			}
+			continue
+		}
+		if line == nil {
+			select {
+			case <-h.queue.notify:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		id, body := parseQueueRecord(line)
+		var meta struct {
+			Event TranEvent `json:"event"`
+		}
+		if err = json.Unmarshal(body, &meta); err == nil {
+			for attempt := 1; ; attempt++ {
+				if err = w.send(ctx, h, meta.Event, id, body); err == nil || !retryable(err) {
+					break
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				w.logFailed(h, attempt, err)
+				if sleepCtx(ctx, w.cfg.Retry.backoff(attempt)) != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			// 损坏的记录或被接收方拒绝，重试无用，移走后继续投递后面的
+			if e := h.queue.bury(body); e != nil {
+				if w.zap_l != nil {
+					w.zap_l.Error("webhook.queue",
+						zap.String("event", "dead_save_failed"),
+						zap.String("url", h.target.URL),
+						zap.String("err", e.Error()),
+					)
+				}
+				if sleepCtx(ctx, failCooldown) != nil {
+					return
+				}
+				continue
+			}
+			if w.zap_l != nil {
+				w.zap_l.Error("webhook.queue",
+					zap.String("event", "dead_letter"),
+					zap.String("url", h.target.URL),
+					zap.String("err", err.Error()),
+				)
+			}
+		}
+		if err := h.queue.pop(); err != nil && w.zap_l != nil {
+			w.zap_l.Error("webhook.queue",
+				zap.String("event", "ack_failed"),
+				zap.String("url", h.target.URL),
+				zap.String("err", err.Error()),
+			)
+		}
+	}
+}
+
+func (w *WebhookSink) logFailed(h *webhook, attempt int, err error) {
+	if w.zap_l == nil {
+		return
+	}
+	w.zap_l.Warn("webhook.send",
+		zap.String("event", "send_failed"),
+		zap.String("url", h.target.URL),
+		zap.Int("attempt", attempt),
+		zap.String("err", err.Error()),
+	)
+}
+
+// Close 停止后台投递并关闭队列文件
+func (w *WebhookSink) Close() error {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	w.wg.Wait()
+	var err error
+	for _, h := range w.hooks {
+		if h.queue != nil {
+			err = errors.Join(err, h.queue.close())
+		}
+	}
+	return err
+}
+
+// queueRecord 队列里的一行：消息 ID、制表符、交易 JSON；JSON 里的制表符都已转义
+func queueRecord(id string, body []byte) []byte {
+	line := make([]byte, 0, len(id)+1+len(body))
+	line = append(line, id...)
+	line = append(line, '\t')
+	return append(line, body...)
+}
+
+// parseQueueRecord 旧版本写入的行只有 JSON，没有消息 ID
+func parseQueueRecord(line []byte) (string, []byte) {
+	if i := bytes.IndexByte(line, '\t'); i >= 0 && !bytes.HasPrefix(line, []byte("{")) {
+		return string(line[:i]), line[i+1:]
+	}
+	return "", line
+}
+
+// webhookQueue 一个地址的持久化队列：数据文件每行一条，offset 文件记录已投递到的位置
+type webhookQueue struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File // 追加写
+	r      *os.File // 顺序读
+	offset int64    // 第一条未投递记录的位置
+	next   int64    // peek 返回记录之后的位置
+	notify chan struct{}
+}
+
+func openWebhookQueue(path string) (*webhookQueue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := trimPartial(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	q := &webhookQueue{path: path, f: f, r: r, notify: make(chan struct{}, 1)}
+	if raw, err := os.ReadFile(path + ".offset"); err == nil {
+		q.offset, _ = strconv.ParseInt(string(raw), 10, 64)
+	}
+	q.offset = min(q.offset, size)
+	q.next = q.offset
+	return q, nil
+}
+
+// trimPartial 截掉崩溃时写了一半、没有换行的最后一行，否则下次追加会和它拼成一行被当成损坏记录；返回截断后的大小
+func trimPartial(f *os.File) (int64, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := st.Size()
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := min(int64(len(buf)), end)
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == st.Size() {
+		return end, nil
+	}
+	if err := f.Truncate(end); err != nil {
+		return 0, err
+	}
+	return end, f.Sync()
+}
+
+func (q *webhookQueue) push(bodies [][]byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	buf := make([]byte, 0)
+	for _, body := range bodies {
+		buf = append(buf, body...)
+		buf = append(buf, '\n')
+	}
+	if _, err := q.f.Write(buf); err != nil {
+		return err
+	}
+	if err := q.f.Sync(); err != nil {
+		return err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek 第一条未投递的记录，没有返回 nil
+func (q *webhookQueue) peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.r.Seek(q.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(q.r).ReadBytes('\n')
+	if errors.Is(err, io.EOF) {
+		// 没有完整的一行
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.next = q.offset + int64(len(line))
+	return line[:len(line)-1], nil
+}
+
+// pop 确认 peek 返回的记录已投递；队列清空时先记 offset=0 再截断文件，已投递部分过大时压缩，中途崩溃只会重发不会丢
+func (q *webhookQueue) pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.offset = q.next
+	st, err := q.f.Stat()
+	if err != nil {
+		return q.saveOffset()
+	}
+	if st.Size() != q.offset {
+		if q.offset >= webhookCompactSize {
+			return q.compact()
+		}
+		return q.saveOffset()
+	}
+	q.offset, q.next = 0, 0
+	if err := q.saveOffset(); err != nil {
+		return err
+	}
+	return q.f.Truncate(0)
+}
+
+// compact 未投递部分写到新文件替换原文件；调用方持有 q.mu
+func (q *webhookQueue) compact() error {
+	tmp := q.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := q.r.Seek(q.offset, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, q.r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := errors.Join(out.Sync(), out.Close()); err != nil {
+		return err
+	}
+	// 先记 offset=0 再替换，替换前崩溃会从原文件开头重发
+	offset := q.offset
+	q.offset, q.next = 0, 0
+	if err := q.saveOffset(); err != nil {
+		q.offset, q.next = offset, offset
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(q.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(q.path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	q.f.Close()
+	q.r.Close()
+	q.f, q.r = f, r
+	return nil
+}
+
+func (q *webhookQueue) saveOffset() error {
+	tmp := q.path + ".offset.tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatInt(q.offset, 10)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := errors.Join(f.Sync(), f.Close()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path+".offset")
+}
+
+// bury 不可重试的记录追加到死信文件，之后由调用方 pop
+func (q *webhookQueue) bury(body []byte) error {
+	return appendDead(q.path+".dead", body)
+}
+
+// appendDead 一条记录一行追加到死信文件
+func appendDead(path string, body []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	line := append(append(make([]byte, 0, len(body)+1), body...), '\n')
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.Join(f.Sync(), f.Close())
+}
+
+func (q *webhookQueue) close() error {
+	return errors.Join(q.f.Close(), q.r.Close())
+}
@@ -0,0 +1,476 @@
+package bg
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookServer 记录收到的回调，fail 返回非 nil 时按该状态码拒绝
+type hookServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	hits int
+	got  []string // 已接受的 TxId，按到达顺序
+	ids  []string // 已接受请求的 X-Yscan-Id
+	fail func(tran *ContractTokenTran, hit int) int
+}
+
+func newHookServer(t *testing.T, secret string) *hookServer {
+	hs := &hookServer{}
+	hs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, err := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+		if err != nil || time.Since(time.Unix(ts, 0)).Abs() > time.Minute {
+			t.Errorf("bad timestamp header %q", r.Header.Get(WebhookTimestampHeader))
+		}
+		if secret != "" && r.Header.Get(WebhookSignatureHeader) != WebhookSignature(secret, ts, body) {
+			t.Errorf("bad signature %q", r.Header.Get(WebhookSignatureHeader))
+		}
+		tran := &ContractTokenTran{}
+		if err := json.Unmarshal(body, tran); err != nil {
+			t.Errorf("bad body %s: %v", body, err)
+		}
+		if r.Header.Get(WebhookEventHeader) != string(tran.Event) {
+			t.Errorf("event header %q, body event %q", r.Header.Get(WebhookEventHeader), tran.Event)
+		}
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		hs.hits++
+		if hs.fail != nil {
+			if code := hs.fail(tran, hs.hits); code != 0 {
+				w.WriteHeader(code)
+				return
+			}
+		}
+		hs.got = append(hs.got, tran.TxId)
+		hs.ids = append(hs.ids, r.Header.Get(WebhookIDHeader))
+	}))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func (hs *hookServer) received() []string {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return append([]string(nil), hs.got...)
+}
+
+func (hs *hookServer) setFail(fail func(tran *ContractTokenTran, hit int) int) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.fail = fail
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func hookBatch(ids ...string) []*ContractTokenTran {
+	out := make([]*ContractTokenTran, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, &ContractTokenTran{Type: CHAIN_ETH, TxId: id, BlockNum: 1, Event: EventConfirmed})
+	}
+	return out
+}
+
+func TestWebhookSignedHeaders(t *testing.T) {
+	hs := newHookServer(t, "secret")
+	w, err := NewWebhookSink(WebhookCfg{Targets: []WebhookTarget{{URL: hs.URL, Secret: "secret"}}, DeadDir: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	batch := hookBatch("a")
+	batch = append(batch, &ContractTokenTran{TxId: "b", Event: EventRetracted})
+	if err := w.Publish(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(hs.received(), ","); got != "a,b" {
+		t.Fatalf("received %s", got)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// 与接收方约定的格式：HMAC-SHA256(secret, ts + "." + body)，即 openssl dgst -sha256 -hmac key
+	got := WebhookSignature("key", 1700000000, []byte(`{"a":1}`))
+	want := "sha256=a438e398bfafc57e4396bb7fc2304422f0f768e965d073ca313cb52e22e6ad03"
+	if got != want {
+		t.Fatalf("signature %s, want %s", got, want)
+	}
+}
+
+func TestWebhookRetry5xx(t *testing.T) {
+	hs := newHookServer(t, "")
+	hs.setFail(func(_ *ContractTokenTran, hit int) int {
+		if hit <= 2 {
+			return http.StatusBadGateway
+		}
+		return 0
+	})
+	w, err := NewWebhookSink(WebhookCfg{
+		Targets: []WebhookTarget{{URL: hs.URL}},
+		Retry:   RetryCfg{MaxAttempts: 3, BaseDelay: time.Millisecond},
+		DeadDir: t.TempDir(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Publish(context.Background(), hookBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+	if hs.hits != 3 || len(hs.received()) != 1 {
+		t.Fatalf("hits %d received %v", hs.hits, hs.received())
+	}
+
+	hs.setFail(func(*ContractTokenTran, int) int { return http.StatusServiceUnavailable })
+	if err := w.Publish(context.Background(), hookBatch("b")); err == nil {
+		t.Fatal("expected error after attempts exhausted")
+	}
+}
+
+func TestWebhook4xxNotRetried(t *testing.T) {
+	reject := func(tran *ContractTokenTran, _ int) int {
+		if tran.TxId == "bad" {
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+	hs := newHookServer(t, "")
+	hs.setFail(reject)
+	// 同步模式必须有地方放被拒的记录
+	if _, err := NewWebhookSink(WebhookCfg{Targets: []WebhookTarget{{URL: hs.URL}}}, nil); err == nil {
+		t.Fatal("sync mode without DeadDir accepted")
+	}
+	// 同步模式移到死信文件后继续，不让一条被拒的记录卡住该地址
+	syncDir := t.TempDir()
+	w, err := NewWebhookSink(WebhookCfg{
+		Targets: []WebhookTarget{{URL: hs.URL}},
+		Retry:   RetryCfg{MaxAttempts: 5, BaseDelay: time.Millisecond},
+		DeadDir: syncDir,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Publish(context.Background(), hookBatch("bad", "next")); err != nil {
+		t.Fatal(err)
+	}
+	if hs.hits != 2 || strings.Join(hs.received(), ",") != "next" {
+		t.Fatalf("400 retried or blocked: %d hits, received %v", hs.hits, hs.received())
+	}
+	dead, _ := filepath.Glob(filepath.Join(syncDir, "*.dead"))
+	if len(dead) != 1 {
+		t.Fatalf("sync dead files %v", dead)
+	}
+	if raw, err := os.ReadFile(dead[0]); err != nil || !strings.Contains(string(raw), `"bad"`) {
+		t.Fatalf("sync dead file %q %v", raw, err)
+	}
+	w.Close()
+	hs = newHookServer(t, "")
+	hs.setFail(reject)
+
+	// 队列模式移到死信文件，后面的照常投递
+	dir := t.TempDir()
+	w, err = NewWebhookSink(WebhookCfg{
+		Targets:  []WebhookTarget{{URL: hs.URL}},
+		Retry:    RetryCfg{BaseDelay: time.Millisecond},
+		QueueDir: dir,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Publish(context.Background(), hookBatch("bad", "next")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "next delivered", func() bool { return len(hs.received()) == 1 })
+	dead, _ = filepath.Glob(filepath.Join(dir, "*.queue.dead"))
+	if len(dead) != 1 {
+		t.Fatalf("dead files %v", dead)
+	}
+	raw, err := os.ReadFile(dead[0])
+	if err != nil || !strings.Contains(string(raw), `"bad"`) || strings.Count(string(raw), "\n") != 1 {
+		t.Fatalf("dead file %q %v", raw, err)
+	}
+}
+
+func TestWebhook429Retried(t *testing.T) {
+	hs := newHookServer(t, "")
+	hs.setFail(func(_ *ContractTokenTran, hit int) int {
+		if hit == 1 {
+			return http.StatusTooManyRequests
+		}
+		return 0
+	})
+	w, err := NewWebhookSink(WebhookCfg{
+		Targets: []WebhookTarget{{URL: hs.URL}},
+		Retry:   RetryCfg{MaxAttempts: 3, BaseDelay: time.Millisecond},
+		DeadDir: t.TempDir(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Publish(context.Background(), hookBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookQueueOrder(t *testing.T) {
+	a, b := newHookServer(t, ""), newHookServer(t, "")
+	// a 每隔几条失败一次，b 不失败；各自的顺序都应与发布顺序一致
+	a.setFail(func(_ *ContractTokenTran, hit int) int {
+		if hit%3 == 0 {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+	w, err := NewWebhookSink(WebhookCfg{
+		Targets:  []WebhookTarget{{URL: a.URL}, {URL: b.URL}},
+		Retry:    RetryCfg{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		QueueDir: t.TempDir(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	want := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		ids := []string{strconv.Itoa(i*3 + 1), strconv.Itoa(i*3 + 2), strconv.Itoa(i*3 + 3)}
+		want = append(want, ids...)
+		if err := w.Publish(context.Background(), hookBatch(ids...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, hs := range []*hookServer{a, b} {
+		waitFor(t, "all delivered", func() bool { return len(hs.received()) == len(want) })
+		if got := strings.Join(hs.received(), ","); got != strings.Join(want, ",") {
+			t.Fatalf("order %s", got)
+		}
+	}
+}
+
+func TestWebhookQueueResume(t *testing.T) {
+	hs := newHookServer(t, "")
+	hs.setFail(func(*ContractTokenTran, int) int { return http.StatusServiceUnavailable })
+	cfg := WebhookCfg{
+		Targets:  []WebhookTarget{{URL: hs.URL}},
+		Retry:    RetryCfg{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+		QueueDir: t.TempDir(),
+	}
+	w, err := NewWebhookSink(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Publish(context.Background(), hookBatch("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "first attempt", func() bool {
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		return hs.hits > 0
+	})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hs.setFail(nil)
+	w, err = NewWebhookSink(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Publish(context.Background(), hookBatch("c")); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭时被放弃的请求可能已经到了服务端，允许重复，但顺序不变
+	uniq := func() string {
+		out := make([]string, 0)
+		for _, id := range hs.received() {
+			if len(out) == 0 || out[len(out)-1] != id {
+				out = append(out, id)
+			}
+		}
+		return strings.Join(out, ",")
+	}
+	waitFor(t, "queue drained", func() bool { return uniq() == "a,b,c" })
+}
+
+func TestWebhookQueuePartialLine(t *testing.T) {
+	hs := newHookServer(t, "")
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte(hs.URL))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:8])+".queue")
+	// 上次写到一半崩溃：最后一行没有换行
+	first := queueRecord("id-a", []byte(`{"txid":"a","event":"confirmed"}`))
+	if err := os.WriteFile(path, append(append(first, '\n'), `id-x\t{"txid":"x","ev`...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebhookSink(WebhookCfg{Targets: []WebhookTarget{{URL: hs.URL}}, QueueDir: dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Publish(context.Background(), hookBatch("b")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "queue drained", func() bool { return len(hs.received()) == 2 })
+	if got := strings.Join(hs.received(), ","); got != "a,b" {
+		t.Fatalf("received %s", got)
+	}
+	if dead, _ := filepath.Glob(filepath.Join(dir, "*.dead")); len(dead) != 0 {
+		t.Fatalf("dead files %v", dead)
+	}
+}
+
+func TestWebhookQueueCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.queue")
+	q, err := openWebhookQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push([][]byte{[]byte("one"), []byte("two"), []byte("three")}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := q.peek(); err != nil || string(body) != "one" {
+		t.Fatalf("peek %q %v", body, err)
+	}
+	q.mu.Lock()
+	q.offset = q.next
+	err = q.compact()
+	q.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(path)
+	off, _ := os.ReadFile(path + ".offset")
+	if string(raw) != "two\nthree\n" || string(off) != "0" {
+		t.Fatalf("after compact %q offset %q", raw, off)
+	}
+	// 压缩后继续追加和读取
+	if err := q.push([][]byte{[]byte("four")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+	q, err = openWebhookQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	got := make([]string, 0)
+	for {
+		body, err := q.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body == nil {
+			break
+		}
+		got = append(got, string(body))
+		if err := q.pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(got, ",") != "two,three,four" {
+		t.Fatalf("after reopen %v", got)
+	}
+	if st, _ := os.Stat(path); st.Size() != 0 {
+		t.Fatalf("drained queue not truncated: %d bytes", st.Size())
+	}
+}
+
+func TestWebhookSyncPartialFailure(t *testing.T) {
+	a, b := newHookServer(t, ""), newHookServer(t, "")
+	// b 收下 x 后拒绝 y，a 一切正常
+	b.setFail(func(tran *ContractTokenTran, _ int) int {
+		if tran.TxId == "y" {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	})
+	w, err := NewWebhookSink(WebhookCfg{
+		Targets: []WebhookTarget{{URL: b.URL}, {URL: a.URL}},
+		Retry:   RetryCfg{MaxAttempts: 2, BaseDelay: time.Millisecond},
+		DeadDir: t.TempDir(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	batch := hookBatch("x", "y")
+	if err := w.Publish(context.Background(), batch); err == nil {
+		t.Fatal("partial failure not reported")
+	}
+	// 前面的地址失败不影响后面的地址
+	if got := strings.Join(a.received(), ","); got != "x,y" {
+		t.Fatalf("a received %s", got)
+	}
+	// Scan 重投同一批：只补发各地址没送达的
+	b.setFail(nil)
+	if err := w.Publish(context.Background(), hookBatch("x", "y")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(a.received(), ","); got != "x,y" {
+		t.Fatalf("a received %s after redelivery", got)
+	}
+	if got := strings.Join(b.received(), ","); got != "x,y" {
+		t.Fatalf("b received %s after redelivery", got)
+	}
+	if want := tranMsgID(batch[0]); a.ids[0] != want || b.ids[0] != want {
+		t.Fatalf("message ids %v %v, want %s", a.ids, b.ids, want)
+	}
+	// 整批成功后不再记住，之后重扫的重复由接收方按 ID 去重
+	for _, h := range w.hooks {
+		if len(h.sent) != 0 {
+			t.Fatalf("sent ids left %v", h.sent)
+		}
+	}
+}
+
+func TestWebhookQueueIDs(t *testing.T) {
+	hs := newHookServer(t, "")
+	dir := t.TempDir()
+	cfg := WebhookCfg{Targets: []WebhookTarget{{URL: hs.URL}}, QueueDir: dir}
+	// 旧版本写入的记录只有 JSON，升级后照常投递，只是不带 ID
+	sum := sha1.Sum([]byte(hs.URL))
+	legacy := filepath.Join(dir, hex.EncodeToString(sum[:8])+".queue")
+	if err := os.WriteFile(legacy, []byte(`{"txid":"old","event":"confirmed"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebhookSink(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	batch := hookBatch("new")
+	if err := w.Publish(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "queue drained", func() bool { return len(hs.received()) == 2 })
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if strings.Join(hs.got, ",") != "old,new" || hs.ids[0] != "" || hs.ids[1] != tranMsgID(batch[0]) {
+		t.Fatalf("received %v ids %v", hs.got, hs.ids)
+	}
+}